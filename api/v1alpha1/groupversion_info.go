@@ -0,0 +1,23 @@
+// Package v1alpha1 contains the Widget custom resource. It lets you reproduce
+// the race on a custom resource, since the cache treats CRDs differently from
+// built-in types (e.g., they are served as JSON instead of protobuf).
+//
+// +kubebuilder:object:generate=true
+// +groupName=cacherace.io
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the group version used to register these objects.
+	GroupVersion = schema.GroupVersion{Group: "cacherace.io", Version: "v1alpha1"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme.
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types in this group-version to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
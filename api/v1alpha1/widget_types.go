@@ -0,0 +1,74 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WidgetSpec is the desired state of a Widget. There isn't much to it: the
+// reconciler only ever touches the Widget's annotations or status.
+type WidgetSpec struct {
+	// +optional
+	Color string `json:"color,omitempty"`
+}
+
+// WidgetStatus is written by the reconciler when it is configured to write to
+// the status rather than to the annotations.
+type WidgetStatus struct {
+	// Found holds the same key/value pairs as the annotations that the
+	// reconciler would otherwise add.
+	// +optional
+	Found map[string]string `json:"found,omitempty"`
+
+	// Conditions holds the CacheConsistent condition when the reconciler is
+	// configured to report on the consistency of its cache.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+
+// Widget is a namespaced custom resource that mirrors the Secrets used by the
+// reproducer.
+type Widget struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WidgetSpec   `json:"spec,omitempty"`
+	Status WidgetStatus `json:"status,omitempty"`
+}
+
+// StatusFound returns the key/value pairs written to the status.
+func (w *Widget) StatusFound() map[string]string {
+	return w.Status.Found
+}
+
+// SetStatusFound replaces the key/value pairs written to the status.
+func (w *Widget) SetStatusFound(found map[string]string) {
+	w.Status.Found = found
+}
+
+// GetConditions returns the conditions of the status.
+func (w *Widget) GetConditions() []metav1.Condition {
+	return w.Status.Conditions
+}
+
+// SetConditions replaces the conditions of the status.
+func (w *Widget) SetConditions(conditions []metav1.Condition) {
+	w.Status.Conditions = conditions
+}
+
+// +kubebuilder:object:root=true
+
+// WidgetList contains a list of Widget.
+type WidgetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Widget `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Widget{}, &WidgetList{})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// benchmarkOptions are set from the flags of the benchmark subcommand.
+type benchmarkOptions struct {
+	Namespace  string
+	Iterations int
+}
+
+// runBenchmark annotates a probe Secret Iterations times, the same way as the
+// CacheLagProber does, and prints the share of the reads of the cache that
+// were stale right after the write along with the percentiles of the time the
+// cache took to catch up. The probe Secret is deleted at the end.
+func runBenchmark(ctx context.Context, rc *rest.Config, log logr.Logger, out io.Writer, opts benchmarkOptions) error {
+	if opts.Iterations <= 0 {
+		return fmt.Errorf("--iterations must be positive, got %d", opts.Iterations)
+	}
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	if err != nil {
+		return fmt.Errorf("while building the scheme: %w", err)
+	}
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             log,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return fmt.Errorf("while creating the manager: %w", err)
+	}
+	// The informer must exist before the manager starts for the cache to be
+	// synced once started is closed.
+	_, err = mgr.GetCache().GetInformer(ctx, &corev1.Secret{})
+	if err != nil {
+		return fmt.Errorf("while creating the Secret informer: %w", err)
+	}
+
+	mgrCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	started, errc := StartManager(mgrCtx, mgr)
+	select {
+	case <-started:
+	case err := <-errc:
+		return fmt.Errorf("while starting the manager: %w", err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		stop()
+		<-errc
+	}()
+
+	key := types.NamespacedName{Namespace: opts.Namespace, Name: "cacherace-benchmark-" + rand.String(5)}
+	defer func() {
+		// The context may be done already, which is why the cleanup gets
+		// a context of its own.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := client.IgnoreNotFound(mgr.GetClient().Delete(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}))
+		if err != nil {
+			log.Error(err, "while deleting the probe Secret", "secret", key)
+		}
+	}()
+
+	prober := &CacheLagProber{Client: mgr.GetClient(), Cache: mgr.GetCache(), Log: log, Key: key}
+	lags := make([]time.Duration, 0, opts.Iterations)
+	stales := 0
+	for i := 0; i < opts.Iterations; i++ {
+		lag, stale, err := prober.probe(ctx, log.WithValues("secret", key), 10*time.Second)
+		if err != nil {
+			return fmt.Errorf("while probing %d out of %d: %w", i+1, opts.Iterations, err)
+		}
+		lags = append(lags, lag)
+		if stale {
+			stales++
+		}
+	}
+	sort.Slice(lags, func(i, j int) bool { return lags[i] < lags[j] })
+
+	fmt.Fprintf(out, "iterations: %d\n", opts.Iterations)
+	fmt.Fprintf(out, "stale reads: %d/%d (%.1f%%)\n", stales, opts.Iterations, 100*float64(stales)/float64(opts.Iterations))
+	fmt.Fprintf(out, "cache catch-up latency: p50=%s p99=%s\n", percentile(lags, 0.50), percentile(lags, 0.99))
+	return nil
+}
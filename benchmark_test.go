@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRunBenchmark(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Second)
+	defer cancel()
+
+	var out bytes.Buffer
+	err = runBenchmark(ctx, rc, logger, &out, benchmarkOptions{Namespace: "default", Iterations: 5})
+	require.NoError(t, err)
+	t.Logf("Output:\n%s", out.String())
+	require.Regexp(t, `(?m)^iterations: 5$`, out.String())
+	require.Regexp(t, `(?m)^stale reads: \d/5 \(\d+\.\d%\)$`, out.String())
+	require.Regexp(t, `(?m)^cache catch-up latency: p50=\S+ p99=\S+$`, out.String())
+
+	t.Log("The probe Secret should be gone")
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+	var secrets corev1.SecretList
+	require.NoError(t, kc.List(ctx, &secrets, client.InNamespace("default")))
+	for _, secret := range secrets.Items {
+		require.False(t, strings.HasPrefix(secret.Name, "cacherace-benchmark-"), "left behind: %s", secret.Name)
+	}
+}
+
+func TestRunBenchmark_InvalidIterations(t *testing.T) {
+	err := runBenchmark(context.Background(), nil, nil, nil, benchmarkOptions{Iterations: 0})
+	require.EqualError(t, err, "--iterations must be positive, got 0")
+}
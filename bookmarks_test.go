@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+func TestWithoutWatchBookmarks(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const runs = 5
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DisableWatchBookmarks=%t", disabled), func(t *testing.T) {
+			// The watches are recorded as they go out, i.e., after the
+			// round tripper that RunScenario adds has dropped the bookmarks.
+			watches := &watchRecorder{}
+			recorded := rest.CopyConfig(rc)
+			recorded.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+				return watchRecordingRoundTripper{next: rt, watches: watches}
+			})
+
+			stale := 0
+			for i := 0; i < runs; i++ {
+				report, err := RunScenario(context.Background(), ScenarioConfig{
+					RestConfig:            recorded,
+					Log:                   logger,
+					Name:                  fmt.Sprintf("secret-%t-%d", disabled, i),
+					RequeueOnStale:        100 * time.Millisecond,
+					DisableWatchBookmarks: disabled,
+				})
+				require.NoError(t, err)
+				if report.StaleReadObserved {
+					stale++
+				}
+			}
+			t.Logf("Stale reads: %d/%d", stale, runs)
+
+			total, withBookmarks := watches.counts()
+			require.Greater(t, total, 0)
+			if disabled {
+				require.Equal(t, 0, withBookmarks)
+			} else {
+				require.Equal(t, total, withBookmarks)
+			}
+		})
+	}
+}
+
+type watchRecorder struct {
+	mu                   sync.Mutex
+	total, withBookmarks int
+}
+
+func (r *watchRecorder) counts() (total, withBookmarks int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.total, r.withBookmarks
+}
+
+type watchRecordingRoundTripper struct {
+	next    http.RoundTripper
+	watches *watchRecorder
+}
+
+func (rt watchRecordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	query := req.URL.Query()
+	if query.Get("watch") == "true" {
+		rt.watches.mu.Lock()
+		rt.watches.total++
+		if query.Get("allowWatchBookmarks") == "true" {
+			rt.watches.withBookmarks++
+		}
+		rt.watches.mu.Unlock()
+	}
+	return rt.next.RoundTrip(req)
+}
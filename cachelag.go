@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ProbeAnnotation is the annotation that the CacheLagProber writes to the
+// probe Secret.
+const ProbeAnnotation = "cacherace.io/probe"
+
+// CacheLagProber is a Runnable that measures how far behind the apiserver the
+// cache is. Every Interval, it annotates the probe Secret and times how long
+// the cache takes to return the resourceVersion that the apiserver
+// acknowledged. The last measure is exported as the gauge
+// cacherace_cache_sync_lag_seconds.
+type CacheLagProber struct {
+	Client client.Client // Used for the writes, e.g., mgr.GetClient().
+	Cache  client.Reader // Where the lag is measured, e.g., mgr.GetCache().
+	Log    logr.Logger   // Defaults to logr.Discard().
+
+	// Key is the probe Secret. It gets created if it doesn't exist.
+	Key types.NamespacedName
+
+	// Interval is the time between two probes. Defaults to 10 seconds.
+	Interval time.Duration
+}
+
+// Start probes until the context is done. A failed probe is logged and
+// doesn't stop the next ones.
+func (p *CacheLagProber) Start(ctx context.Context) error {
+	log := p.Log
+	if log == nil {
+		log = logr.Discard()
+	}
+	log = log.WithValues("secret", p.Key)
+	interval := p.Interval
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		lag, _, err := p.probe(ctx, log, interval)
+		if err != nil {
+			log.Error(err, "cache lag probe failed")
+			return
+		}
+		cacheSyncLag.WithLabelValues(p.Key.String()).Set(lag.Seconds())
+		log.V(1).Info("cache lag probed", "lag", lag)
+	}, interval)
+
+	return nil
+}
+
+// probe writes the probe annotation and returns the time between the moment
+// the apiserver acknowledged the write and the moment the cache had it, and
+// whether the first read of the cache, right after the write, was stale. It
+// gives up after the given timeout.
+func (p *CacheLagProber) probe(ctx context.Context, log logr.Logger, timeout time.Duration) (lag time.Duration, stale bool, err error) {
+	secret := &corev1.Secret{}
+	secret.Name, secret.Namespace = p.Key.Name, p.Key.Namespace
+	err = p.Client.Create(ctx, secret)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return 0, false, fmt.Errorf("while creating the probe Secret: %w", err)
+	}
+
+	// A merge patch doesn't carry the resourceVersion, which means it can't
+	// conflict with a stale read.
+	patch := client.RawPatch(types.MergePatchType, []byte(fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, ProbeAnnotation, time.Now().Format(time.RFC3339Nano))))
+	err = p.Client.Patch(ctx, secret, patch)
+	if err != nil {
+		return 0, false, fmt.Errorf("while annotating the probe Secret: %w", err)
+	}
+	acked := time.Now()
+	written := secret.ResourceVersion
+
+	first := true
+	err = PollLogged(ctx, log, 10*time.Millisecond, timeout, func() (bool, error) {
+		var cached corev1.Secret
+		err := p.Cache.Get(ctx, p.Key, &cached)
+		caughtUp := err == nil && !olderThan(cached.ResourceVersion, written)
+		if first {
+			stale = !caughtUp
+			first = false
+		}
+		switch {
+		case apierrors.IsNotFound(err):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+		return caughtUp, nil
+	})
+	if err != nil {
+		return 0, stale, fmt.Errorf("while waiting for the cache to have the resourceVersion %s: %w", written, err)
+	}
+
+	return time.Since(acked), stale, nil
+}
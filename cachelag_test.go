@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestCacheLagProber(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+
+	key := types.NamespacedName{Name: "probe", Namespace: "default"}
+	require.NoError(t, mgr.Add(&CacheLagProber{
+		Client:   mgr.GetClient(),
+		Cache:    mgr.GetCache(),
+		Log:      logger,
+		Key:      key,
+		Interval: 100 * time.Millisecond,
+	}))
+	startManager(t, ctx, mgr)
+
+	t.Log("Waiting for the first probe to be exported")
+	var lag float64
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		var found bool
+		var err error
+		lag, found, err = gaugeValue("cacherace_cache_sync_lag_seconds", "probe", key.String())
+		return found, err
+	}))
+	require.GreaterOrEqual(t, lag, 0.0)
+
+	var secret corev1.Secret
+	require.NoError(t, mgr.GetAPIReader().Get(ctx, key, &secret))
+	require.Contains(t, secret.Annotations, ProbeAnnotation)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+)
+
+// ClientWiring tells how the client returned by mgr.GetClient() splits the
+// reads from the writes. The wiring changed across controller-runtime
+// versions, and so did the objects that get read from the cache.
+type ClientWiring string
+
+const (
+	// ClientWiringDefault is what the vendored controller-runtime does, i.e.,
+	// cluster.DefaultNewClient: a delegating client that reads from the cache,
+	// except for the unstructured objects and the ones listed in
+	// ClientDisableCacheFor, and writes to the apiserver.
+	ClientWiringDefault ClientWiring = "Default"
+
+	// ClientWiringSplit composes the reader and the writer by hand, the way
+	// it was done with client.DelegatingClient in older controller-runtime
+	// versions: every read goes to the cache, every write to the apiserver.
+	ClientWiringSplit ClientWiring = "Split"
+
+	// ClientWiringDirect doesn't use the cache at all. Since the reconciler
+	// then reads from the apiserver, the race can't happen, which makes it
+	// a baseline to compare the other wirings against.
+	ClientWiringDirect ClientWiring = "Direct"
+)
+
+// NewClientFunc returns the func to set in ctrl.Options.NewClient for the
+// given wiring. An empty wiring is the same as ClientWiringDefault.
+func NewClientFunc(wiring ClientWiring) (cluster.NewClientFunc, error) {
+	switch wiring {
+	case "", ClientWiringDefault:
+		return cluster.DefaultNewClient, nil
+	case ClientWiringSplit:
+		return newSplitClient, nil
+	case ClientWiringDirect:
+		return newDirectClient, nil
+	default:
+		return nil, fmt.Errorf("unknown client wiring %q, must be one of %s, %s, %s", wiring, ClientWiringDefault, ClientWiringSplit, ClientWiringDirect)
+	}
+}
+
+// splitClient reads from the cache and writes to the apiserver.
+type splitClient struct {
+	client.Reader
+	client.Writer
+	client.StatusClient
+
+	uncached client.Client
+}
+
+func newSplitClient(c cache.Cache, config *rest.Config, options client.Options, _ ...client.Object) (client.Client, error) {
+	uncached, err := client.New(config, options)
+	if err != nil {
+		return nil, fmt.Errorf("while creating the uncached client: %w", err)
+	}
+	return &splitClient{Reader: c, Writer: uncached, StatusClient: uncached, uncached: uncached}, nil
+}
+
+func (c *splitClient) Scheme() *runtime.Scheme {
+	return c.uncached.Scheme()
+}
+
+func (c *splitClient) RESTMapper() meta.RESTMapper {
+	return c.uncached.RESTMapper()
+}
+
+func newDirectClient(_ cache.Cache, config *rest.Config, options client.Options, _ ...client.Object) (client.Client, error) {
+	uncached, err := client.New(config, options)
+	if err != nil {
+		return nil, fmt.Errorf("while creating the uncached client: %w", err)
+	}
+	return uncached, nil
+}
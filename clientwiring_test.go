@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestNewClientFunc(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	tests := []struct {
+		wiring       ClientWiring
+		wantLiveGets int
+	}{
+		{wiring: ClientWiringDefault, wantLiveGets: 0},
+		{wiring: ClientWiringSplit, wantLiveGets: 0},
+		{wiring: ClientWiringDirect, wantLiveGets: 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.wiring), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+			defer cancel()
+
+			secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-" + strings.ToLower(string(tt.wiring)), Namespace: "default"}}
+			require.NoError(t, kc.Create(ctx, &secret))
+
+			requests := &secretRequestCounter{path: "/api/v1/namespaces/default/secrets/" + secret.Name}
+			counted := rest.CopyConfig(rc)
+			counted.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+				return secretRequestRoundTripper{next: rt, requests: requests}
+			})
+
+			newClient, err := NewClientFunc(tt.wiring)
+			require.NoError(t, err)
+			mgr, err := ctrl.NewManager(counted, ctrl.Options{
+				Scheme:             scheme,
+				Logger:             logger,
+				MetricsBindAddress: "0",
+				NewClient:          newClient,
+			})
+			require.NoError(t, err)
+			startManager(t, ctx, mgr)
+
+			// The first Get starts the v1.Secret informer and waits for it
+			// to sync: the Secret is in the cache from then on.
+			var got corev1.Secret
+			require.NoError(t, mgr.GetClient().Get(ctx, client.ObjectKeyFromObject(&secret), &got))
+			got.Labels = map[string]string{"foo": "bar"}
+			require.NoError(t, mgr.GetClient().Update(ctx, &got))
+
+			gets, puts := requests.counts()
+			require.Equal(t, tt.wantLiveGets, gets, "GET requests on the Secret")
+			require.Equal(t, 1, puts, "PUT requests on the Secret")
+		})
+	}
+}
+
+func TestNewClientFunc_Unknown(t *testing.T) {
+	_, err := NewClientFunc("Legacy")
+	require.EqualError(t, err, `unknown client wiring "Legacy", must be one of Default, Split, Direct`)
+}
+
+// secretRequestCounter counts the GET and PUT requests on a single Secret.
+type secretRequestCounter struct {
+	path string
+
+	mu         sync.Mutex
+	gets, puts int
+}
+
+func (c *secretRequestCounter) counts() (gets, puts int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gets, c.puts
+}
+
+type secretRequestRoundTripper struct {
+	next     http.RoundTripper
+	requests *secretRequestCounter
+}
+
+func (rt secretRequestRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == rt.requests.path {
+		rt.requests.mu.Lock()
+		switch req.Method {
+		case http.MethodGet:
+			rt.requests.gets++
+		case http.MethodPut:
+			rt.requests.puts++
+		}
+		rt.requests.mu.Unlock()
+	}
+	return rt.next.RoundTrip(req)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// SetupConflictingReconcilers sets up two Secret controllers, "secret-a" and
+// "secret-b", that both want the annotation key on every Secret, one with
+// valueA and the other with valueB. Both leave the annotation alone once it is
+// set, so the first write wins. The loser only notices when its cache catches
+// up: until then, it keeps trying to add the annotation and its Updates are
+// rejected with a 409 Conflict. Which value wins is a matter of timing.
+func SetupConflictingReconcilers(mgr manager.Manager, key, valueA, valueB string) error {
+	for name, value := range map[string]string{"secret-a": valueA, "secret-b": valueB} {
+		err := (&AnnotatingReconciler{
+			Client:       mgr.GetClient(),
+			Log:          mgr.GetLogger(),
+			Annotations:  map[string]string{key: value},
+			KeepExisting: true,
+			Name:         name,
+		}).SetupWithManager(mgr)
+		if err != nil {
+			return fmt.Errorf("while setting up the %s controller: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestSetupConflictingReconcilers(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	require.NoError(t, SetupConflictingReconcilers(mgr, "winner", "a", "b"))
+
+	startManager(t, ctx, mgr)
+
+	// Each Secret is a run of the race.
+	const runs = 10
+	var secrets []corev1.Secret
+	for i := 0; i < runs; i++ {
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("secret-%d", i), Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+		secrets = append(secrets, secret)
+	}
+
+	t.Log("Waiting for every Secret to have a winner")
+	winners := make(map[string]string)
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		for _, secret := range secrets {
+			err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+			if err != nil {
+				return false, err
+			}
+			winner, ok := secret.Annotations["winner"]
+			if !ok {
+				return false, nil
+			}
+			winners[secret.Name] = winner
+		}
+		return true, nil
+	}))
+
+	t.Log("The first write should never be overwritten")
+	time.Sleep(time.Second)
+	wins := map[string]int{}
+	for _, secret := range secrets {
+		require.NoError(t, kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret))
+		require.Equal(t, winners[secret.Name], secret.Annotations["winner"], "the value of %s flipped", secret.Name)
+		wins[secret.Annotations["winner"]]++
+	}
+	require.Equal(t, runs, wins["a"]+wins["b"])
+
+	t.Logf("Out of %d runs, a won %d times and b won %d times", runs, wins["a"], wins["b"])
+	if wins["a"] > 0 && wins["b"] > 0 {
+		t.Log("The winner changed across runs: the outcome is not deterministic")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// updateFunc is the signature shared by client.Writer's and
+// client.StatusWriter's Update.
+type updateFunc func(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error
+
+// injectedConflicts counts the conflicts injected per object. It backs
+// InjectConflicts and outlives the reconciles.
+type injectedConflicts struct {
+	mu     sync.Mutex
+	counts map[client.ObjectKey]int
+}
+
+// wrap returns an update that fails the first conflicts calls for each
+// object with a 409 Conflict, without sending them, which tests the handling
+// of the conflicts without having to win the race. The conflict names the
+// object's resource, e.g., "secrets", as the apiserver's does; the resource
+// is left empty when c can't map the object.
+func (i *injectedConflicts) wrap(c client.Client, update updateFunc, conflicts int) updateFunc {
+	return func(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+		key := client.ObjectKeyFromObject(obj)
+		i.mu.Lock()
+		if i.counts == nil {
+			i.counts = make(map[client.ObjectKey]int)
+		}
+		inject := i.counts[key] < conflicts
+		if inject {
+			i.counts[key]++
+		}
+		i.mu.Unlock()
+
+		if inject {
+			return apierrors.NewConflict(resourceOf(c, obj), key.Name, errors.New("injected by InjectConflicts"))
+		}
+		return update(ctx, obj, opts...)
+	}
+}
+
+func resourceOf(c client.Client, obj client.Object) schema.GroupResource {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return schema.GroupResource{}
+	}
+	// The fake client has no RESTMapper.
+	mapper := c.RESTMapper()
+	if mapper == nil {
+		return schema.GroupResource{}
+	}
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return schema.GroupResource{}
+	}
+	return mapping.Resource.GroupResource()
+}
+
+func (r *AnnotatingReconciler) injectedConflicts() *injectedConflicts {
+	r.conflictsOnce.Do(func() {
+		r.conflicts = &injectedConflicts{}
+	})
+	return r.conflicts
+}
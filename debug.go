@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// CachedSecret is what the cache knows about a given Secret. The Secret's data
+// is left out on purpose.
+type CachedSecret struct {
+	Namespace       string            `json:"namespace"`
+	Name            string            `json:"name"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// DumpCache lists the Secrets that the given reader currently holds, sorted by
+// namespace and name. When given the manager's cache (mgr.GetCache()), this is
+// the content of the concrete v1.Secret informer, i.e., the one that
+// client.Get hits in the reconciler. Note that listing Secrets from the cache
+// creates the v1.Secret informer if it doesn't exist yet.
+func DumpCache(ctx context.Context, r client.Reader) ([]CachedSecret, error) {
+	var list corev1.SecretList
+	err := r.List(ctx, &list)
+	if err != nil {
+		return nil, fmt.Errorf("while listing Secrets: %w", err)
+	}
+
+	secrets := make([]CachedSecret, 0, len(list.Items))
+	for _, s := range list.Items {
+		secrets = append(secrets, CachedSecret{
+			Namespace:       s.Namespace,
+			Name:            s.Name,
+			ResourceVersion: s.ResourceVersion,
+			Annotations:     s.Annotations,
+		})
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		if secrets[i].Namespace != secrets[j].Namespace {
+			return secrets[i].Namespace < secrets[j].Namespace
+		}
+		return secrets[i].Name < secrets[j].Name
+	})
+
+	return secrets, nil
+}
+
+// GetBoth reads the object with the given key from the cache and from the
+// apiserver, e.g., with mgr.GetClient() and mgr.GetAPIReader(). The returned
+// objects are copies of obj, which is left untouched. When the cache doesn't
+// have the object yet, cachedObj is nil and no error is returned. The cache is
+// read first: reading from the apiserver takes a round trip, during which the
+// cache may catch up.
+func GetBoth(ctx context.Context, cached client.Client, live client.Reader, key client.ObjectKey, obj client.Object) (cachedObj, liveObj client.Object, err error) {
+	cachedObj = obj.DeepCopyObject().(client.Object)
+	err = cached.Get(ctx, key, cachedObj)
+	switch {
+	case apierrors.IsNotFound(err):
+		cachedObj = nil
+	case err != nil:
+		return nil, nil, fmt.Errorf("while reading %s from the cache: %w", key, err)
+	}
+
+	liveObj = obj.DeepCopyObject().(client.Object)
+	err = live.Get(ctx, key, liveObj)
+	if err != nil {
+		return nil, nil, fmt.Errorf("while reading %s from the apiserver: %w", key, err)
+	}
+
+	return cachedObj, liveObj, nil
+}
+
+// debugHandler serves the debug endpoints:
+//
+//	GET /cache/secrets    JSON array of the Secrets held by the cache.
+func debugHandler(r client.Reader) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache/secrets", func(w http.ResponseWriter, req *http.Request) {
+		secrets, err := DumpCache(req.Context(), r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(secrets)
+	})
+	return mux
+}
+
+// httpServer is an HTTP server, separate from the metrics server, such as the
+// debug server that lets you inspect the cache while the reproducer runs. It
+// implements manager.Runnable so that it starts and stops with the manager.
+type httpServer struct {
+	Name    string // E.g., "debug". Only used in logs and errors.
+	Addr    string
+	Handler http.Handler
+	Log     logr.Logger
+}
+
+func (s httpServer) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("while listening on %s for the %s server: %w", s.Addr, s.Name, err)
+	}
+
+	srv := &http.Server{Handler: s.Handler}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	s.Log.Info(s.Name+" server is starting to listen", "addr", ln.Addr().String())
+	err = srv.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("while serving the %s server: %w", s.Name, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func Test_debugHandler(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	srv := httptest.NewServer(debugHandler(mgr.GetCache()))
+	defer srv.Close()
+
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "secret-1",
+			Namespace:   "default",
+			Annotations: map[string]string{"foo": "bar"},
+		},
+	}
+	require.NoError(t, kc.Create(ctx, &secret))
+
+	t.Log("Waiting for the Secret to show up in /cache/secrets")
+	var got []CachedSecret
+	err = pollUntil(ctx, 100*time.Millisecond, timeout, func() (bool, error) {
+		resp, err := http.Get(srv.URL + "/cache/secrets")
+		if err != nil {
+			return false, err
+		}
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		got = nil
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		if err != nil {
+			return false, err
+		}
+		for _, s := range got {
+			if s.Namespace == "default" && s.Name == "secret-1" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	require.NoError(t, err)
+
+	require.Contains(t, got, CachedSecret{
+		Namespace:       "default",
+		Name:            "secret-1",
+		ResourceVersion: secret.ResourceVersion,
+		Annotations:     map[string]string{"foo": "bar"},
+	})
+}
+
+func TestGetBoth(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	// The manager is partitioned from the apiserver to make its cache lag
+	// behind; the live reads go through kc, which isn't.
+	partitioner := &Partitioner{}
+	mgr, err := ctrl.NewManager(partitioner.Wrap(rc), ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	_, err = mgr.GetCache().GetInformer(ctx, &corev1.Secret{})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+
+	t.Log("Waiting for the cache to catch up with the creation")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		cached, live, err := GetBoth(ctx, mgr.GetClient(), kc, key, &corev1.Secret{})
+		if err != nil {
+			return false, err
+		}
+		return cached != nil && cached.GetResourceVersion() == live.GetResourceVersion(), nil
+	}))
+	created := secret.ResourceVersion
+
+	t.Log("The cache can't see an update made during a partition")
+	partitioner.SimulatePartition(2 * time.Second)
+	secret.Labels = map[string]string{"foo": "bar"}
+	require.NoError(t, kc.Update(ctx, &secret))
+
+	cached, live, err := GetBoth(ctx, mgr.GetClient(), kc, key, &corev1.Secret{})
+	require.NoError(t, err)
+	require.Equal(t, secret.ResourceVersion, live.GetResourceVersion())
+	require.Equal(t, created, cached.GetResourceVersion())
+}
+
+// AssertCacheMatchesServer polls until the objects listed from the cache are
+// the same, resourceVersion included, as the ones listed from the apiserver.
+// The type of list, e.g., &corev1.SecretList{}, tells what to list. When the
+// cache doesn't converge within the given duration, the test fails with the
+// first mismatch, in namespace/name order.
+func AssertCacheMatchesServer(t *testing.T, cached client.Client, live client.Reader, list client.ObjectList, within time.Duration, opts ...client.ListOption) {
+	t.Helper()
+
+	var mismatch error
+	err := pollUntil(context.Background(), 100*time.Millisecond, within, func() (bool, error) {
+		var err error
+		mismatch, err = cacheMismatch(cached, live, list, opts...)
+		if err != nil {
+			return false, err
+		}
+		return mismatch == nil, nil
+	})
+	if errors.Is(err, wait.ErrWaitTimeout) && mismatch != nil {
+		err = mismatch
+	}
+	if err != nil {
+		t.Errorf("the cache did not converge within %s: %v", within, err)
+	}
+}
+
+// cacheMismatch returns the first difference between the cache and the
+// apiserver, or nil when they agree.
+func cacheMismatch(cached client.Client, live client.Reader, list client.ObjectList, opts ...client.ListOption) (mismatch, err error) {
+	ctx := context.Background()
+	resourceVersions := func(r client.Reader) (map[string]string, error) {
+		l := list.DeepCopyObject().(client.ObjectList)
+		err := r.List(ctx, l, opts...)
+		if err != nil {
+			return nil, err
+		}
+		objs, err := meta.ExtractList(l)
+		if err != nil {
+			return nil, err
+		}
+		rvs := make(map[string]string, len(objs))
+		for _, obj := range objs {
+			o := obj.(client.Object)
+			rvs[client.ObjectKeyFromObject(o).String()] = o.GetResourceVersion()
+		}
+		return rvs, nil
+	}
+
+	liveRVs, err := resourceVersions(live)
+	if err != nil {
+		return nil, fmt.Errorf("while listing from the apiserver: %w", err)
+	}
+	cachedRVs, err := resourceVersions(cached)
+	if err != nil {
+		return nil, fmt.Errorf("while listing from the cache: %w", err)
+	}
+
+	keys := make([]string, 0, len(liveRVs)+len(cachedRVs))
+	for key := range liveRVs {
+		keys = append(keys, key)
+	}
+	for key := range cachedRVs {
+		if _, ok := liveRVs[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		liveRV, inLive := liveRVs[key]
+		cachedRV, inCache := cachedRVs[key]
+		switch {
+		case !inCache:
+			return fmt.Errorf("%s is missing from the cache (live resourceVersion %s)", key, liveRV), nil
+		case !inLive:
+			return fmt.Errorf("%s is in the cache (resourceVersion %s) but no longer in the apiserver", key, cachedRV), nil
+		case cachedRV != liveRV:
+			return fmt.Errorf("%s has the resourceVersion %s in the cache but %s in the apiserver", key, cachedRV, liveRV), nil
+		}
+	}
+	return nil, nil
+}
+
+func TestAssertCacheMatchesServer(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	require.NoError(t, SeedSecrets(ctx, kc, "default", 5, corev1.Secret{}))
+
+	AssertCacheMatchesServer(t, mgr.GetClient(), mgr.GetAPIReader(), &corev1.SecretList{}, 5*time.Second, client.InNamespace("default"))
+}
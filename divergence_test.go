@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// AssertTransientDivergence fails the test unless the resourceVersion of the
+// object with the given key, as seen by primary and secondary, differs at
+// some point and is then the same for both within the given duration. In
+// other words, the race happens but the caches are eventually consistent. An
+// object that is missing counts as an empty resourceVersion. The reader that
+// is expected to lag behind, e.g., the cache when primary is the APIReader,
+// must be passed as secondary since it is read first.
+func AssertTransientDivergence(t *testing.T, primary, secondary client.Reader, key client.ObjectKey, obj client.Object, within time.Duration) {
+	t.Helper()
+	err := detectTransientDivergence(primary, secondary, key, obj, within)
+	if err != nil {
+		t.Errorf("%s: %v", key, err)
+	}
+}
+
+func detectTransientDivergence(primary, secondary client.Reader, key client.ObjectKey, obj client.Object, within time.Duration) error {
+	diverged := false
+	var primaryRV, secondaryRV string
+	err := pollUntil(context.Background(), time.Millisecond, within, func() (bool, error) {
+		var err error
+		secondaryRV, err = resourceVersionOf(secondary, key, obj)
+		if err != nil {
+			return false, fmt.Errorf("while reading from secondary: %w", err)
+		}
+		primaryRV, err = resourceVersionOf(primary, key, obj)
+		if err != nil {
+			return false, fmt.Errorf("while reading from primary: %w", err)
+		}
+
+		if primaryRV != secondaryRV {
+			diverged = true
+			return false, nil
+		}
+		return diverged, nil
+	})
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, wait.ErrWaitTimeout):
+		return err
+	case !diverged:
+		return fmt.Errorf("primary and secondary never diverged within %s (resourceVersion %q)", within, primaryRV)
+	case primaryRV != secondaryRV:
+		return fmt.Errorf("primary and secondary diverged but did not converge within %s (resourceVersion %q in primary, %q in secondary)", within, primaryRV, secondaryRV)
+	default:
+		return fmt.Errorf("primary and secondary diverged and converged, but only as the %s window ended", within)
+	}
+}
+
+func resourceVersionOf(r client.Reader, key client.ObjectKey, obj client.Object) (string, error) {
+	obj = obj.DeepCopyObject().(client.Object)
+	err := r.Get(context.Background(), key, obj)
+	switch {
+	case apierrors.IsNotFound(err):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	return obj.GetResourceVersion(), nil
+}
+
+func TestAssertTransientDivergence(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+
+	t.Log("Waiting for the cache to catch up with the creation")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		cached, live, err := GetBoth(ctx, mgr.GetClient(), mgr.GetAPIReader(), key, &corev1.Secret{})
+		if err != nil {
+			return false, err
+		}
+		return cached != nil && cached.GetResourceVersion() == live.GetResourceVersion(), nil
+	}))
+
+	t.Run("without writes, nothing diverges", func(t *testing.T) {
+		err := detectTransientDivergence(mgr.GetAPIReader(), mgr.GetClient(), key, &corev1.Secret{}, 200*time.Millisecond)
+		require.EqualError(t, err, fmt.Sprintf("primary and secondary never diverged within 200ms (resourceVersion %q)", secret.ResourceVersion))
+	})
+
+	t.Run("an update makes the cache lag for a moment", func(t *testing.T) {
+		// The informer usually catches up with the update in less than a
+		// poll interval; the lagging client keeps the divergence from
+		// depending on that by serving the old version to the first Gets.
+		stale := secret.DeepCopy()
+		secret.Labels = map[string]string{"foo": "bar"}
+		require.NoError(t, kc.Update(ctx, &secret))
+		lagging := &laggingClient{Client: mgr.GetClient(), stale: stale, staleGets: 5}
+		AssertTransientDivergence(t, mgr.GetAPIReader(), lagging, key, &corev1.Secret{}, 5*time.Second)
+	})
+}
+
+// AssertAnnotationInBothCaches waits until the Secret with the given key has
+// the annotation wantKey=wantValue in both primary and secondary, and fails
+// the test, naming the reader that lagged behind, if that doesn't happen
+// within the given duration. The Secret is read as a Secret from primary and
+// as its metadata from secondary: with mgr.GetClient() passed for both, the
+// concrete cache is compared with the metadata cache, which are the two
+// caches involved in the race.
+func AssertAnnotationInBothCaches(t *testing.T, primary, secondary client.Reader, key client.ObjectKey, wantKey, wantValue string, within time.Duration) {
+	t.Helper()
+	err := waitAnnotationInBothCaches(primary, secondary, key, wantKey, wantValue, within)
+	if err != nil {
+		t.Errorf("%s: %v", key, err)
+	}
+}
+
+func waitAnnotationInBothCaches(primary, secondary client.Reader, key client.ObjectKey, wantKey, wantValue string, within time.Duration) error {
+	inPrimary, inSecondary := false, false
+	err := pollUntil(context.Background(), time.Millisecond, within, func() (bool, error) {
+		if !inPrimary {
+			var secret corev1.Secret
+			err := primary.Get(context.Background(), key, &secret)
+			if client.IgnoreNotFound(err) != nil {
+				return false, fmt.Errorf("while reading from primary: %w", err)
+			}
+			inPrimary = err == nil && secret.Annotations[wantKey] == wantValue
+		}
+		if !inSecondary {
+			meta := &metav1.PartialObjectMetadata{}
+			meta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+			err := secondary.Get(context.Background(), key, meta)
+			if client.IgnoreNotFound(err) != nil {
+				return false, fmt.Errorf("while reading from secondary: %w", err)
+			}
+			inSecondary = err == nil && meta.Annotations[wantKey] == wantValue
+		}
+		return inPrimary && inSecondary, nil
+	})
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, wait.ErrWaitTimeout):
+		return err
+	case !inPrimary && !inSecondary:
+		return fmt.Errorf("neither primary nor secondary had %s=%s within %s", wantKey, wantValue, within)
+	case !inPrimary:
+		return fmt.Errorf("secondary had %s=%s but primary lagged behind for more than %s", wantKey, wantValue, within)
+	default:
+		return fmt.Errorf("primary had %s=%s but secondary lagged behind for more than %s", wantKey, wantValue, within)
+	}
+}
+
+func TestAssertAnnotationInBothCaches(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	err = (&AnnotatingReconciler{
+		Client:         mgr.GetClient(),
+		Log:            logger,
+		RequeueOnStale: 100 * time.Millisecond,
+	}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+
+	AssertAnnotationInBothCaches(t, mgr.GetClient(), mgr.GetClient(), key, "secret-found", "yes", 5*time.Second)
+
+	t.Run("the lagging reader is named", func(t *testing.T) {
+		// The fake client only has the Secret from before the annotation.
+		stale := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}).Build()
+		err := waitAnnotationInBothCaches(mgr.GetClient(), stale, key, "secret-found", "yes", 100*time.Millisecond)
+		require.EqualError(t, err, "primary had secret-found=yes but secondary lagged behind for more than 100ms")
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import "errors"
+
+// ErrConflict is matched, with errors.Is, by the errors that the
+// AnnotatingReconciler returns when its write was rejected because the object
+// changed since it was read, i.e., because the read was stale. The original
+// error is still there, so apierrors.IsConflict keeps working.
+var ErrConflict = errors.New("conflict")
+
+// conflictError wraps the conflict returned by the apiserver.
+type conflictError struct {
+	err error
+}
+
+func (e conflictError) Error() string {
+	return e.err.Error()
+}
+
+func (e conflictError) Unwrap() error {
+	return e.err
+}
+
+func (e conflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ErrPanic is matched, with errors.Is, by the errors that the Recovering
+// middleware returns when the reconcile panicked.
+var ErrPanic = errors.New("reconcile panicked")
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EventCounts is the number of events that an informer delivered for an
+// object.
+type EventCounts struct {
+	Add, Update, Delete int
+}
+
+// EventCounter counts the events that an informer delivers, per object. The
+// events are delivered from the informer's goroutine, hence the lock.
+type EventCounter struct {
+	mu     sync.Mutex
+	counts map[string]EventCounts
+}
+
+// Watch registers the counter on the cache's informer for the kind of obj,
+// e.g., &corev1.Secret{}. The informer gets created if it doesn't exist yet.
+// The objects that the informer already knows about show up as adds, as they
+// do for any other event handler.
+func (c *EventCounter) Watch(ctx context.Context, informers cache.Informers, obj client.Object) error {
+	informer, err := informers.GetInformer(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("while getting the informer for %T: %w", obj, err)
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			c.count(obj, func(counts *EventCounts) { counts.Add++ })
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			c.count(obj, func(counts *EventCounts) { counts.Update++ })
+		},
+		DeleteFunc: func(obj interface{}) {
+			c.count(obj, func(counts *EventCounts) { counts.Delete++ })
+		},
+	})
+	return nil
+}
+
+// Counts returns the events counted so far for the key, of the form
+// "namespace/name".
+func (c *EventCounter) Counts(key string) EventCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[key]
+}
+
+func (c *EventCounter) count(obj interface{}, inc func(*EventCounts)) {
+	// Also works with the DeletedFinalStateUnknown tombstones.
+	key, err := toolscache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]EventCounts)
+	}
+	counts := c.counts[key]
+	inc(&counts)
+	c.counts[key] = counts
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AssertEventCount fails the test unless the counter saw exactly the given
+// number of events for the key, of the form "namespace/name".
+func AssertEventCount(t *testing.T, counter *EventCounter, key string, add, update, delete int) {
+	t.Helper()
+	want := EventCounts{Add: add, Update: update, Delete: delete}
+	got := counter.Counts(key)
+	if got != want {
+		t.Errorf("unexpected events for %s: got %+v, want %+v", key, got, want)
+	}
+}
+
+func TestEventCounter(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	counter := &EventCounter{}
+	require.NoError(t, counter.Watch(ctx, mgr.GetCache(), &corev1.Secret{}))
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret).String()
+
+	t.Log("Waiting for the ADD")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return counter.Counts(key).Add > 0, nil
+	}))
+	// Leaves some time for a duplicate to show up.
+	time.Sleep(500 * time.Millisecond)
+	AssertEventCount(t, counter, key, 1, 0, 0)
+
+	require.NoError(t, kc.Delete(ctx, &secret))
+	t.Log("Waiting for the DELETE")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return counter.Counts(key).Delete > 0, nil
+	}))
+	time.Sleep(500 * time.Millisecond)
+	AssertEventCount(t, counter, key, 1, 0, 1)
+}
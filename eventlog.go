@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// The verbs of the events in the EventLog.
+const (
+	VerbAdd    = "add"
+	VerbUpdate = "update"
+	VerbDelete = "delete"
+)
+
+// Event is an event that an informer delivered, along with the object as the
+// informer saw it.
+type Event struct {
+	Time            time.Time       `json:"time"`
+	Verb            string          `json:"verb"` // One of VerbAdd, VerbUpdate, VerbDelete.
+	APIVersion      string          `json:"apiVersion"`
+	Kind            string          `json:"kind"`
+	Namespace       string          `json:"namespace,omitempty"`
+	Name            string          `json:"name"`
+	ResourceVersion string          `json:"resourceVersion"`
+	Object          json.RawMessage `json:"object"`
+}
+
+// EventLog records the events that informers deliver, in the order they are
+// delivered, so that a racy run can be saved with SaveEvents and replayed
+// later with ReplayEvents. The Scheme is used to find the kind of the objects.
+// The events whose object can't be encoded are logged and left out.
+type EventLog struct {
+	Scheme *runtime.Scheme
+	Log    logr.Logger // Defaults to logr.Discard().
+
+	mu     sync.Mutex
+	events []Event
+}
+
+// Watch registers the log on the cache's informer for the kind of obj. As
+// with EventCounter, the objects that the informer already knows about show
+// up as adds.
+func (l *EventLog) Watch(ctx context.Context, informers cache.Informers, obj client.Object) error {
+	gvk, err := apiutil.GVKForObject(obj, l.Scheme)
+	if err != nil {
+		return fmt.Errorf("while getting the kind of %T: %w", obj, err)
+	}
+	informer, err := informers.GetInformer(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("while getting the informer for %s: %w", gvk.Kind, err)
+	}
+	log := l.Log
+	if log == nil {
+		log = logr.Discard()
+	}
+
+	record := func(verb string, obj interface{}) {
+		if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		o, ok := obj.(client.Object)
+		if !ok {
+			return
+		}
+		raw, err := json.Marshal(o)
+		if err != nil {
+			log.Error(err, "while encoding the object, the event is left out of the log",
+				"verb", verb, "kind", gvk.Kind, "object", client.ObjectKeyFromObject(o), "resourceVersion", o.GetResourceVersion())
+			return
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.events = append(l.events, Event{
+			Time:            time.Now().UTC().Round(0), // Same as once saved and loaded.
+			Verb:            verb,
+			APIVersion:      gvk.GroupVersion().String(),
+			Kind:            gvk.Kind,
+			Namespace:       o.GetNamespace(),
+			Name:            o.GetName(),
+			ResourceVersion: o.GetResourceVersion(),
+			Object:          raw,
+		})
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { record(VerbAdd, obj) },
+		UpdateFunc: func(_, obj interface{}) { record(VerbUpdate, obj) },
+		DeleteFunc: func(obj interface{}) { record(VerbDelete, obj) },
+	})
+	return nil
+}
+
+// Events returns a copy of the events recorded so far.
+func (l *EventLog) Events() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Event(nil), l.events...)
+}
+
+// SaveEvents writes the events to the file at path, one JSON object per line.
+func SaveEvents(path string, events []Event) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("while creating the event log: %w", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		err := enc.Encode(e)
+		if err != nil {
+			return fmt.Errorf("while encoding the event for %s/%s at resourceVersion %s: %w", e.Namespace, e.Name, e.ResourceVersion, err)
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("while writing the event log: %w", err)
+	}
+	return f.Close()
+}
+
+// LoadEvents reads the events written by SaveEvents.
+func LoadEvents(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("while opening the event log: %w", err)
+	}
+	defer f.Close()
+
+	var events []Event
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var e Event
+		err := dec.Decode(&e)
+		if err != nil {
+			return nil, fmt.Errorf("while decoding event %d of the event log: %w", len(events)+1, err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// ReplayEvents feeds the events to the reconciler, one at a time and in order,
+// without an apiserver: each event is applied to c, usually a fake client that
+// the reconciler also uses, and then the object is reconciled once. It all
+// happens on the calling goroutine, so two replays of the same events make the
+// same calls. The reconciler's writes land in c too, and are overwritten by
+// the next event for the same object, the same way the informer would.
+//
+// Since c plays the part of both the informer that triggers the reconciles
+// and the cache that the reconciler reads, a replay shows what the reconciler
+// did given the order of the events, but not the lag between two informers.
+// The results and errors returned by Reconcile are not acted upon; wrap the
+// reconciler in a ReconcileRecorder to look at them.
+func ReplayEvents(ctx context.Context, events []Event, c client.Client, r reconcile.Reconciler) error {
+	for i, e := range events {
+		err := applyEvent(ctx, c, e)
+		if err != nil {
+			return fmt.Errorf("while applying event %d (%s %s %s/%s): %w", i+1, e.Verb, e.Kind, e.Namespace, e.Name, err)
+		}
+		_, _ = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKey{Namespace: e.Namespace, Name: e.Name}})
+	}
+	return nil
+}
+
+func applyEvent(ctx context.Context, c client.Client, e Event) error {
+	gvk := schema.FromAPIVersionAndKind(e.APIVersion, e.Kind)
+	newObj := func() (client.Object, error) {
+		o, err := c.Scheme().New(gvk)
+		if err != nil {
+			return nil, err
+		}
+		obj, ok := o.(client.Object)
+		if !ok {
+			return nil, fmt.Errorf("%T is not a client.Object", o)
+		}
+		return obj, nil
+	}
+
+	obj, err := newObj()
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(e.Object, obj)
+	if err != nil {
+		return fmt.Errorf("while decoding the object: %w", err)
+	}
+	// The resourceVersions recorded are the apiserver's, the ones in c are
+	// unrelated.
+	obj.SetResourceVersion("")
+
+	switch e.Verb {
+	case VerbAdd:
+		return c.Create(ctx, obj)
+	case VerbUpdate:
+		current, err := newObj()
+		if err != nil {
+			return err
+		}
+		err = c.Get(ctx, client.ObjectKeyFromObject(obj), current)
+		if err != nil {
+			return err
+		}
+		obj.SetResourceVersion(current.GetResourceVersion())
+		return c.Update(ctx, obj)
+	case VerbDelete:
+		return client.IgnoreNotFound(c.Delete(ctx, obj))
+	default:
+		return fmt.Errorf("unknown verb %q", e.Verb)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReplayEvents(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	eventLog := &EventLog{Scheme: scheme}
+	require.NoError(t, eventLog.Watch(ctx, mgr.GetCache(), &corev1.Secret{}))
+	err = (&AnnotatingReconciler{
+		Client:         mgr.GetClient(),
+		Log:            logger,
+		RequeueOnStale: 100 * time.Millisecond,
+	}).SetupWithManager(mgr)
+	require.NoError(t, err)
+
+	mgrCtx, stop := context.WithCancel(ctx)
+	errc := startManager(t, mgrCtx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	t.Log("Waiting for the Secret to be annotated in the cache, i.e., for the last event")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		var fromCache corev1.Secret
+		err := mgr.GetClient().Get(ctx, client.ObjectKeyFromObject(&secret), &fromCache)
+		if err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+		return fromCache.Annotations["secret-found"] == "yes", nil
+	}))
+	stop()
+	<-errc
+	var live corev1.Secret
+	require.NoError(t, kc.Get(ctx, client.ObjectKeyFromObject(&secret), &live))
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	require.NoError(t, SaveEvents(path, eventLog.Events()))
+	events, err := LoadEvents(path)
+	require.NoError(t, err)
+	require.Equal(t, eventLog.Events(), events)
+	require.Equal(t, VerbAdd, events[0].Verb)
+
+	t.Log("Replaying the events without an apiserver")
+	fc := &updateRecorder{Client: fake.NewClientBuilder().WithScheme(scheme).Build()}
+	err = ReplayEvents(ctx, events, fc, &AnnotatingReconciler{Client: fc, Log: logger})
+	require.NoError(t, err)
+
+	var replayed corev1.Secret
+	require.NoError(t, fc.Get(ctx, client.ObjectKeyFromObject(&secret), &replayed))
+	require.Equal(t, live.Annotations, replayed.Annotations)
+	require.NotEmpty(t, fc.LastResourceVersion(), "the replayed reconciler should have annotated the Secret")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// FakeStaleCache is an in-memory client.Reader that lags a fixed number of
+// versions behind the objects it is given with Set. With a lag of 1, Get
+// returns the version that precedes the latest one, and an object that was
+// only Set once can't be found, which is what the reconciler sees when the
+// cache hasn't caught up with the ADDED event yet. It lets unit tests
+// reproduce the stale reads without envtest.
+type FakeStaleCache struct {
+	lag int
+
+	mu       sync.Mutex
+	versions map[fakeCacheKey][]client.Object
+}
+
+type fakeCacheKey struct {
+	typ reflect.Type
+	key client.ObjectKey
+}
+
+// NewFakeStaleCache returns an empty cache that lags lag versions behind. A
+// lag of 0 makes it return the latest version, like a cache that is in sync.
+func NewFakeStaleCache(lag int) *FakeStaleCache {
+	return &FakeStaleCache{lag: lag, versions: make(map[fakeCacheKey][]client.Object)}
+}
+
+// Set records a new version of obj, e.g., the object returned by Create or
+// Update.
+func (c *FakeStaleCache) Set(obj client.Object) {
+	key := fakeCacheKey{typ: reflect.TypeOf(obj), key: client.ObjectKeyFromObject(obj)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.versions[key] = append(c.versions[key], obj.DeepCopyObject().(client.Object))
+}
+
+// stale returns the version of the object that the cache serves, or nil.
+// The caller must hold c.mu.
+func (c *FakeStaleCache) stale(key fakeCacheKey) client.Object {
+	versions := c.versions[key]
+	i := len(versions) - 1 - c.lag
+	if i < 0 {
+		return nil
+	}
+	return versions[i]
+}
+
+func (c *FakeStaleCache) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stale := c.stale(fakeCacheKey{typ: reflect.TypeOf(obj), key: key})
+	if stale == nil {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: reflect.TypeOf(obj).Elem().Name()}, key.Name)
+	}
+	reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(stale.DeepCopyObject()).Elem())
+	return nil
+}
+
+// List returns the objects sorted by namespace and name. It only supports the
+// client.InNamespace option.
+func (c *FakeStaleCache) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	if listOpts.LabelSelector != nil || listOpts.FieldSelector != nil {
+		return fmt.Errorf("FakeStaleCache doesn't support selectors")
+	}
+
+	itemsPtr, err := meta.GetItemsPtr(list)
+	if err != nil {
+		return fmt.Errorf("while getting the items of %T: %w", list, err)
+	}
+	itemType := reflect.TypeOf(itemsPtr).Elem().Elem()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []fakeCacheKey
+	for key := range c.versions {
+		if key.typ.Elem() != itemType {
+			continue
+		}
+		if listOpts.Namespace != "" && key.key.Namespace != listOpts.Namespace {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].key.String() < keys[j].key.String()
+	})
+
+	var objs []runtime.Object
+	for _, key := range keys {
+		stale := c.stale(key)
+		if stale == nil {
+			continue
+		}
+		objs = append(objs, stale.DeepCopyObject())
+	}
+
+	return meta.SetList(list, objs)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestFakeStaleCache(t *testing.T) {
+	ctx := context.Background()
+	cache := NewFakeStaleCache(1)
+	key := client.ObjectKey{Namespace: "default", Name: "secret-1"}
+
+	v1 := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace, ResourceVersion: "1"}}
+	cache.Set(v1)
+
+	var got corev1.Secret
+	err := cache.Get(ctx, key, &got)
+	require.True(t, apierrors.IsNotFound(err), "expected NotFound, got: %v", err)
+
+	v2 := v1.DeepCopy()
+	v2.ResourceVersion = "2"
+	cache.Set(v2)
+
+	require.NoError(t, cache.Get(ctx, key, &got))
+	require.Equal(t, "1", got.ResourceVersion)
+
+	var list corev1.SecretList
+	require.NoError(t, cache.List(ctx, &list, client.InNamespace("default")))
+	require.Len(t, list.Items, 1)
+	require.Equal(t, "1", list.Items[0].ResourceVersion)
+
+	require.NoError(t, cache.List(ctx, &list, client.InNamespace("other")))
+	require.Empty(t, list.Items)
+}
+
+func TestAnnotatingReconciler_ReadFrom(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	key := client.ObjectKey{Namespace: "default", Name: "secret-1"}
+	cache := NewFakeStaleCache(1)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace, ResourceVersion: "1"}}
+	cache.Set(secret)
+	secret = secret.DeepCopy()
+	secret.ResourceVersion = "2"
+	cache.Set(secret)
+
+	writer := &recordingWriter{scheme: scheme}
+	r := &AnnotatingReconciler{Client: writer, Log: NewCapturingLogger(), ReadFrom: cache}
+	_, err = r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+
+	t.Log("The reconciler should have acted on the stale version")
+	require.Len(t, writer.updates, 1)
+	require.Equal(t, "1", writer.updates[0].GetResourceVersion())
+}
+
+// recordingWriter records the objects given to Update. Only Update and Scheme
+// can be called.
+type recordingWriter struct {
+	client.Client
+	scheme  *runtime.Scheme
+	updates []client.Object
+}
+
+func (c *recordingWriter) Update(_ context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	c.updates = append(c.updates, obj.DeepCopyObject().(client.Object))
+	return nil
+}
+
+func (c *recordingWriter) Scheme() *runtime.Scheme {
+	return c.scheme
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// fakeManager implements the part of manager.Manager that the builder uses,
+// which lets SetupWithManager run without a cluster. The runnables are not
+// started, only recorded. The other methods panic.
+type fakeManager struct {
+	manager.Manager
+	client client.Client
+	scheme *runtime.Scheme
+
+	runnables []manager.Runnable
+}
+
+func newFakeManager(scheme *runtime.Scheme) *fakeManager {
+	return &fakeManager{client: fake.NewClientBuilder().WithScheme(scheme).Build(), scheme: scheme}
+}
+
+func (m *fakeManager) GetClient() client.Client    { return m.client }
+func (m *fakeManager) GetScheme() *runtime.Scheme  { return m.scheme }
+func (m *fakeManager) GetLogger() logr.Logger      { return logr.Discard() }
+func (m *fakeManager) GetCache() cache.Cache       { return nil }
+func (m *fakeManager) SetFields(interface{}) error { return nil }
+
+func (m *fakeManager) GetControllerOptions() v1alpha1.ControllerConfigurationSpec {
+	return v1alpha1.ControllerConfigurationSpec{}
+}
+
+func (m *fakeManager) Add(r manager.Runnable) error {
+	m.runnables = append(m.runnables, r)
+	return nil
+}
+
+func TestAnnotatingReconciler_SetupWithManager(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		r    *AnnotatingReconciler
+	}{
+		{name: "default", r: &AnnotatingReconciler{}},
+		{name: "named", r: &AnnotatingReconciler{Name: "secret-a"}},
+		{name: "full object", r: &AnnotatingReconciler{WatchFullObject: true}},
+		{name: "with predicates", r: &AnnotatingReconciler{AuditEvents: true, OnlyCreates: true, OnlyGenerationChanges: true}},
+		{name: "coalesced", r: &AnnotatingReconciler{Coalesce: time.Second}},
+		{name: "with middlewares", r: &AnnotatingReconciler{Middlewares: []Middleware{WithCorrelationID}}},
+		{name: "secret type", r: &AnnotatingReconciler{SecretType: corev1.SecretTypeTLS}},
+		{name: "deterministic order", r: &AnnotatingReconciler{DeterministicOrder: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newFakeManager(scheme)
+			r := tt.r
+			r.Client = mgr.GetClient()
+			r.Log = logr.Discard()
+
+			require.NoError(t, r.SetupWithManager(mgr))
+			require.Len(t, mgr.runnables, 1)
+			require.Implements(t, (*controller.Controller)(nil), mgr.runnables[0])
+		})
+	}
+}
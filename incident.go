@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Incident is a stale read as recorded by RunScenario, with enough detail to
+// tell what happened after the run is over.
+type Incident struct {
+	Timestamp time.Time `json:"timestamp"`
+	Key       string    `json:"key"` // Of the form "namespace/name".
+
+	// WriteRV is the latest resourceVersion known to exist when the read
+	// happened, and SeenRV the one that the read returned, empty when the
+	// object couldn't be found.
+	WriteRV string `json:"writeRV"`
+	SeenRV  string `json:"seenRV"`
+
+	// CacheName is the informer that the read went through, e.g.,
+	// "v1.Secret".
+	CacheName string `json:"cacheName"`
+
+	// StackTrace is the stack of the goroutine that did the read, which
+	// tells which part of the reconcile read stale data.
+	StackTrace string `json:"stackTrace"`
+}
+
+// WriteIncidents writes the incidents to w, one JSON object per line, as
+// SaveEvents does with the events.
+func WriteIncidents(w io.Writer, incidents []Incident) error {
+	enc := json.NewEncoder(w)
+	for _, incident := range incidents {
+		err := enc.Encode(incident)
+		if err != nil {
+			return fmt.Errorf("while encoding the incident for %s at resourceVersion %s: %w", incident.Key, incident.SeenRV, err)
+		}
+	}
+	return nil
+}
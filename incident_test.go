@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSkewClient_Incidents(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	kc := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+	key := client.ObjectKeyFromObject(secret)
+	require.NoError(t, kc.Get(ctx, key, secret))
+	stale := secret.DeepCopy()
+	secret.Labels = map[string]string{"changed": "yes"}
+	require.NoError(t, kc.Update(ctx, secret))
+
+	skew := &skewClient{Client: &laggingClient{Client: kc, stale: stale, staleGets: 1}, key: key, cacheName: "v1.Secret"}
+	skew.addVersion(stale.ResourceVersion)
+	skew.addVersion(secret.ResourceVersion)
+
+	t.Log("The first Get is stale, the second one isn't")
+	require.NoError(t, skew.Get(ctx, key, &corev1.Secret{}))
+	require.NoError(t, skew.Get(ctx, key, &corev1.Secret{}))
+
+	incidents := skew.Incidents()
+	require.Len(t, incidents, 1)
+	got := incidents[0]
+	require.Equal(t, "default/secret-1", got.Key)
+	require.Equal(t, secret.ResourceVersion, got.WriteRV)
+	require.Equal(t, stale.ResourceVersion, got.SeenRV)
+	require.Equal(t, "v1.Secret", got.CacheName)
+	require.NotEmpty(t, got.StackTrace)
+	require.Contains(t, got.StackTrace, "TestSkewClient_Incidents")
+	require.False(t, got.Timestamp.IsZero())
+
+	t.Log("The incidents should survive a round trip through JSON")
+	var buf bytes.Buffer
+	require.NoError(t, WriteIncidents(&buf, incidents))
+	var decoded Incident
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, got.WriteRV, decoded.WriteRV)
+	require.Equal(t, got.SeenRV, decoded.SeenRV)
+	require.Equal(t, got.StackTrace, decoded.StackTrace)
+	require.True(t, got.Timestamp.Equal(decoded.Timestamp))
+	require.Contains(t, buf.String(), `"seenRV":"`+stale.ResourceVersion+`"`)
+}
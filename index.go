@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// SetupIndex adds the field index to the manager's cache of Secrets so that
+// the Secrets can be listed with client.MatchingFields{field: value}. Such a
+// List goes through the index rather than through the whole cache, and the
+// index is updated by the same informer, which means it is just as stale.
+// It must be called before the manager starts.
+func SetupIndex(ctx context.Context, mgr manager.Manager, field string, extractor client.IndexerFunc) error {
+	err := mgr.GetFieldIndexer().IndexField(ctx, &corev1.Secret{}, field, extractor)
+	if err != nil {
+		return fmt.Errorf("while indexing the Secrets by %s: %w", field, err)
+	}
+	return nil
+}
+
+// IndexByLabel is an extractor for SetupIndex that indexes the objects by the
+// value of their label key. The objects without the label aren't indexed.
+func IndexByLabel(key string) client.IndexerFunc {
+	return func(obj client.Object) []string {
+		value, ok := obj.GetLabels()[key]
+		if !ok {
+			return nil
+		}
+		return []string{value}
+	}
+}
+
+// IndexByAnnotation is the same as IndexByLabel, but with an annotation.
+func IndexByAnnotation(key string) client.IndexerFunc {
+	return func(obj client.Object) []string {
+		value, ok := obj.GetAnnotations()[key]
+		if !ok {
+			return nil
+		}
+		return []string{value}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestSetupIndex(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	require.NoError(t, SetupIndex(ctx, mgr, "tier", IndexByLabel("tier")))
+	require.NoError(t, SetupIndex(ctx, mgr, "owner", IndexByAnnotation("owner")))
+	startManager(t, ctx, mgr)
+
+	require.NoError(t, SeedSecrets(ctx, kc, "default", 3, corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:        "frontend",
+		Labels:      map[string]string{"tier": "frontend"},
+		Annotations: map[string]string{"owner": "alice"},
+	}}))
+	require.NoError(t, SeedSecrets(ctx, kc, "default", 2, corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:   "backend",
+		Labels: map[string]string{"tier": "backend"},
+	}}))
+
+	t.Log("Waiting for the index to agree with the apiserver")
+	var want corev1.SecretList
+	require.NoError(t, kc.List(ctx, &want, client.InNamespace("default"), client.MatchingLabels{"tier": "frontend"}))
+	require.Len(t, want.Items, 3)
+	var got corev1.SecretList
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := mgr.GetClient().List(ctx, &got, client.InNamespace("default"), client.MatchingFields{"tier": "frontend"})
+		if err != nil {
+			return false, err
+		}
+		return len(got.Items) == len(want.Items), nil
+	}))
+	require.Equal(t, SortedSecretNames(want), SortedSecretNames(got))
+
+	require.NoError(t, mgr.GetClient().List(ctx, &got, client.InNamespace("default"), client.MatchingFields{"owner": "alice"}))
+	require.Equal(t, SortedSecretNames(want), SortedSecretNames(got))
+
+	require.NoError(t, mgr.GetClient().List(ctx, &got, client.InNamespace("default"), client.MatchingFields{"tier": "database"}))
+	require.Empty(t, got.Items)
+}
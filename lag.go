@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// eventArrivals remembers when each object was last enqueued by an event that
+// went through all the predicates. It backs LogReconcileLag. The workqueue
+// keeps a single request per object, which is why only the earliest arrival
+// is kept until the object gets reconciled.
+type eventArrivals struct {
+	mu       sync.Mutex
+	arrivals map[types.NamespacedName]time.Time
+}
+
+func (a *eventArrivals) record(obj client.Object) bool {
+	key := client.ObjectKeyFromObject(obj)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.arrivals == nil {
+		a.arrivals = make(map[types.NamespacedName]time.Time)
+	}
+	if _, ok := a.arrivals[key]; !ok {
+		a.arrivals[key] = time.Now()
+	}
+	return true
+}
+
+// take returns when the object was enqueued and forgets it, so that the
+// events that come in during the reconcile count towards the next one. It
+// returns false when the reconcile wasn't triggered by an event, e.g., when
+// it is a requeue.
+func (a *eventArrivals) take(key types.NamespacedName) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	arrival, ok := a.arrivals[key]
+	delete(a.arrivals, key)
+	return arrival, ok
+}
+
+// predicate records the arrival of the events and lets them all through. It
+// must be the last predicate so that it only sees the events that get
+// enqueued.
+func (a *eventArrivals) predicate() predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return a.record(e.Object) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return a.record(e.ObjectNew) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return a.record(e.Object) },
+		GenericFunc: func(e event.GenericEvent) bool { return a.record(e.Object) },
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// MeasureLatencies starts the same controller as RunScenario, creates count
+// Secrets named after cfg.Name followed by their index, e.g., secret-1-0,
+// and returns the percentiles of the time between the creation of each
+// Secret and the moment its annotation shows up in the apiserver. The
+// Secrets are polled every 10 milliseconds, which is the resolution of the
+// latencies. It fails when a Secret isn't annotated within cfg.Timeout. The
+// Secrets aren't deleted afterwards; set cfg.RunLabel to clean them up with
+// CleanupByLabel.
+func MeasureLatencies(ctx context.Context, cfg ScenarioConfig, count int) (p50, p90, p99 time.Duration, err error) {
+	if count <= 0 {
+		return 0, 0, 0, fmt.Errorf("count must be positive, got %d", count)
+	}
+	cfg = cfg.withDefaults()
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	kc, err := client.New(cfg.RestConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("while creating the uncached client: %w", err)
+	}
+	mgr, err := ctrl.NewManager(cfg.managerConfig(), ctrl.Options{
+		Scheme:             scheme,
+		Logger:             cfg.Log,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("while creating the manager: %w", err)
+	}
+	err = (&AnnotatingReconciler{
+		Client:         mgr.GetClient(),
+		Log:            cfg.Log,
+		RequeueOnStale: cfg.RequeueOnStale,
+	}).SetupWithManager(mgr)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	mgrCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	started, errc := StartManager(mgrCtx, mgr)
+	select {
+	case <-started:
+	case err := <-errc:
+		return 0, 0, 0, fmt.Errorf("while starting the manager: %w", err)
+	case <-ctx.Done():
+		return 0, 0, 0, ctx.Err()
+	}
+	defer func() {
+		stop()
+		<-errc
+	}()
+
+	created := make(map[string]time.Time, count)
+	for i := 0; i < count; i++ {
+		secret := paddedSecret(cfg.Namespace, fmt.Sprintf("%s-%d", cfg.Name, i), cfg.DataSizeBytes)
+		if cfg.RunLabel != "" {
+			secret.Labels = map[string]string{RunLabelKey: cfg.RunLabel}
+		}
+		created[secret.Name] = time.Now()
+		err = kc.Create(ctx, secret)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("while creating Secret %d out of %d: %w", i+1, count, err)
+		}
+	}
+
+	latencies := make(map[string]time.Duration, count)
+	err = PollLogged(ctx, cfg.Log, 10*time.Millisecond, cfg.Timeout, func() (bool, error) {
+		var secrets corev1.SecretList
+		err := kc.List(ctx, &secrets, client.InNamespace(cfg.Namespace))
+		if err != nil {
+			return false, err
+		}
+		now := time.Now()
+		for _, secret := range secrets.Items {
+			at, ok := created[secret.Name]
+			if !ok || secret.Annotations["secret-found"] != "yes" {
+				continue
+			}
+			if _, seen := latencies[secret.Name]; !seen {
+				latencies[secret.Name] = now.Sub(at)
+			}
+		}
+		return len(latencies) == count, nil
+	})
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("while waiting for the %d Secrets to be annotated, %d were: %w", count, len(latencies), err)
+	}
+
+	sorted := make([]time.Duration, 0, count)
+	for _, latency := range latencies {
+		sorted = append(sorted, latency)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return percentile(sorted, 0.50), percentile(sorted, 0.90), percentile(sorted, 0.99), nil
+}
+
+// percentile uses the nearest-rank method. The durations must be sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
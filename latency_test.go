@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMeasureLatencies(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	p50, p90, p99, err := MeasureLatencies(context.Background(), ScenarioConfig{
+		RestConfig:     rc,
+		Log:            logger,
+		Name:           "secret",
+		RequeueOnStale: 100 * time.Millisecond,
+	}, 20)
+	require.NoError(t, err)
+	t.Logf("p50=%s p90=%s p99=%s", p50, p90, p99)
+	require.Greater(t, int64(p50), int64(0))
+	require.LessOrEqual(t, int64(p50), int64(p90))
+	require.LessOrEqual(t, int64(p90), int64(p99))
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	require.Equal(t, time.Duration(5), percentile(sorted, 0.50))
+	require.Equal(t, time.Duration(9), percentile(sorted, 0.90))
+	require.Equal(t, time.Duration(10), percentile(sorted, 0.99))
+	require.Equal(t, time.Duration(1), percentile(sorted[:1], 0.50))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/goleak"
+)
+
+// knownGoroutines are the goroutines that may outlive a test without being
+// leaks:
+//
+//   - klog's flushDaemon is started once per process, when klog is
+//     initialized, and never stops;
+//   - net/http keeps idle connections to the apiserver (persistConn's
+//     readLoop and writeLoop) until they time out or the apiserver stops,
+//     which matters when the apiserver outlives the test, e.g., with
+//     USE_EXISTING_CLUSTER=true.
+//
+// The reflectors, workqueues and watches take a moment to return once the
+// manager is stopped; goleak.VerifyNone retries for a while, so they don't
+// need to be listed. goleak.IgnoreCurrent, passed as "before", ignores the
+// goroutines that already existed when the test started.
+var knownGoroutines = []goleak.Option{
+	goleak.IgnoreTopFunction("k8s.io/klog/v2.(*loggingT).flushDaemon"),
+	goleak.IgnoreTopFunction("net/http.(*persistConn).readLoop"),
+	goleak.IgnoreTopFunction("net/http.(*persistConn).writeLoop"),
+}
+
+// AssertNoLeaks fails the test if, once the test and its cleanup functions
+// (e.g., the one registered by startTestEnv) are done, goroutines other than
+// the ones in before and in knownGoroutines are still running. It must be
+// called before startTestEnv since the cleanup functions run in reverse
+// order:
+//
+//	AssertNoLeaks(t, goleak.IgnoreCurrent())
+//	rc := startTestEnv(t, scheme)
+func AssertNoLeaks(t *testing.T, before goleak.Option) {
+	t.Cleanup(func() {
+		goleak.VerifyNone(t, append([]goleak.Option{before}, knownGoroutines...)...)
+	})
+}
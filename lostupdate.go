@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DetectLostUpdate reads the Secret key, of the form "namespace/name", and
+// returns the keys of the annotations in wrote that the Secret doesn't have,
+// or that have another value. A non-empty list means that someone overwrote
+// our write, e.g., with an Update computed from a copy that didn't have our
+// annotations yet. Pass a reader that doesn't go through the cache, such as
+// mgr.GetAPIReader(), otherwise the cache may hide the loss or make one up.
+// The keys are sorted.
+func DetectLostUpdate(ctx context.Context, live client.Reader, key string, wrote map[string]string) (lost []string, err error) {
+	ns, name, err := toolscache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing the key %q: %w", key, err)
+	}
+
+	var secret corev1.Secret
+	err = live.Get(ctx, client.ObjectKey{Namespace: ns, Name: name}, &secret)
+	if err != nil {
+		return nil, fmt.Errorf("while getting Secret %s: %w", key, err)
+	}
+
+	for k, v := range wrote {
+		got, found := secret.Annotations[k]
+		if !found || got != v {
+			lost = append(lost, k)
+		}
+	}
+	sort.Strings(lost)
+	return lost, nil
+}
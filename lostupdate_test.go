@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestDetectLostUpdate(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "clobbered", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	stale := secret.DeepCopy()
+
+	wrote := map[string]string{"secret-found": "yes", "owner": "secret-a"}
+	secret.Annotations = wrote
+	require.NoError(t, kc.Update(ctx, &secret))
+
+	lost, err := DetectLostUpdate(ctx, kc, "default/clobbered", wrote)
+	require.NoError(t, err)
+	require.Empty(t, lost)
+
+	// The other writer started from a copy read before our write and doesn't
+	// send a resourceVersion, so the apiserver accepts the Update without a
+	// conflict and our "secret-found" annotation is gone.
+	stale.ResourceVersion = ""
+	stale.Annotations = map[string]string{"owner": "secret-b"}
+	require.NoError(t, kc.Update(ctx, stale))
+
+	lost, err = DetectLostUpdate(ctx, kc, "default/clobbered", wrote)
+	require.NoError(t, err)
+	require.Equal(t, []string{"owner", "secret-found"}, lost)
+
+	_, err = DetectLostUpdate(ctx, kc, "default/missing", wrote)
+	require.Error(t, err)
+}
@@ -1,28 +1,161 @@
 package main
 
 import (
-	_ "context"
-	_ "flag"
-	_ "fmt"
-	_ "strings"
-	_ "testing"
-	_ "time"
-
-	_ "github.com/go-logr/logr"
-	_ "github.com/stretchr/testify/require"
-	_ "k8s.io/api/core/v1"
-	_ "k8s.io/apimachinery/pkg/api/errors"
-	_ "k8s.io/apimachinery/pkg/apis/meta/v1"
-	_ "k8s.io/apimachinery/pkg/runtime"
-	_ "k8s.io/apimachinery/pkg/types"
-	_ "k8s.io/apimachinery/pkg/util/wait"
-	_ "k8s.io/klog/v2"
-	_ "sigs.k8s.io/controller-runtime"
-	_ "sigs.k8s.io/controller-runtime/pkg/builder"
-	_ "sigs.k8s.io/controller-runtime/pkg/client"
-	_ "sigs.k8s.io/controller-runtime/pkg/envtest"
-	_ "sigs.k8s.io/controller-runtime/pkg/handler"
-	_ "sigs.k8s.io/controller-runtime/pkg/manager"
-	_ "sigs.k8s.io/controller-runtime/pkg/reconcile"
-	_ "sigs.k8s.io/controller-runtime/pkg/source"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/klogr"
+	ctrl "sigs.k8s.io/controller-runtime"
 )
+
+// The command runs the same Secret controller as main_test.go, but against the
+// cluster that your kubeconfig points to. It is meant for poking at the race
+// while it happens, e.g. with --debug-addr, or to profile it with --pprof-addr.
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "benchmark" {
+		benchmarkMain(os.Args[2:])
+		return
+	}
+
+	var opts runOptions
+	flag.StringVar(&opts.MetricsAddr, "metrics-addr", ":8080", "Address on which the metrics server listens, e.g. 127.0.0.1:8080. The metrics are served over plain HTTP without authentication. Disabled when set to 0.")
+	flag.StringVar(&opts.DebugAddr, "debug-addr", "", "Address on which the debug server listens, e.g. :8081. The debug server exposes /cache/secrets. Disabled when empty.")
+	flag.StringVar(&opts.PprofAddr, "pprof-addr", "", "Address on which the pprof server listens, e.g. :6060. The pprof server exposes /debug/pprof/. Disabled when empty.")
+	flag.StringVar((*string)(&opts.ClientWiring), "client-wiring", string(ClientWiringDefault), "How the manager's client splits reads and writes, one of Default, Split or Direct. See ClientWiring.")
+	flag.StringVar(&opts.MetricsDump, "metrics-dump", "", "File to which the metrics get written, in the Prometheus text format, when the command stops. Disabled when empty.")
+	flag.StringVar(&opts.TraceOut, "trace-out", "", "File to which the runtime execution trace gets written while the command runs, to be opened with go tool trace. Disabled when empty.")
+	flag.StringVar(&opts.ProbeSecret, "probe-secret", "", "Secret, of the form namespace/name, that gets annotated every 10 seconds to measure the cache lag, exported as cacherace_cache_sync_lag_seconds. Disabled when empty.")
+	klog.InitFlags(nil)
+	flag.Parse()
+
+	log := klogr.New()
+	ctrl.SetLogger(log)
+
+	err := run(ctrl.SetupSignalHandler(), ctrl.GetConfigOrDie(), log, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// benchmarkMain runs the benchmark subcommand, which measures how the cache of
+// the cluster that your kubeconfig points to keeps up with the writes:
+//
+//	go run . benchmark --namespace default --iterations 20
+func benchmarkMain(args []string) {
+	var opts benchmarkOptions
+	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	fs.StringVar(&opts.Namespace, "namespace", "default", "Namespace in which the probe Secret gets created and then deleted.")
+	fs.IntVar(&opts.Iterations, "iterations", 10, "Number of times the probe Secret gets written.")
+	klog.InitFlags(fs)
+	_ = fs.Parse(args)
+
+	log := klogr.New()
+	ctrl.SetLogger(log)
+
+	err := runBenchmark(ctrl.SetupSignalHandler(), ctrl.GetConfigOrDie(), log, os.Stdout, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runOptions are set from the command-line flags.
+type runOptions struct {
+	ClientWiring         ClientWiring
+	MetricsAddr          string
+	MetricsDump          string // Path of the file written on shutdown.
+	TraceOut             string // Path of the execution trace.
+	DebugAddr, PprofAddr string
+	ProbeSecret          string // Of the form namespace/name.
+}
+
+func run(ctx context.Context, rc *rest.Config, log logr.Logger, opts runOptions) (err error) {
+	if opts.TraceOut != "" {
+		stopTrace, err := startTrace(opts.TraceOut)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			stopErr := stopTrace()
+			if err == nil {
+				err = stopErr
+			}
+		}()
+	}
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	if err != nil {
+		return fmt.Errorf("while building the scheme: %w", err)
+	}
+
+	newClient, err := NewClientFunc(opts.ClientWiring)
+	if err != nil {
+		return err
+	}
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             log,
+		NewClient:          newClient,
+		MetricsBindAddress: opts.MetricsAddr,
+	})
+	if err != nil {
+		return fmt.Errorf("while creating the manager: %w", err)
+	}
+
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: log}).SetupWithManager(mgr)
+	if err != nil {
+		return err
+	}
+
+	if opts.DebugAddr != "" {
+		err = mgr.Add(httpServer{Name: "debug", Addr: opts.DebugAddr, Handler: debugHandler(mgr.GetCache()), Log: log.WithName("debug")})
+		if err != nil {
+			return fmt.Errorf("while adding the debug server: %w", err)
+		}
+	}
+
+	if opts.PprofAddr != "" {
+		err = mgr.Add(httpServer{Name: "pprof", Addr: opts.PprofAddr, Handler: pprofHandler(), Log: log.WithName("pprof")})
+		if err != nil {
+			return fmt.Errorf("while adding the pprof server: %w", err)
+		}
+	}
+
+	if opts.ProbeSecret != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(opts.ProbeSecret)
+		if err != nil || namespace == "" {
+			return fmt.Errorf("--probe-secret must be of the form namespace/name, got %q", opts.ProbeSecret)
+		}
+		err = mgr.Add(&CacheLagProber{
+			Client: mgr.GetClient(),
+			Cache:  mgr.GetCache(),
+			Log:    log.WithName("probe"),
+			Key:    types.NamespacedName{Namespace: namespace, Name: name},
+		})
+		if err != nil {
+			return fmt.Errorf("while adding the cache lag prober: %w", err)
+		}
+	}
+
+	err = mgr.Start(ctx)
+	if opts.MetricsDump != "" {
+		dumpErr := DumpMetrics(opts.MetricsDump)
+		if dumpErr != nil && err == nil {
+			return dumpErr
+		}
+		if dumpErr != nil {
+			log.Error(dumpErr, "while dumping the metrics")
+		}
+	}
+	return err
+}
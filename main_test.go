@@ -2,113 +2,45 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"flag"
 	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
-	"sigs.k8s.io/controller-runtime/pkg/manager"
-	"sigs.k8s.io/controller-runtime/pkg/reconcile"
-)
-
-// In this test, we create a tiny Secret controller that does one single thing:
-// it adds the secret-found=yes annotation if it does not already have it.
-//
-//  +-----------------------+
-//  | kind: Secret          |
-//  | metadata:             |
-//  |   name: example-1     |
-//  |   annotations: []     |
-//  +-----------------------+
-//              |
-//              |
-//              | reconciliation = add annotation
-//              |
-//              v
-//  +-------------------------+
-//  | kind: Secret            |
-//  | metadata:               |
-//  |   name: example-1       |
-//  |   annotations:          |
-//  |     secret-found: "yes" |
-//  +-------------------------+
-//
-func setupConfigMapReconciler(mgr manager.Manager, log logr.Logger) error {
-
-	log = log.WithName("secret-reconciler")
-
-	err := ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Secret{}, builder.OnlyMetadata).
-		Complete(reconcile.Func(func(_ context.Context, r reconcile.Request) (reconcile.Result, error) {
-			log := log
-			log = log.WithValues("secret", r.NamespacedName)
-			log.Info("start")
-			defer log.Info("end")
-
-			secret := &corev1.Secret{}
-			err := mgr.GetClient().Get(context.Background(), r.NamespacedName, secret)
-			switch {
-			// If the secret doesn't exist, the reconciliation is done.
-			case apierrors.IsNotFound(err):
-				log.Info("secret not found")
-				return reconcile.Result{}, nil
-			case err != nil:
-				return reconcile.Result{}, fmt.Errorf("looking for Secret %s: %w", r.NamespacedName, err)
-			}
-
-			if secret.Annotations != nil && secret.Annotations["secret-found"] == "yes" {
-				return reconcile.Result{}, nil
-			}
-
-			if secret.Annotations == nil {
-				secret.Annotations = make(map[string]string)
-			}
-			secret.Annotations["secret-found"] = "yes"
-			err = mgr.GetClient().Update(context.Background(), secret)
-			if err != nil {
-				return reconcile.Result{}, err
-			}
 
-			return reconcile.Result{}, nil
-		}))
-	if err != nil {
-		return fmt.Errorf("while completing new controller: %w", err)
-	}
-
-	return nil
-}
+	"controller-runtime-cache-race/api/v1alpha1"
+)
 
 func Test_secretController(t *testing.T) {
-	logger := TestLogger{T: t}
-	ctrl.SetLogger(logger)
-	klog.SetLogger(logger)
-	klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
-	klog.InitFlags(klogFlags)
-	_ = klogFlags.Set("v", "6")
-
-	scheme := runtime.NewScheme()
-	require.NoError(t, corev1.AddToScheme(scheme))
+	AssertNoLeaks(t, goleak.IgnoreCurrent())
+	captured := NewCapturingLogger()
+	logger := teeLogger{setupTestLogger(t), captured}
+	configureKlog(t, 6)
 
-	testEnv := &envtest.Environment{Scheme: scheme}
-	rc, err := testEnv.Start()
+	scheme, err := BuildScheme(corev1.AddToScheme)
 	require.NoError(t, err)
-	defer func() {
-		require.NoError(t, testEnv.Stop())
-	}()
+
+	rc := startTestEnv(t, scheme)
 
 	const timeout = 10 * time.Second
 	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
@@ -124,12 +56,10 @@ func Test_secretController(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	err = setupConfigMapReconciler(mgr, logger)
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: logger}).SetupWithManager(mgr)
 	require.NoError(t, err)
 
-	go func() {
-		require.NoError(t, mgr.Start(ctx))
-	}()
+	startManager(t, ctx, mgr)
 
 	t.Log("Force creation of the v1.Secret informer")
 	// Dummy call that forces the reflector and informer to be created/started,
@@ -142,7 +72,7 @@ func Test_secretController(t *testing.T) {
 	mgr.GetClient().Get(context.Background(), types.NamespacedName{}, &corev1.Secret{})
 	time.Sleep(300 * time.Millisecond)
 
-	const nsName = "ns-1"
+	nsName, name := UniqueNames(t)
 	ns1 := corev1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: nsName,
@@ -150,15 +80,17 @@ func Test_secretController(t *testing.T) {
 	}
 	require.NoError(t, kc.Create(ctx, &ns1))
 
-	name := "secret-1"
 	t.Logf("Create Secret %s in namespace %s owned", name, nsName)
+	const sentinel = "s3cr3t-sentinel-value"
 	secret := corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: nsName,
 		},
+		Data: map[string][]byte{"password": []byte(sentinel)},
 	}
 	require.NoError(t, kc.Create(ctx, &secret))
+	defer AssertNoSecretDataLogged(t, captured, sentinel)
 
 	t.Log("Waiting for Secret to have the annotation secret-found=yes")
 	err = pollUntil(ctx, time.Second, timeout, func() (done bool, err error) {
@@ -177,12 +109,381 @@ func Test_secretController(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// Same as Test_secretController, but with the Widget custom resource.
+func Test_widgetController(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme, v1alpha1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme, "config/crd")
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: ":0",
+	})
+	require.NoError(t, err)
+
+	err = NewAnnotatingReconciler(mgr.GetClient(), logger, &v1alpha1.Widget{}, "widget-found", "yes").SetupWithManager(mgr)
+	require.NoError(t, err)
+
+	startManager(t, ctx, mgr)
+
+	t.Log("Force creation of the v1alpha1.Widget informer")
+	_ = mgr.GetClient().Get(context.Background(), types.NamespacedName{}, &v1alpha1.Widget{})
+	time.Sleep(300 * time.Millisecond)
+
+	name := "widget-1"
+	t.Logf("Create Widget %s in namespace default", name)
+	widget := v1alpha1.Widget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+	}
+	require.NoError(t, kc.Create(ctx, &widget))
+
+	t.Log("Waiting for Widget to have the annotation widget-found=yes")
+	err = pollUntil(ctx, time.Second, timeout, func() (done bool, err error) {
+		var widget v1alpha1.Widget
+		err = kc.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, &widget)
+		if err != nil {
+			return false, err
+		}
+
+		return widget.Annotations["widget-found"] == "yes", nil
+	})
+	require.NoError(t, err)
+}
+
+// The comment in Test_secretController claims that the dummy Get creates the
+// v1.Secret informer. Since the cache doesn't tell which informers it holds,
+// we count the LIST requests that a v1.Secret informer sends when it starts.
+func Test_dummyGetCreatesSecretInformer(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	lists := &secretListCounter{}
+	rc = rest.CopyConfig(rc)
+	rc.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return countingRoundTripper{next: rt, lists: lists}
+	})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: logger}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	// The controller starts the metadata informer once the manager's cache
+	// is started, which is what StartManager waits for.
+	t.Log("Only the metadata informer should exist once the manager is started")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return lists.metadata() > 0, nil
+	}))
+	require.Equal(t, 0, lists.concrete())
+	metadataLists := lists.metadata()
+
+	_ = mgr.GetClient().Get(ctx, types.NamespacedName{}, &corev1.Secret{})
+
+	// The reflector sends its LIST from its own goroutine, and may relist.
+	t.Log("The dummy Get should have started the v1.Secret informer")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return lists.concrete() >= 1, nil
+	}))
+	require.Equal(t, metadataLists, lists.metadata(), "the dummy Get should not have touched the metadata informer")
+}
+
+// secretListCounter counts the cluster-wide LIST requests on Secrets, which
+// each informer sends once when it starts. The requests made by the metadata
+// informer ask for PartialObjectMetadataList in the Accept header.
+type secretListCounter struct {
+	mu                       sync.Mutex
+	concreteLists, metaLists int
+}
+
+// countingRoundTripper feeds the secretListCounter. Each client built from
+// the rest.Config gets its own.
+type countingRoundTripper struct {
+	next  http.RoundTripper
+	lists *secretListCounter
+}
+
+func (rt countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && req.URL.Path == "/api/v1/secrets" && req.URL.Query().Get("watch") != "true" {
+		rt.lists.mu.Lock()
+		if strings.Contains(req.Header.Get("Accept"), "as=PartialObjectMetadataList") {
+			rt.lists.metaLists++
+		} else {
+			rt.lists.concreteLists++
+		}
+		rt.lists.mu.Unlock()
+	}
+	return rt.next.RoundTrip(req)
+}
+
+func (c *secretListCounter) concrete() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.concreteLists
+}
+
+func (c *secretListCounter) metadata() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metaLists
+}
+
+// uniqueNamesCount makes the names returned by UniqueNames unique within the
+// test binary, including across tests that happen to share the same name.
+var uniqueNamesCount uint64
+
+// UniqueNames returns a namespace name and an object name that no other call
+// returns, which keeps a test's objects apart from the ones of the other tests
+// when they share an apiserver, e.g., with USE_EXISTING_CLUSTER=true. Only
+// Test_secretController uses it so far; the other tests hard-code "default"
+// and "secret-1" and get an apiserver of their own. Both names are derived
+// from the test name so that the objects left behind tell which test created
+// them. They are valid DNS-1123 labels. The namespace isn't created.
+func UniqueNames(t *testing.T) (ns, name string) {
+	t.Helper()
+	n := atomic.AddUint64(&uniqueNamesCount, 1)
+	suffix := "-" + strconv.FormatUint(n, 10)
+
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, t.Name())
+	if max := validation.DNS1123LabelMaxLength - len("ns-") - len(suffix); len(base) > max {
+		base = base[:max]
+	}
+	base = strings.Trim(base, "-")
+	if base == "" {
+		base = "test"
+	}
+
+	return "ns-" + base + suffix, base + suffix
+}
+
+func TestUniqueNames(t *testing.T) {
+	ns1, name1 := UniqueNames(t)
+	ns2, name2 := UniqueNames(t)
+	require.NotEqual(t, ns1, ns2)
+	require.NotEqual(t, name1, name2)
+	require.True(t, strings.HasPrefix(name1, "testuniquenames-"), name1)
+
+	t.Run("Long_name/With Symbols_"+strings.Repeat("x", 80), func(t *testing.T) {
+		ns, name := UniqueNames(t)
+		require.Empty(t, validation.IsDNS1123Label(ns))
+		require.Empty(t, validation.IsDNS1123Label(name))
+	})
+}
+
 func pollUntil(ctx context.Context, interval time.Duration, timeout time.Duration, f wait.ConditionFunc) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	return wait.PollImmediateUntil(interval, f, ctx.Done())
 }
 
+// startTestEnv starts a local control plane (etcd and kube-apiserver) and
+// stops it when the test ends. The CRDs found in crdPaths, e.g. "config/crd",
+// are installed before it returns. The binaries are looked up in
+// KUBEBUILDER_ASSETS. With USE_EXISTING_CLUSTER=true, no control plane is
+// started and the tests run against the cluster the kubeconfig points to.
+func startTestEnv(t *testing.T, scheme *runtime.Scheme, crdPaths ...string) *rest.Config {
+	testEnv := newTestEnv(scheme, crdPaths...)
+	rc, err := testEnv.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, testEnv.Stop())
+	})
+	return rc
+}
+
+// startManager starts mgr with StartManager and waits for its caches to sync,
+// failing the test if the manager stops before that. The returned channel is
+// StartManager's errc, for the tests that wait for the manager to stop.
+func startManager(t *testing.T, ctx context.Context, mgr ctrl.Manager) <-chan error {
+	t.Helper()
+	started, errc := StartManager(ctx, mgr)
+	select {
+	case <-started:
+	case err := <-errc:
+		t.Fatalf("the manager stopped before it started: %v", err)
+	}
+	return errc
+}
+
+func newTestEnv(scheme *runtime.Scheme, crdPaths ...string) *envtest.Environment {
+	return &envtest.Environment{
+		Scheme: scheme,
+		CRDInstallOptions: envtest.CRDInstallOptions{
+			Paths:              crdPaths,
+			ErrorIfPathMissing: true,
+		},
+	}
+}
+
+func Test_newTestEnvWithExistingCluster(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	// Even without CRDs to install, Start connects to the cluster, so the
+	// "existing cluster" has to be a real one.
+	existing := startTestEnv(t, scheme)
+
+	useExistingCluster := true
+	testEnv := newTestEnv(scheme)
+	testEnv.UseExistingCluster = &useExistingCluster
+	testEnv.Config = existing
+
+	rc, err := testEnv.Start()
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, testEnv.Stop())
+	}()
+
+	require.Same(t, existing, rc)
+	require.Nil(t, testEnv.ControlPlane.APIServer, "a local apiserver was started")
+	require.Nil(t, testEnv.ControlPlane.Etcd, "a local etcd was started")
+}
+
+// The controller-runtime and klog loggers are process-wide, and
+// ctrl.SetLogger only takes effect the first time it is called. To be able to
+// run more than one test, both are given a forwardingLogger that prints to
+// whichever test last called setupTestLogger.
+var (
+	forwardMu sync.Mutex
+	forwardTo logr.Logger = logr.Discard()
+)
+
+func init() {
+	ctrl.SetLogger(forwardingLogger{})
+	klog.SetLogger(forwardingLogger{})
+}
+
+// klog's flags are registered once since klog.InitFlags binds them to klog's
+// process-wide state every time it is called.
+var (
+	klogFlagsOnce sync.Once
+	klogFlags     = flag.NewFlagSet("klog", flag.ExitOnError)
+)
+
+// configureKlog sets klog's verbosity until the test ends, after which the
+// previous verbosity is restored. Since klog's verbosity is process-wide, the
+// tests that call configureKlog must not run in parallel.
+func configureKlog(t *testing.T, verbosity int) {
+	klogFlagsOnce.Do(func() {
+		klog.InitFlags(klogFlags)
+	})
+
+	previous := klogFlags.Lookup("v").Value.String()
+	require.NoError(t, klogFlags.Set("v", strconv.Itoa(verbosity)))
+	t.Cleanup(func() {
+		require.NoError(t, klogFlags.Set("v", previous))
+	})
+}
+
+func Test_configureKlog(t *testing.T) {
+	before := klog.V(2).Enabled()
+	t.Run("verbose", func(t *testing.T) {
+		configureKlog(t, 6)
+		require.True(t, bool(klog.V(6).Enabled()))
+	})
+	t.Run("quiet", func(t *testing.T) {
+		configureKlog(t, 2)
+		require.True(t, bool(klog.V(2).Enabled()))
+		require.False(t, bool(klog.V(6).Enabled()), "the verbosity of the previous subtest leaked")
+	})
+	require.Equal(t, before, klog.V(2).Enabled(), "the verbosity was not restored")
+}
+
+// setupTestLogger returns a TestLogger for t and points the global loggers to
+// it until the test ends.
+func setupTestLogger(t *testing.T) TestLogger {
+	logger := TestLogger{T: t}
+
+	forwardMu.Lock()
+	forwardTo = logger
+	forwardMu.Unlock()
+	t.Cleanup(func() {
+		forwardMu.Lock()
+		forwardTo = logr.Discard()
+		forwardMu.Unlock()
+	})
+
+	return logger
+}
+
+// forwardingLogger is a logr.Logger that forwards everything to forwardTo.
+type forwardingLogger struct {
+	name          string
+	keysAndValues []interface{}
+}
+
+func (log forwardingLogger) target() logr.Logger {
+	forwardMu.Lock()
+	target := forwardTo
+	forwardMu.Unlock()
+
+	if log.name != "" {
+		target = target.WithName(log.name)
+	}
+	if len(log.keysAndValues) > 0 {
+		target = target.WithValues(log.keysAndValues...)
+	}
+	return target
+}
+
+func (log forwardingLogger) Info(msg string, keysAndValues ...interface{}) {
+	log.target().Info(msg, keysAndValues...)
+}
+
+func (log forwardingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	log.target().Error(err, msg, keysAndValues...)
+}
+
+func (forwardingLogger) Enabled() bool {
+	return true
+}
+
+func (log forwardingLogger) V(v int) logr.Logger {
+	return log
+}
+
+func (log forwardingLogger) WithName(name string) logr.Logger {
+	log.name = name
+	return log
+}
+
+func (log forwardingLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	log.keysAndValues = append(append([]interface{}{}, log.keysAndValues...), keysAndValues...)
+	return log
+}
+
 // TestLogger is a logr.Logger that prints everything to t.Log.
 type TestLogger struct {
 	T          *testing.T
@@ -221,3 +522,169 @@ func (log TestLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
 	}
 	return log
 }
+
+// AssertNoSecretDataLogged fails the test if a line logged through log
+// contains the given value, as is, base64-encoded as in the JSON of a
+// Secret, or as the bytes that %v prints for a []byte, e.g., when someone
+// logs the full Secret.
+func AssertNoSecretDataLogged(t *testing.T, log CapturingLogger, knownSecretValue string) {
+	t.Helper()
+	for _, line := range secretDataLogged(log, knownSecretValue) {
+		t.Errorf("the secret value was logged: %s", line)
+	}
+}
+
+// secretDataLogged returns the lines that contain the value.
+func secretDataLogged(log CapturingLogger, value string) []string {
+	forms := []string{
+		value,
+		base64.StdEncoding.EncodeToString([]byte(value)),
+		strings.Trim(fmt.Sprint([]byte(value)), "[]"),
+	}
+	var leaked []string
+	for _, line := range log.Lines() {
+		text := fmt.Sprintf("%s %s %v %+v", line.Name, line.Msg, line.Err, line.KeysAndValues)
+		for _, form := range forms {
+			if strings.Contains(text, form) {
+				leaked = append(leaked, text)
+				break
+			}
+		}
+	}
+	return leaked
+}
+
+func TestAssertNoSecretDataLogged(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"},
+		Data:       map[string][]byte{"password": []byte("hunter2")},
+	}
+
+	log := NewCapturingLogger()
+	log.Info("reconciling", "secret", client.ObjectKeyFromObject(secret))
+	AssertNoSecretDataLogged(t, log, "hunter2")
+
+	log.WithValues("object", secret).Info("got the full object")
+	log.Error(fmt.Errorf("invalid password %s", base64.StdEncoding.EncodeToString(secret.Data["password"])), "while checking")
+	require.Len(t, secretDataLogged(log, "hunter2"), 2)
+}
+
+// teeLogger sends every line to both loggers, e.g., to a TestLogger and to a
+// CapturingLogger.
+type teeLogger [2]logr.Logger
+
+func (log teeLogger) Info(msg string, keysAndValues ...interface{}) {
+	log[0].Info(msg, keysAndValues...)
+	log[1].Info(msg, keysAndValues...)
+}
+
+func (log teeLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	log[0].Error(err, msg, keysAndValues...)
+	log[1].Error(err, msg, keysAndValues...)
+}
+
+func (log teeLogger) Enabled() bool {
+	return log[0].Enabled() || log[1].Enabled()
+}
+
+func (log teeLogger) V(v int) logr.Logger {
+	return teeLogger{log[0].V(v), log[1].V(v)}
+}
+
+func (log teeLogger) WithName(name string) logr.Logger {
+	return teeLogger{log[0].WithName(name), log[1].WithName(name)}
+}
+
+func (log teeLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return teeLogger{log[0].WithValues(keysAndValues...), log[1].WithValues(keysAndValues...)}
+}
+
+// CapturingLogger is a logr.Logger that keeps the log lines in memory so that
+// tests can assert on them. The loggers derived from it with WithName,
+// WithValues or V share the same lines.
+type CapturingLogger struct {
+	lines         *capturedLines
+	name          string
+	level         int
+	keysAndValues []interface{}
+}
+
+type capturedLines struct {
+	mu    sync.Mutex
+	lines []LogLine
+}
+
+// LogLine is a line logged through a CapturingLogger. KeysAndValues contains
+// the values given with WithValues followed by the ones given to Info or
+// Error.
+type LogLine struct {
+	Name          string
+	Level         int
+	Msg           string
+	Err           error
+	KeysAndValues []interface{}
+}
+
+// Value returns the value associated with the given key, or nil.
+func (l LogLine) Value(key string) interface{} {
+	for i := 0; i+1 < len(l.KeysAndValues); i += 2 {
+		if l.KeysAndValues[i] == key {
+			return l.KeysAndValues[i+1]
+		}
+	}
+	return nil
+}
+
+func NewCapturingLogger() CapturingLogger {
+	return CapturingLogger{lines: &capturedLines{}}
+}
+
+// Lines returns the lines logged so far.
+func (log CapturingLogger) Lines() []LogLine {
+	log.lines.mu.Lock()
+	defer log.lines.mu.Unlock()
+	return append([]LogLine{}, log.lines.lines...)
+}
+
+func (log CapturingLogger) add(err error, msg string, keysAndValues []interface{}) {
+	line := LogLine{
+		Name:          log.name,
+		Level:         log.level,
+		Msg:           msg,
+		Err:           err,
+		KeysAndValues: append(append([]interface{}{}, log.keysAndValues...), keysAndValues...),
+	}
+	log.lines.mu.Lock()
+	log.lines.lines = append(log.lines.lines, line)
+	log.lines.mu.Unlock()
+}
+
+func (log CapturingLogger) Info(msg string, keysAndValues ...interface{}) {
+	log.add(nil, msg, keysAndValues)
+}
+
+func (log CapturingLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	log.add(err, msg, keysAndValues)
+}
+
+func (CapturingLogger) Enabled() bool {
+	return true
+}
+
+func (log CapturingLogger) V(v int) logr.Logger {
+	log.level += v
+	return log
+}
+
+func (log CapturingLogger) WithName(name string) logr.Logger {
+	if log.name != "" {
+		name = log.name + "." + name
+	}
+	log.name = name
+	return log
+}
+
+func (log CapturingLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	log.keysAndValues = append(append([]interface{}{}, log.keysAndValues...), keysAndValues...)
+	return log
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// StartManager runs mgr.Start in the background. The started channel is
+// closed once the manager has been elected and the cache has started and
+// synced the informers that existed at that point; the informers that the
+// controllers create when they start may still be syncing. The error returned
+// by mgr.Start, if any, is sent to errc, which is closed when mgr.Start
+// returns. When ctx is done before the cache has synced, started is never
+// closed.
+func StartManager(ctx context.Context, mgr manager.Manager) (started <-chan struct{}, errc <-chan error) {
+	startedCh := make(chan struct{})
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(errCh)
+		err := mgr.Start(ctx)
+		if err != nil {
+			errCh <- err
+		}
+	}()
+
+	go func() {
+		select {
+		case <-mgr.Elected():
+		case <-ctx.Done():
+			return
+		}
+		if mgr.GetCache().WaitForCacheSync(ctx) {
+			close(startedCh)
+		}
+	}()
+
+	return startedCh, errCh
+}
+
+// WithBaseContext returns a context that carries the values of base(), e.g., a
+// logger or an experiment ID, and that is done when ctx is done. The vendored
+// controller-runtime has no BaseContext option: the manager hands the context
+// given to mgr.Start to every runnable, and each controller passes it on to
+// Reconcile. Start the manager with the returned context for the values to
+// show up in Reconcile. When base() and ctx both have a value for the same
+// key, the one from base() wins.
+func WithBaseContext(ctx context.Context, base func() context.Context) context.Context {
+	return baseContext{Context: ctx, values: base()}
+}
+
+type baseContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c baseContext) Value(key interface{}) interface{} {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
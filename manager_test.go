@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestStartManager(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: logger}).SetupWithManager(mgr)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started, errc := StartManager(ctx, mgr)
+
+	select {
+	case <-started:
+	case err := <-errc:
+		t.Fatalf("the manager stopped before it started: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the manager to start")
+	}
+
+	t.Log("Stopping the manager should close errc without sending an error")
+	cancel()
+	select {
+	case err, ok := <-errc:
+		require.False(t, ok, "unexpected error: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the manager to stop")
+	}
+}
+
+type experimentIDKey struct{}
+
+func TestWithBaseContext(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	seen := make(chan interface{}, 1)
+	err = ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Secret{}, builder.OnlyMetadata).
+		Complete(reconcile.Func(func(ctx context.Context, _ reconcile.Request) (reconcile.Result, error) {
+			select {
+			case seen <- ctx.Value(experimentIDKey{}):
+			default:
+			}
+			return reconcile.Result{}, nil
+		}))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	base := func() context.Context {
+		return context.WithValue(context.Background(), experimentIDKey{}, "experiment-1")
+	}
+	startManager(t, WithBaseContext(ctx, base), mgr)
+
+	require.NoError(t, kc.Create(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}))
+
+	select {
+	case v := <-seen:
+		require.Equal(t, "experiment-1", v)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the Secret to be reconciled")
+	}
+}
+
+// startupLog records the order in which the startup steps happen.
+type startupLog struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (l *startupLog) record(step string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.steps = append(l.steps, step)
+}
+
+func (l *startupLog) Steps() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.steps...)
+}
+
+func (l *startupLog) index(step string) int {
+	for i, s := range l.Steps() {
+		if s == step {
+			return i
+		}
+	}
+	return -1
+}
+
+// syncRecordingCache records when WaitForCacheSync first returns true, which
+// the manager calls before it starts the runnables.
+type syncRecordingCache struct {
+	cache.Cache
+	log  *startupLog
+	once sync.Once
+}
+
+func (c *syncRecordingCache) WaitForCacheSync(ctx context.Context) bool {
+	synced := c.Cache.WaitForCacheSync(ctx)
+	if synced {
+		c.once.Do(func() { c.log.record("cache synced") })
+	}
+	return synced
+}
+
+// TestManager_StartupOrder pins the ordering that the repro depends on: the
+// manager starts the cache and waits for the informers that exist by then to
+// sync before it starts the runnables, controllers included. The metadata
+// informer is created upfront so that it is one of them; otherwise, the
+// controller creates it when it starts and waits for it on its own. The
+// Secret informer that Reconcile reads from is never one of them: it only
+// gets created by the first Get, which is where the race comes from.
+func TestManager_StartupOrder(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+
+	log := &startupLog{}
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+		NewCache: func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+			c, err := cache.New(config, opts)
+			if err != nil {
+				return nil, err
+			}
+			return &syncRecordingCache{Cache: c, log: log}, nil
+		},
+	})
+	require.NoError(t, err)
+
+	// Getting the informer before the manager starts doesn't block, unlike
+	// later on, when GetInformer waits for the informer to sync.
+	meta := &metav1.PartialObjectMetadata{}
+	meta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+	informer, err := mgr.GetCache().GetInformer(ctx, meta)
+	require.NoError(t, err)
+	metadataSynced := informer.HasSynced
+
+	require.NoError(t, mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if !metadataSynced() {
+			log.record("runnable started before the metadata informer synced")
+		}
+		log.record("runnable started")
+		return nil
+	})))
+
+	var firstReconcile sync.Once
+	r := &AnnotatingReconciler{Client: mgr.GetClient(), Log: logger, Middlewares: []Middleware{
+		func(next reconcile.Reconciler) reconcile.Reconciler {
+			return reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+				firstReconcile.Do(func() {
+					if !metadataSynced() {
+						log.record("reconcile started before the metadata informer synced")
+					}
+					log.record("first reconcile")
+				})
+				return next.Reconcile(ctx, req)
+			})
+		},
+	}}
+	require.NoError(t, r.SetupWithManager(mgr))
+
+	startManager(t, ctx, mgr)
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return log.index("first reconcile") >= 0 && log.index("runnable started") >= 0, nil
+	}))
+
+	steps := log.Steps()
+	t.Logf("Startup steps: %q", steps)
+	require.NotContains(t, steps, "runnable started before the metadata informer synced")
+	require.NotContains(t, steps, "reconcile started before the metadata informer synced")
+	require.Equal(t, "cache synced", steps[0], "the cache should sync before anything else starts")
+	require.Less(t, log.index("cache synced"), log.index("runnable started"))
+	require.Less(t, log.index("cache synced"), log.index("first reconcile"))
+}
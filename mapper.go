@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// SnapshotRESTMapper only knows about the kinds that the apiserver served
+// when it was created or last Reset. Unlike controller-runtime's dynamic
+// RESTMapper, it never refreshes on its own, which makes it easy to reproduce
+// the "no matches for kind" errors that a stale RESTMapper causes when a CRD
+// is installed after the manager starts.
+type SnapshotRESTMapper struct {
+	discovery discovery.DiscoveryInterface
+
+	mu     sync.RWMutex
+	mapper meta.RESTMapper
+}
+
+// NewSnapshotRESTMapper can be used as ctrl.Options.MapperProvider.
+func NewSnapshotRESTMapper(cfg *rest.Config) (meta.RESTMapper, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("while creating the discovery client: %w", err)
+	}
+	m := &SnapshotRESTMapper{discovery: dc}
+	err = m.Reset()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reset discovers the kinds served by the apiserver again.
+func (m *SnapshotRESTMapper) Reset() error {
+	resources, err := restmapper.GetAPIGroupResources(m.discovery)
+	if err != nil {
+		return fmt.Errorf("while discovering the API resources: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mapper = restmapper.NewDiscoveryRESTMapper(resources)
+	return nil
+}
+
+func (m *SnapshotRESTMapper) current() meta.RESTMapper {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mapper
+}
+
+func (m *SnapshotRESTMapper) KindFor(resource schema.GroupVersionResource) (schema.GroupVersionKind, error) {
+	return m.current().KindFor(resource)
+}
+
+func (m *SnapshotRESTMapper) KindsFor(resource schema.GroupVersionResource) ([]schema.GroupVersionKind, error) {
+	return m.current().KindsFor(resource)
+}
+
+func (m *SnapshotRESTMapper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource, error) {
+	return m.current().ResourceFor(input)
+}
+
+func (m *SnapshotRESTMapper) ResourcesFor(input schema.GroupVersionResource) ([]schema.GroupVersionResource, error) {
+	return m.current().ResourcesFor(input)
+}
+
+func (m *SnapshotRESTMapper) RESTMapping(gk schema.GroupKind, versions ...string) (*meta.RESTMapping, error) {
+	return m.current().RESTMapping(gk, versions...)
+}
+
+func (m *SnapshotRESTMapper) RESTMappings(gk schema.GroupKind, versions ...string) ([]*meta.RESTMapping, error) {
+	return m.current().RESTMappings(gk, versions...)
+}
+
+func (m *SnapshotRESTMapper) ResourceSingularizer(resource string) (string, error) {
+	return m.current().ResourceSingularizer(resource)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"controller-runtime-cache-race/api/v1alpha1"
+)
+
+func TestAnnotatingReconciler_MapperRefreshOnMissing(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme, v1alpha1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme) // The Widget CRD is installed later on.
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+		MapperProvider:     NewSnapshotRESTMapper,
+	})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	// With controller-runtime v0.10, a controller can't start watching a
+	// kind that doesn't exist yet, which is why Reconcile is called directly.
+	key := types.NamespacedName{Name: "widget-1", Namespace: "default"}
+	req := reconcile.Request{NamespacedName: key}
+	stale := NewAnnotatingReconciler(mgr.GetClient(), logger, &v1alpha1.Widget{}, "widget-found", "yes")
+	refreshing := NewAnnotatingReconciler(mgr.GetClient(), logger, &v1alpha1.Widget{}, "widget-found", "yes")
+	refreshing.MapperRefreshOnMissing = true
+
+	res, err := refreshing.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, time.Second, res.RequeueAfter)
+
+	t.Log("Installing the Widget CRD after the manager started")
+	_, err = envtest.InstallCRDs(rc, envtest.CRDInstallOptions{Paths: []string{"config/crd"}, ErrorIfPathMissing: true})
+	require.NoError(t, err)
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+	widget := v1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	require.NoError(t, kc.Create(ctx, &widget))
+
+	_, err = stale.Reconcile(ctx, req)
+	var noKindMatch *meta.NoKindMatchError
+	require.True(t, errors.As(err, &noKindMatch), "expected a no match error, got: %v", err)
+
+	t.Log("Retrying as the requeue would, until the Widget is annotated")
+	require.NoError(t, pollUntil(ctx, 100*time.Millisecond, timeout, func() (bool, error) {
+		_, err := refreshing.Reconcile(ctx, req)
+		if err != nil {
+			return false, err
+		}
+		err = kc.Get(ctx, key, &widget)
+		if err != nil {
+			return false, err
+		}
+		return widget.Annotations["widget-found"] == "yes", nil
+	}))
+}
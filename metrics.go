@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// activeReconciles is the number of reconciles in progress, which shows how
+// many workers are busy under load and how long the manager takes to drain
+// them on shutdown. It is served along with controller-runtime's metrics.
+var activeReconciles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cacherace_active_reconciles",
+	Help: "Number of reconciles in progress per controller.",
+}, []string{"controller"})
+
+// cacheSyncLag is set by the CacheLagProber.
+var cacheSyncLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cacherace_cache_sync_lag_seconds",
+	Help: "Time it took for the cache to reflect the last write to the probe Secret, once acknowledged by the apiserver.",
+}, []string{"probe"})
+
+// apiserverRequests is incremented by the RequestCounters.
+var apiserverRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cacherace_apiserver_requests_total",
+	Help: "Number of requests sent to the apiserver through a RequestCounter, per verb and resource.",
+}, []string{"verb", "resource"})
+
+// staleReads is incremented by the AnnotatingReconciler each time it notices
+// that the cache is behind, i.e., with RequeueOnStale or ConsistencyChecks.
+// It isn't a vector so that it shows up, at zero, before any stale read.
+var staleReads = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cacherace_stale_reads_total",
+	Help: "Number of reads from the cache that the reconcilers noticed were stale.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(activeReconciles, cacheSyncLag, apiserverRequests, staleReads)
+}
+
+// DumpMetrics writes the metrics of the controller-runtime registry, which
+// include ours, to the file at path in the Prometheus text format, so that a
+// run can be archived without being scraped. The file is replaced atomically.
+func DumpMetrics(path string) error {
+	err := prometheus.WriteToTextfile(path, metrics.Registry)
+	if err != nil {
+		return fmt.Errorf("while dumping the metrics to %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+func Test_activeReconciles(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	// Seeding before the manager starts gives a burst of reconciles.
+	require.NoError(t, SeedSecrets(ctx, kc, "default", 10, corev1.Secret{}))
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	err = (&AnnotatingReconciler{
+		Client:                  &slowClient{Client: mgr.GetClient(), delay: 500 * time.Millisecond},
+		Log:                     logger,
+		MaxConcurrentReconciles: 5,
+	}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	t.Log("Waiting for more than one reconcile to be in progress")
+	var max float64
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		active, _, err := gaugeValue("cacherace_active_reconciles", "controller", "secret")
+		if err != nil {
+			return false, err
+		}
+		if active > max {
+			max = active
+		}
+		return max > 1, nil
+	}))
+	require.LessOrEqual(t, max, 5.0)
+}
+
+// gaugeValue returns the value of the gauge with the given name and label
+// from controller-runtime's metrics registry. found is false when the gauge
+// has no such label yet.
+func gaugeValue(name, labelName, labelValue string) (value float64, found bool, err error) {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		return 0, false, err
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == labelName && label.GetValue() == labelValue {
+					return m.GetGauge().GetValue(), true, nil
+				}
+			}
+		}
+	}
+	return 0, false, nil
+}
+
+// slowClient delays each Get so that the reconciles last long enough to be
+// observed.
+type slowClient struct {
+	client.Client
+	delay time.Duration
+}
+
+func (c *slowClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	time.Sleep(c.delay)
+	return c.Client.Get(ctx, key, obj)
+}
+
+// The command dumps the metrics when it stops, as with --metrics-dump.
+func TestRun_MetricsDump(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "metrics.prom")
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(runCtx, rc, logger, runOptions{MetricsAddr: "0", MetricsDump: path})
+	}()
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+		return secret.Annotations["secret-found"] == "yes", err
+	}))
+
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err), "the metrics should only be dumped on shutdown")
+	stop()
+	require.NoError(t, <-done)
+
+	dump, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(dump), "# TYPE cacherace_stale_reads_total counter")
+	require.Contains(t, string(dump), `cacherace_active_reconciles{controller="secret"} 0`)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Middleware wraps a reconciler with a concern that doesn't belong to any
+// reconciler in particular, such as timing the reconciles.
+type Middleware func(reconcile.Reconciler) reconcile.Reconciler
+
+// Chain wraps r with the middlewares. The first middleware is the outermost
+// one: Chain(r, a, b) is the same as a(b(r)).
+func Chain(r reconcile.Reconciler, mws ...Middleware) reconcile.Reconciler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		r = mws[i](r)
+	}
+	return r
+}
+
+// Recording returns a middleware that records each reconcile into the
+// recorder. The recorder can only wrap one reconciler at a time.
+func Recording(recorder *ReconcileRecorder) Middleware {
+	return func(next reconcile.Reconciler) reconcile.Reconciler {
+		recorder.Reconciler = next
+		return recorder
+	}
+}
+
+// Recovering returns a middleware that recovers from a panic in the
+// reconcile, logs it with its stack trace at the error level and returns an
+// error matching ErrPanic so that the object gets requeued. By default,
+// controller-runtime v0.10 lets the panic crash the manager. Its
+// controller.Options.RecoverPanic also turns the panic into an error, but
+// the panic only goes to client-go's panic handlers, which log through klog
+// rather than the given logger, and the error can't be told apart from the
+// others. With repanic, the panic is logged and raised again, which tests use
+// so that a panic doesn't go unnoticed.
+func Recovering(log logr.Logger, repanic bool) Middleware {
+	return func(next reconcile.Reconciler) reconcile.Reconciler {
+		return reconcile.Func(func(ctx context.Context, req reconcile.Request) (_ reconcile.Result, err error) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				err = fmt.Errorf("%w: %v", ErrPanic, r)
+				log.Error(err, "recovered from a panic", "request", req.NamespacedName, "stack", string(debug.Stack()))
+				if repanic {
+					panic(r)
+				}
+			}()
+			return next.Reconcile(ctx, req)
+		})
+	}
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID is a middleware that gives each reconcile a random ID,
+// stored in the context and added as "reconcileID" to the context's logger.
+// The AnnotatingReconciler also adds it to its own logger, which tells the
+// log lines of two reconciles of the same object apart.
+func WithCorrelationID(next reconcile.Reconciler) reconcile.Reconciler {
+	return reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+		id := rand.String(8)
+		ctx = context.WithValue(ctx, correlationIDKey{}, id)
+		ctx = logr.NewContext(ctx, logr.FromContextOrDiscard(ctx).WithValues("reconcileID", id))
+		return next.Reconcile(ctx, req)
+	})
+}
+
+// CorrelationID returns the ID set by WithCorrelationID, or an empty string.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	around := func(name string) Middleware {
+		return func(next reconcile.Reconciler) reconcile.Reconciler {
+			return reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+				calls = append(calls, name+" before")
+				defer func() { calls = append(calls, name+" after") }()
+				return next.Reconcile(ctx, req)
+			})
+		}
+	}
+	inner := reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+		calls = append(calls, "inner")
+		return reconcile.Result{}, nil
+	})
+
+	_, err := Chain(inner, around("a"), around("b")).Reconcile(context.Background(), reconcile.Request{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a before", "b before", "inner", "b after", "a after"}, calls)
+}
+
+func TestWithCorrelationID(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+	log := NewCapturingLogger()
+
+	recorder := &ReconcileRecorder{}
+	r := Chain(&AnnotatingReconciler{Client: c, Log: log}, Recording(recorder), WithCorrelationID)
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(secret)}
+	for i := 0; i < 2; i++ {
+		_, err = r.Reconcile(context.Background(), req)
+		require.NoError(t, err)
+	}
+	require.Len(t, recorder.Events("default/secret-1"), 2)
+
+	// Each reconcile has its own ID, which all its lines carry.
+	var ids []interface{}
+	for _, line := range log.Lines() {
+		id := valueOf(line.KeysAndValues, "reconcileID")
+		require.NotNil(t, id, "line %q has no reconcileID", line.Msg)
+		if line.Msg == "start" {
+			ids = append(ids, id)
+		}
+	}
+	require.Len(t, ids, 2)
+	require.NotEqual(t, ids[0], ids[1])
+}
+
+func valueOf(keysAndValues []interface{}, key string) interface{} {
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if keysAndValues[i] == key {
+			return keysAndValues[i+1]
+		}
+	}
+	return nil
+}
+
+func TestRecovering(t *testing.T) {
+	// The mutator forgets to initialize the annotations.
+	panicking := reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+		var annotations map[string]string
+		annotations["secret-found"] = "yes"
+		return reconcile.Result{}, nil
+	})
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "secret-1", Namespace: "default"}}
+
+	t.Run("the panic is logged and returned as an error", func(t *testing.T) {
+		log := NewCapturingLogger()
+		_, err := Chain(panicking, Recovering(log, false)).Reconcile(context.Background(), req)
+		require.Error(t, err)
+		require.True(t, errors.Is(err, ErrPanic), "expected ErrPanic, got: %v", err)
+		require.Contains(t, err.Error(), "assignment to entry in nil map")
+
+		lines := log.Lines()
+		require.Len(t, lines, 1)
+		require.Equal(t, "recovered from a panic", lines[0].Msg)
+		require.Equal(t, err, lines[0].Err)
+		require.Contains(t, lines[0].Value("stack"), "middleware_test.go")
+	})
+
+	t.Run("the panic is raised again with repanic", func(t *testing.T) {
+		log := NewCapturingLogger()
+		require.Panics(t, func() {
+			_, _ = Chain(panicking, Recovering(log, true)).Reconcile(context.Background(), req)
+		})
+		require.Len(t, log.Lines(), 1)
+	})
+
+	t.Run("the manager keeps running and requeues the object", func(t *testing.T) {
+		logger := setupTestLogger(t)
+
+		scheme, err := BuildScheme(corev1.AddToScheme)
+		require.NoError(t, err)
+		rc := startTestEnv(t, scheme)
+
+		const timeout = 10 * time.Second
+		ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+		defer cancel()
+
+		kc, err := client.New(rc, client.Options{Scheme: scheme})
+		require.NoError(t, err)
+
+		mgr, err := ctrl.NewManager(rc, ctrl.Options{
+			Scheme:             scheme,
+			Logger:             logger,
+			MetricsBindAddress: "0",
+		})
+		require.NoError(t, err)
+		var panicked int32
+		panicOnce := func(next reconcile.Reconciler) reconcile.Reconciler {
+			return reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+				if atomic.CompareAndSwapInt32(&panicked, 0, 1) {
+					return panicking.Reconcile(ctx, req)
+				}
+				return next.Reconcile(ctx, req)
+			})
+		}
+		log := NewCapturingLogger()
+		err = (&AnnotatingReconciler{
+			Client:          mgr.GetClient(),
+			Log:             logger,
+			WatchFullObject: true,
+			Middlewares:     []Middleware{Recovering(log, false), panicOnce},
+		}).SetupWithManager(mgr)
+		require.NoError(t, err)
+		startManager(t, ctx, mgr)
+
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+
+		t.Log("Waiting for the Secret to be annotated after the panic")
+		require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+			err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+			if err != nil {
+				return false, err
+			}
+			return secret.Annotations["secret-found"] == "yes", nil
+		}))
+		require.Len(t, log.Lines(), 1)
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// SetupMultiCluster creates one manager per cluster, each running the
+// AnnotatingReconciler, and returns them sorted by cluster name; starting
+// them is up to the caller. The log lines of each manager and its reconciler
+// carry the "cluster" key, and the controllers are named secret-<cluster> so
+// that the metrics, e.g., cacherace_active_reconciles, tell the clusters
+// apart. The metrics servers are disabled since the managers would all bind
+// the same address; the metrics are still in the controller-runtime registry.
+func SetupMultiCluster(configs map[string]*rest.Config, log logr.Logger) ([]manager.Manager, error) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	if err != nil {
+		return nil, fmt.Errorf("while building the scheme: %w", err)
+	}
+
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var mgrs []manager.Manager
+	for _, name := range names {
+		clusterLog := log.WithValues("cluster", name)
+		mgr, err := ctrl.NewManager(configs[name], ctrl.Options{
+			Scheme:             scheme,
+			Logger:             clusterLog,
+			MetricsBindAddress: "0",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("while creating the manager for cluster %s: %w", name, err)
+		}
+		err = (&AnnotatingReconciler{
+			Client: mgr.GetClient(),
+			Log:    clusterLog,
+			Name:   "secret-" + name,
+		}).SetupWithManager(mgr)
+		if err != nil {
+			return nil, fmt.Errorf("while setting up the reconciler for cluster %s: %w", name, err)
+		}
+		mgrs = append(mgrs, mgr)
+	}
+	return mgrs, nil
+}
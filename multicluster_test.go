@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestSetupMultiCluster(t *testing.T) {
+	captured := NewCapturingLogger()
+	logger := teeLogger{setupTestLogger(t), captured}
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	configs := map[string]*rest.Config{
+		"east": startTestEnv(t, scheme),
+		"west": startTestEnv(t, scheme),
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Second)
+	defer cancel()
+
+	mgrs, err := SetupMultiCluster(configs, logger)
+	require.NoError(t, err)
+	require.Len(t, mgrs, 2)
+	for _, mgr := range mgrs {
+		startManager(t, ctx, mgr)
+	}
+
+	// Each cluster gets a Secret of its own name, so that a log line tagged
+	// with the wrong cluster would show.
+	for cluster, rc := range configs {
+		kc, err := client.New(rc, client.Options{Scheme: scheme})
+		require.NoError(t, err)
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-" + cluster, Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+		require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 10*time.Second, func() (bool, error) {
+			err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+			return secret.Annotations["secret-found"] == "yes", err
+		}), "the Secret in cluster %s wasn't annotated", cluster)
+	}
+
+	reconciled := map[string]bool{}
+	for _, line := range captured.Lines() {
+		if line.Msg != "start" {
+			continue
+		}
+		cluster, ok := line.Value("cluster").(string)
+		require.True(t, ok, "log line without a cluster: %+v", line)
+		require.Equal(t, "secret-"+cluster+"-reconciler", line.Name)
+		key, ok := line.Value("secret").(types.NamespacedName)
+		if !ok || key.Name != "secret-"+cluster {
+			require.Fail(t, "log line tagged with the wrong cluster", "%+v", line)
+		}
+		reconciled[cluster] = true
+	}
+	require.Equal(t, map[string]bool{"east": true, "west": true}, reconciled)
+}
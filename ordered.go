@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// creationOrdered is the source of the create events when DeterministicOrder
+// is set. The informer delivers the objects of its initial list in the order
+// in which the apiserver lists them, which isn't specified and changes from
+// one list to the next when served by the watch cache. Instead,
+// creationOrdered waits for the informer to sync, lists its store and sends
+// the create events sorted by creationTimestamp, then by namespace and name
+// since the timestamps are only precise to the second. The objects created
+// afterwards come through the watch, which already has them in the order of
+// their creation.
+type creationOrdered struct {
+	Type client.Object
+
+	cache   cache.Cache
+	started chan error
+}
+
+var _ source.SyncingSource = &creationOrdered{}
+
+// InjectCache is called by the controller.
+func (s *creationOrdered) InjectCache(c cache.Cache) error {
+	s.cache = c
+	return nil
+}
+
+func (s *creationOrdered) Start(ctx context.Context, h handler.EventHandler, q workqueue.RateLimitingInterface, prcts ...predicate.Predicate) error {
+	if s.cache == nil {
+		return fmt.Errorf("creationOrdered needs a cache")
+	}
+	s.started = make(chan error, 1)
+
+	enqueue := func(obj client.Object) {
+		e := event.CreateEvent{Object: obj}
+		for _, p := range prcts {
+			if !p.Create(e) {
+				return
+			}
+		}
+		h.Create(e, q)
+	}
+
+	// Like source.Kind, GetInformer blocks until the informer is synced
+	// when the cache has already started.
+	go func() {
+		informer, err := s.cache.GetInformer(ctx, s.Type)
+		if err != nil {
+			s.started <- err
+			return
+		}
+
+		// The handler may be told about the objects of the initial list
+		// after the informer has synced, which is why the objects that were
+		// listed are remembered, by UID since a recreated object keeps its
+		// key. A nil map means that the store wasn't listed yet.
+		var mu sync.Mutex
+		var listed map[string]struct{}
+		informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+			AddFunc: func(o interface{}) {
+				obj, ok := o.(client.Object)
+				if !ok {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if listed == nil {
+					return
+				}
+				if _, ok := listed[string(obj.GetUID())]; ok {
+					return
+				}
+				enqueue(obj)
+			},
+		})
+		if !toolscache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+			s.started <- errors.New("cache did not sync")
+			return
+		}
+		withStore, ok := informer.(interface{ GetStore() toolscache.Store })
+		if !ok {
+			s.started <- fmt.Errorf("the informer %T has no store to list", informer)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		var objs []client.Object
+		for _, o := range withStore.GetStore().List() {
+			if obj, ok := o.(client.Object); ok {
+				objs = append(objs, obj)
+			}
+		}
+		sortByCreation(objs)
+		listed = make(map[string]struct{}, len(objs))
+		for _, obj := range objs {
+			listed[string(obj.GetUID())] = struct{}{}
+			enqueue(obj)
+		}
+		close(s.started)
+	}()
+
+	return nil
+}
+
+// WaitForSync is called by the controller before it starts the workers, which
+// means that the objects that existed at startup are all queued by then.
+func (s *creationOrdered) WaitForSync(ctx context.Context) error {
+	select {
+	case err := <-s.started:
+		return err
+	case <-ctx.Done():
+		return errors.New("timed out waiting for cache to be synced")
+	}
+}
+
+func sortByCreation(objs []client.Object) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		ti, tj := objs[i].GetCreationTimestamp(), objs[j].GetCreationTimestamp()
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return client.ObjectKeyFromObject(objs[i]).String() < client.ObjectKeyFromObject(objs[j]).String()
+	})
+}
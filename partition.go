@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// Partitioner simulates a network partition between the clients built from
+// the rest.Config returned by Wrap, e.g., the manager's informers, and the
+// apiserver. Its zero value is ready to use.
+type Partitioner struct {
+	mu      sync.Mutex
+	until   time.Time
+	watches map[*watchBody]struct{}
+}
+
+// Wrap returns a copy of rc whose requests go through the partitioner.
+func (p *Partitioner) Wrap(rc *rest.Config) *rest.Config {
+	rc = rest.CopyConfig(rc)
+	rc.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return partitionRoundTripper{next: rt, p: p}
+	})
+	return rc
+}
+
+// SimulatePartition cuts the ongoing watches and fails every request with
+// "connection refused" for the duration d; it returns right away. The
+// reflectors see their watch fail and try to list again, backing off between
+// attempts, the same way they do when the apiserver is unreachable. Once d has
+// passed, the next attempt goes through and the cache catches up with what was
+// written in the meantime. Until then, the cache serves whatever it had before
+// the partition. The backoff means that the cache may catch up a few seconds
+// after the partition heals.
+func (p *Partitioner) SimulatePartition(d time.Duration) {
+	p.mu.Lock()
+	p.until = time.Now().Add(d)
+	watches := p.watches
+	p.watches = nil
+	p.mu.Unlock()
+
+	for w := range watches {
+		_ = w.ReadCloser.Close()
+	}
+}
+
+func (p *Partitioner) partitioned() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Now().Before(p.until)
+}
+
+type partitionRoundTripper struct {
+	next http.RoundTripper
+	p    *Partitioner
+}
+
+func (rt partitionRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.p.partitioned() {
+		// What the client sees when the apiserver is unreachable.
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil || req.URL.Query().Get("watch") != "true" {
+		return resp, err
+	}
+
+	w := &watchBody{ReadCloser: resp.Body, p: rt.p}
+	rt.p.mu.Lock()
+	if rt.p.watches == nil {
+		rt.p.watches = make(map[*watchBody]struct{})
+	}
+	rt.p.watches[w] = struct{}{}
+	rt.p.mu.Unlock()
+	resp.Body = w
+	return resp, nil
+}
+
+// watchBody is the body of a watch response, which SimulatePartition closes
+// to cut the watch.
+type watchBody struct {
+	io.ReadCloser
+	p *Partitioner
+}
+
+func (w *watchBody) Close() error {
+	w.p.mu.Lock()
+	delete(w.p.watches, w)
+	w.p.mu.Unlock()
+	return w.ReadCloser.Close()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestPartitioner(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 20 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	partitioner := &Partitioner{}
+	mgr, err := ctrl.NewManager(partitioner.Wrap(rc), ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	_, err = mgr.GetCache().GetInformer(ctx, &corev1.Secret{})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := mgr.GetClient().Get(ctx, key, &corev1.Secret{})
+		return err == nil, client.IgnoreNotFound(err)
+	}))
+
+	const partition = 2 * time.Second
+	partitioned := time.Now()
+	partitioner.SimulatePartition(partition)
+	secret.Labels = map[string]string{"foo": "bar"}
+	require.NoError(t, kc.Update(ctx, &secret))
+
+	t.Log("The cache can't see the update during the partition")
+	time.Sleep(partition / 2)
+	var fromCache corev1.Secret
+	require.NoError(t, mgr.GetClient().Get(ctx, key, &fromCache))
+	require.Empty(t, fromCache.Labels)
+
+	t.Log("Waiting for the cache to catch up after the partition heals")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := mgr.GetClient().Get(ctx, key, &fromCache)
+		return fromCache.ResourceVersion == secret.ResourceVersion, err
+	}))
+	caughtUp := time.Since(partitioned)
+	t.Logf("The cache caught up %s after the start of the partition", caughtUp)
+	require.GreaterOrEqual(t, int64(caughtUp), int64(partition))
+	require.Equal(t, secret.Labels, fromCache.Labels)
+}
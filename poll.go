@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// PollLogged calls f every interval until it returns true, returns an error, or
+// the timeout expires. Each attempt and the final outcome are logged at V(4),
+// which helps understand why a poll timed out.
+func PollLogged(ctx context.Context, log logr.Logger, interval, timeout time.Duration, f func() (bool, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	attempts := 0
+	err := wait.PollImmediateUntil(interval, func() (bool, error) {
+		attempts++
+		done, err := f()
+		log.V(4).Info("poll attempt", "attempt", attempts, "done", done, "err", err)
+		return done, err
+	}, ctx.Done())
+	if err != nil {
+		log.V(4).Info("poll failed", "attempts", attempts, "err", err)
+		return err
+	}
+
+	log.V(4).Info("poll succeeded", "attempts", attempts)
+	return nil
+}
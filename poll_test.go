@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestPollLogged(t *testing.T) {
+	t.Run("logs each attempt and the success", func(t *testing.T) {
+		log := NewCapturingLogger()
+		calls := 0
+		err := PollLogged(context.Background(), log, time.Millisecond, time.Second, func() (bool, error) {
+			calls++
+			return calls == 3, nil
+		})
+		require.NoError(t, err)
+
+		lines := log.Lines()
+		require.Len(t, lines, 4)
+		for i, line := range lines[:3] {
+			assert.Equal(t, 4, line.Level)
+			assert.Equal(t, "poll attempt", line.Msg)
+			assert.Equal(t, i+1, line.Value("attempt"))
+			assert.Equal(t, i == 2, line.Value("done"))
+		}
+		assert.Equal(t, 4, lines[3].Level)
+		assert.Equal(t, "poll succeeded", lines[3].Msg)
+		assert.Equal(t, 3, lines[3].Value("attempts"))
+	})
+
+	t.Run("logs the error", func(t *testing.T) {
+		log := NewCapturingLogger()
+		boom := errors.New("boom")
+		err := PollLogged(context.Background(), log, time.Millisecond, time.Second, func() (bool, error) {
+			return false, boom
+		})
+		require.Equal(t, boom, err)
+
+		lines := log.Lines()
+		require.Len(t, lines, 2)
+		assert.Equal(t, boom, lines[0].Value("err"))
+		assert.Equal(t, "poll failed", lines[1].Msg)
+		assert.Equal(t, boom, lines[1].Value("err"))
+	})
+
+	t.Run("logs the timeout", func(t *testing.T) {
+		log := NewCapturingLogger()
+		err := PollLogged(context.Background(), log, time.Millisecond, 20*time.Millisecond, func() (bool, error) {
+			return false, nil
+		})
+		require.Equal(t, wait.ErrWaitTimeout, err)
+
+		lines := log.Lines()
+		require.NotEmpty(t, lines)
+		last := lines[len(lines)-1]
+		assert.Equal(t, "poll failed", last.Msg)
+		assert.Equal(t, len(lines)-1, last.Value("attempts"))
+		assert.Equal(t, wait.ErrWaitTimeout, last.Value("err"))
+	})
+}
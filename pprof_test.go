@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pprofServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	log := NewCapturingLogger()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- httpServer{Name: "pprof", Addr: ":0", Handler: pprofHandler(), Log: log}.Start(ctx)
+	}()
+
+	t.Log("Waiting for the pprof server to listen")
+	var addr string
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		for _, line := range log.Lines() {
+			if line.Msg == "pprof server is starting to listen" {
+				addr = line.Value("addr").(string)
+				return true, nil
+			}
+		}
+		return false, nil
+	}))
+
+	resp, err := http.Get("http://" + addr + "/debug/pprof/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cancel()
+	require.NoError(t, <-errc)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// readCache memoizes the objects read through its Reader so that reading the
+// same object twice returns the same version, whatever the Reader serves the
+// second time. It backs PerRequestReadCache and only lives for one reconcile.
+// The objects that can't be found aren't memoized, and neither are the lists.
+type readCache struct {
+	client.Reader
+
+	mu      sync.Mutex
+	objects map[readCacheKey]client.Object
+}
+
+type readCacheKey struct {
+	typ reflect.Type
+	key client.ObjectKey
+}
+
+func (c *readCache) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	cacheKey := readCacheKey{typ: reflect.TypeOf(obj), key: key}
+	c.mu.Lock()
+	cached, ok := c.objects[cacheKey]
+	c.mu.Unlock()
+	if ok {
+		reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(cached.DeepCopyObject()).Elem())
+		return nil
+	}
+
+	err := c.Reader.Get(ctx, key, obj)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.objects == nil {
+		c.objects = make(map[readCacheKey]client.Object)
+	}
+	c.objects[cacheKey] = obj.DeepCopyObject().(client.Object)
+	return nil
+}
+
+// forget drops the memoized version of the object, so that the next Get
+// reads it through the Reader again.
+func (c *readCache) forget(key client.ObjectKey, obj client.Object) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.objects, readCacheKey{typ: reflect.TypeOf(obj), key: key})
+}
+
+type readCacheCtxKey struct{}
+
+func withReadCache(ctx context.Context, r client.Reader) context.Context {
+	return context.WithValue(ctx, readCacheCtxKey{}, &readCache{Reader: r})
+}
+
+func readCacheFrom(ctx context.Context) *readCache {
+	c, _ := ctx.Value(readCacheCtxKey{}).(*readCache)
+	return c
+}
@@ -0,0 +1,1091 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// AnnotatingReconciler is a tiny Secret controller that does one single thing:
+// it adds the secret-found=yes annotation if it does not already have it. It
+// is used by both main_test.go and the command in main.go. It can also
+// reconcile other kinds, such as the Widget custom resource.
+//
+//	+-----------------------+
+//	| kind: Secret          |
+//	| metadata:             |
+//	|   name: example-1     |
+//	|   annotations: []     |
+//	+-----------------------+
+//	            |
+//	            |
+//	            | reconciliation = add annotation
+//	            |
+//	            v
+//	+-------------------------+
+//	| kind: Secret            |
+//	| metadata:               |
+//	|   name: example-1       |
+//	|   annotations:          |
+//	|     secret-found: "yes" |
+//	+-------------------------+
+type AnnotatingReconciler struct {
+	Client client.Client
+	Log    logr.Logger
+
+	// Object is the kind of object to reconcile, e.g., &v1alpha1.Widget{}.
+	// Defaults to &corev1.Secret{}.
+	Object client.Object
+
+	// Annotations are the annotations that get added. Defaults to
+	// secret-found=yes.
+	Annotations map[string]string
+
+	// RequeueOnStale, when non-zero, makes the reconciler retry after the given
+	// duration when the object can't be found in the cache although the
+	// metadata cache (the one that triggered the reconciliation) has it, which
+	// means the cache hasn't caught up yet. Unlike returning an error,
+	// requeuing with RequeueAfter doesn't escalate the exponential backoff.
+	RequeueOnStale time.Duration
+
+	// StaleBackoffMax, when non-zero, doubles the RequeueOnStale delay each
+	// time the same object is found stale in a row, up to StaleBackoffMax.
+	// The delay goes back to RequeueOnStale once the object is read.
+	StaleBackoffMax time.Duration
+
+	// RequeueOnNotFound, when non-zero, makes the reconciler retry after the
+	// given duration whenever the object can't be found in the cache, so that
+	// the object gets annotated once the cache catches up even if no other
+	// event comes in. Unlike RequeueOnStale, nothing tells a lagging cache
+	// from an object that is really gone: a deleted object keeps being
+	// requeued. RequeueOnStale takes precedence when both are set.
+	RequeueOnNotFound time.Duration
+
+	// WriteThrough, when true, copies the object returned by a successful
+	// Update into Cache right away instead of waiting for the watch event to
+	// reach the informer, which reduces the window during which the cache
+	// serves the version that precedes our own write. controller-runtime caches
+	// are meant to be read-only: the object is put straight into the
+	// informer's store, no event handler is called, and the next watch event
+	// or relist overwrites it. Objects written by others are unaffected.
+	WriteThrough bool
+	Cache        cache.Informers
+
+	// OnlyCreates, when true, drops the update, delete and generic events so
+	// that the reconciler only ever reacts to the first ADDED event, which is
+	// when the cache is the most likely to be stale.
+	OnlyCreates bool
+
+	// AuditEvents, when true, logs every event received by the controller
+	// along with the object's resourceVersion. The events are not filtered.
+	AuditEvents bool
+
+	// MaxConcurrentReconciles is the number of reconcile workers. Defaults to
+	// 1. A given object is never reconciled by two workers at the same time.
+	MaxConcurrentReconciles int
+
+	// StrictOptimistic, when true, makes the optimistic concurrency explicit:
+	// the resourceVersion returned by Get is set as the precondition of the
+	// Update, so that any change made in between produces a 409 Conflict,
+	// which gets logged. The Update already carries the resourceVersion that
+	// Get returned; this makes sure nothing clears or changes it in between.
+	// With RetryOnConflict, the object is read again and the Update retried a
+	// few times, otherwise the conflict is returned as is.
+	StrictOptimistic bool
+	RetryOnConflict  bool
+
+	// KeepExisting, when true, leaves alone the annotations that are already
+	// set, even to a different value: only the missing ones get added.
+	KeepExisting bool
+
+	// AnnotateObservedRV, when true, also sets the annotation
+	// cacherace.io/observed-rv to the resourceVersion of the object that the
+	// reconciler read, which tells how stale the read was when compared with
+	// the resourceVersion of the object in the apiserver. It is only written
+	// along with the other annotations since the write changes the
+	// resourceVersion, which would otherwise trigger an endless loop.
+	AnnotateObservedRV bool
+
+	// ConsistencyChecks, when non-zero, makes the reconciler compare the
+	// resourceVersion of the object read from the cache with the one that
+	// APIReader (e.g., mgr.GetAPIReader()) returns with a metadata-only Get.
+	// As long as the cache is behind, it is read again, up to
+	// ConsistencyChecks times, after which the object is read from APIReader.
+	ConsistencyChecks int
+	APIReader         client.Reader
+
+	// ReadFrom is where the reconciler reads the object from, e.g., a
+	// FakeStaleCache. Defaults to Client. The metadata cache is always read
+	// through Client.
+	ReadFrom client.Reader
+
+	// Name is the name of the controller, which also appears in the logs.
+	// Defaults to the lowercase kind. Two controllers watching the same kind
+	// need distinct names.
+	Name string
+
+	// WriteTarget tells where the annotations get written. Defaults to
+	// WriteTargetMetadata. With WriteTargetStatus, the object must implement
+	// StatusObject and have a status subresource, such as the Widget.
+	WriteTarget WriteTarget
+
+	// OnlyGenerationChanges, when true, drops the update events that don't
+	// change the generation, such as the ones caused by metadata or status
+	// updates.
+	OnlyGenerationChanges bool
+
+	// WatchFullObject, when true, watches the concrete object rather than its
+	// metadata. Reconcile then reads from the same informer as the one that
+	// triggered it, which has the object by the time the event is handled:
+	// the race can't happen.
+	WatchFullObject bool
+
+	// Coalesce, when non-zero, delays each reconcile by the given duration
+	// and merges into it the events of the same object that come in during
+	// that time. Under a storm of updates, this means one reconcile per
+	// Coalesce instead of one per update.
+	Coalesce time.Duration
+
+	// MapperRefreshOnMissing, when true, makes the reconciler handle the "no
+	// matches for kind" errors, which happen when the CRD got installed after
+	// the RESTMapper learned about the kinds: the RESTMapper is reset, if it
+	// has a Reset method like the SnapshotRESTMapper, and the object is
+	// retried after a second. Otherwise, the error is returned.
+	MapperRefreshOnMissing bool
+
+	// SerializePerKey, when true, makes the reconciles of the same object
+	// wait for each other, from the read to the write. A controller never
+	// reconciles the same key twice at the same time, but two controllers
+	// watching the same kind do, and so do direct calls to Reconcile. The
+	// locks are shared by all the AnnotatingReconcilers of the process that
+	// have SerializePerKey set.
+	SerializePerKey bool
+
+	// Middlewares wrap the reconciler that SetupWithManager registers, the
+	// first one being the outermost. See Chain.
+	Middlewares []Middleware
+
+	// StaleResyncInterval, when non-zero, makes SetupWithManager start a
+	// loop that, every StaleResyncInterval, reconciles again the objects
+	// whose observed-rv annotation, as seen in the cache, is more than
+	// StaleThreshold versions behind the resourceVersion of the object in
+	// the apiserver, along with the objects that don't have the annotation.
+	// It catches the objects left behind after a stale read, e.g., when
+	// RequeueOnStale isn't set. Requires AnnotateObservedRV and APIReader.
+	//
+	// With StaleThreshold set, Reconcile also rewrites the observed-rv
+	// annotation when it lags behind. Since the resourceVersions are shared
+	// by all the objects of the cluster, StaleThreshold must be larger than
+	// the number of writes that happen in the cluster between a read and the
+	// write that follows, or the objects keep being rewritten.
+	StaleResyncInterval time.Duration
+	StaleThreshold      int
+
+	// ReportCacheConsistency, when true, makes the reconciler read the
+	// object from APIReader as well and set the CacheConsistent condition
+	// on its status: True when the cache returned the same resourceVersion
+	// as the apiserver, False otherwise. The object must implement
+	// ConditionObject and have a status subresource, such as the Widget.
+	// Since the condition is written to the object read from the apiserver,
+	// the rest of the reconcile uses that object instead of the cached one.
+	ReportCacheConsistency bool
+
+	// SecretType, when set, restricts the reconciles to the Secrets of that
+	// type, e.g., corev1.SecretTypeTLS. The type isn't part of the metadata,
+	// so the Secrets are then watched in full, as with WatchFullObject: the
+	// metadata informer goes away and, with it, the race. The alternative,
+	// reading the type with a live Get in the predicate, would keep the race
+	// but cost a request to the apiserver for every event. Memory-wise, the
+	// full Secrets are cached either way since Reconcile reads them. The
+	// object must be a Secret.
+	SecretType corev1.SecretType
+
+	// IgnoreOwnUpdates, when true, drops the update events that only change
+	// the annotations that the reconciler writes, along with the
+	// resourceVersion and the managed fields, such as the event that the
+	// reconciler's own write causes. It also drops the periodic resyncs, as
+	// predicate.ResourceVersionChangedPredicate does: that predicate alone
+	// doesn't help since every write, even one without any semantic change,
+	// bumps the resourceVersion. By default, every update gets reconciled.
+	IgnoreOwnUpdates bool
+
+	// DeterministicOrder, when true, queues the objects that exist when the
+	// controller starts in the order of their creation rather than in the
+	// order in which the apiserver lists them, which isn't specified. With a
+	// single worker, they then get reconciled in that order, which makes the
+	// experiments reproducible. It can't be combined with Coalesce.
+	DeterministicOrder bool
+
+	// VerifyWrites, when true, makes the reconciler read the object back
+	// from APIReader after writing it, and check that the annotations are
+	// still there. When they aren't, e.g., because a competing writer
+	// clobbered them right after our write, a warning is logged and the
+	// object is requeued. The read happens right after the write, which
+	// means a clobber that comes later goes unnoticed.
+	VerifyWrites bool
+
+	// PerRequestReadCache, when true, memoizes the objects that a reconcile
+	// reads, so that reading the same object twice within one reconcile
+	// returns the same version even if the cache moved on, or back, in
+	// between. With ConsistencyChecks, the cache is then only read once,
+	// and an object that is behind is read from APIReader right away. The
+	// retries of RetryOnConflict read the object again since they need a
+	// newer version.
+	PerRequestReadCache bool
+
+	// MaxObjectAge, when non-zero, makes the reconciler skip the objects
+	// created more than MaxObjectAge ago, which narrows the experiments down
+	// to the new objects, the ones most likely to be read from a stale
+	// cache. The creationTimestamp is only precise to the second, which
+	// means an object may be skipped up to a second early.
+	MaxObjectAge time.Duration
+
+	// ValidateBeforeWrite, when true, sends the write as a dry run first,
+	// which goes through the admission webhooks without persisting
+	// anything, and only sends the real write when the dry run succeeds.
+	// A rejected dry run is logged and returned as an error. The webhooks
+	// must declare sideEffects: None, or the apiserver rejects the dry run.
+	ValidateBeforeWrite bool
+
+	// InjectConflicts, when non-zero, makes the first InjectConflicts
+	// Updates of each object fail with a 409 Conflict that never reaches
+	// the apiserver, as if the reads had been stale, so that the handling
+	// of the conflicts, e.g., RetryOnConflict, can be tested without the
+	// race. The writes to the status are affected too, the dry runs of
+	// ValidateBeforeWrite are not.
+	InjectConflicts int
+
+	// LogReconcileLag, when true, logs "reconcile lag" at the start of the
+	// reconciles triggered by an event, with the time elapsed since the
+	// event got through the predicates and the object was enqueued. A lag
+	// that grows tells that the workers can't keep up with the events. With
+	// Coalesce, the lag includes the delay. The requeues aren't logged since
+	// no event triggered them. Only works with SetupWithManager.
+	LogReconcileLag bool
+
+	// staleAttempts backs StaleBackoffMax. It maps the key of an object to
+	// the number of times in a row it was found stale, as an *int64. The
+	// entry goes away once the object is read or found gone.
+	staleAttempts sync.Map
+
+	// conflicts backs InjectConflicts, see injectedConflicts.
+	conflictsOnce sync.Once
+	conflicts     *injectedConflicts
+
+	// arrivals backs LogReconcileLag. SetupWithManager creates it along
+	// with the predicate that feeds it.
+	arrivals *eventArrivals
+}
+
+// serializedKeys backs SerializePerKey.
+var serializedKeys keyLocks
+
+// WriteTarget is where the AnnotatingReconciler writes the key/value pairs.
+type WriteTarget string
+
+const (
+	// WriteTargetMetadata writes the key/value pairs as annotations.
+	WriteTargetMetadata WriteTarget = "Metadata"
+
+	// WriteTargetStatus writes the key/value pairs to the status with
+	// Status().Update. Unlike annotations, the status doesn't go through the
+	// same endpoint as the rest of the object and writing it never bumps the
+	// generation.
+	WriteTargetStatus WriteTarget = "Status"
+)
+
+// StatusObject is implemented by the kinds that can be reconciled with
+// WriteTargetStatus.
+type StatusObject interface {
+	client.Object
+	StatusFound() map[string]string
+	SetStatusFound(map[string]string)
+}
+
+// ConditionObject is implemented by the kinds that can be reconciled with
+// ReportCacheConsistency.
+type ConditionObject interface {
+	client.Object
+	GetConditions() []metav1.Condition
+	SetConditions([]metav1.Condition)
+}
+
+// CacheConsistentCondition is the type of the condition set by the
+// AnnotatingReconciler when ReportCacheConsistency is true.
+const CacheConsistentCondition = "CacheConsistent"
+
+// ObservedRVAnnotation is set by the AnnotatingReconciler when
+// AnnotateObservedRV is true.
+const ObservedRVAnnotation = "cacherace.io/observed-rv"
+
+// NewAnnotatingReconciler returns a reconciler that adds the single annotation
+// key=value to the objects of the same kind as obj.
+func NewAnnotatingReconciler(c client.Client, log logr.Logger, obj client.Object, key, value string) *AnnotatingReconciler {
+	return &AnnotatingReconciler{
+		Client:      c,
+		Log:         log,
+		Object:      obj,
+		Annotations: map[string]string{key: value},
+	}
+}
+
+// SetupWithManager watches the objects using the metadata projection while
+// Reconcile reads the concrete object, which means two caches are involved,
+// unless WatchFullObject or SecretType is set.
+func (r *AnnotatingReconciler) SetupWithManager(mgr manager.Manager) error {
+	// The audit predicate goes first so that it sees the events that the
+	// other predicates drop.
+	var preds []predicate.Predicate
+	if r.AuditEvents {
+		preds = append(preds, auditEvents(r.Log.WithName("events")))
+	}
+	if r.OnlyCreates {
+		preds = append(preds, onlyCreates)
+	}
+	if r.OnlyGenerationChanges {
+		preds = append(preds, predicate.GenerationChangedPredicate{})
+	}
+	if r.IgnoreOwnUpdates {
+		preds = append(preds, predicate.ResourceVersionChangedPredicate{}, ignoreAnnotationChanges(r.ownedAnnotations()))
+	}
+	if r.SecretType != "" {
+		if _, ok := r.newObject().(*corev1.Secret); !ok {
+			return fmt.Errorf("SecretType requires the object to be a Secret, got %T", r.newObject())
+		}
+		preds = append(preds, secretOfType(r.SecretType))
+	}
+
+	forPreds := preds
+	if r.DeterministicOrder {
+		if r.Coalesce != 0 {
+			return fmt.Errorf("DeterministicOrder can't be combined with Coalesce")
+		}
+		// The create events come from the creationOrdered source instead.
+		forPreds = append(forPreds[:len(forPreds):len(forPreds)], dropCreates)
+	}
+	if r.LogReconcileLag {
+		// Last, so that the dropped events aren't recorded.
+		r.arrivals = &eventArrivals{}
+		recordArrival := r.arrivals.predicate()
+		preds = append(preds[:len(preds):len(preds)], recordArrival)
+		forPreds = append(forPreds[:len(forPreds):len(forPreds)], recordArrival)
+	}
+	forOpts := []builder.ForOption{builder.WithPredicates(forPreds...)}
+	watchOpts := []builder.WatchesOption{builder.WithPredicates(preds...)}
+	onlyMetadata := !r.WatchFullObject && r.SecretType == ""
+	if onlyMetadata {
+		forOpts = append(forOpts, builder.OnlyMetadata)
+		watchOpts = append(watchOpts, builder.OnlyMetadata)
+	}
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named(r.Name).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles})
+	if r.Coalesce == 0 {
+		b = b.For(r.newObject(), forOpts...)
+	} else {
+		// The builder always enqueues the events of For right away, which
+		// is why For drops them all and the same informer is watched a
+		// second time with an event handler that delays them.
+		forOpts[0] = builder.WithPredicates(dropAll)
+		b = b.For(r.newObject(), forOpts...).
+			Watches(&source.Kind{Type: r.newObject()}, coalesce(r.Coalesce), watchOpts...)
+	}
+	if r.DeterministicOrder {
+		obj := r.newObject()
+		if onlyMetadata {
+			gvk, err := apiutil.GVKForObject(obj, mgr.GetScheme())
+			if err != nil {
+				return fmt.Errorf("while finding the kind of %T: %w", obj, err)
+			}
+			partial := &metav1.PartialObjectMetadata{}
+			partial.SetGroupVersionKind(gvk)
+			obj = partial
+		}
+		b = b.Watches(&creationOrdered{Type: obj}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(preds...))
+	}
+	var resync *staleResync
+	if r.StaleResyncInterval != 0 {
+		if !r.AnnotateObservedRV || r.APIReader == nil {
+			return fmt.Errorf("StaleResyncInterval requires AnnotateObservedRV and APIReader to be set")
+		}
+		events := make(chan event.GenericEvent)
+		resync = &staleResync{r: r, events: events}
+		b = b.Watches(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{})
+	}
+	err := b.Complete(Chain(r, r.Middlewares...))
+	if err != nil {
+		return fmt.Errorf("while completing new controller: %w", err)
+	}
+	if resync != nil {
+		err = mgr.Add(resync)
+		if err != nil {
+			return fmt.Errorf("while adding the stale resync: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Reconcile stores its logger, which carries the request's key, in the context
+// so that the helpers it calls can get it back with logr.FromContext.
+func (r *AnnotatingReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	obj := r.newObject()
+	gvk, err := apiutil.GVKForObject(obj, r.Client.Scheme())
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("while finding the kind of %T: %w", obj, err)
+	}
+	kind := strings.ToLower(gvk.Kind)
+	name := r.Name
+	if name == "" {
+		name = kind
+	}
+
+	active := activeReconciles.WithLabelValues(name)
+	active.Inc()
+	defer active.Dec()
+
+	log := r.Log.WithName(name+"-reconciler").WithValues(kind, req.NamespacedName)
+	if id := CorrelationID(ctx); id != "" {
+		log = log.WithValues("reconcileID", id)
+	}
+	ctx = logr.NewContext(ctx, log)
+	if r.SerializePerKey {
+		unlock := serializedKeys.lock(gvk.String() + " " + req.NamespacedName.String())
+		defer unlock()
+	}
+	log.Info("start")
+	defer log.Info("end")
+	if r.arrivals != nil {
+		if arrival, ok := r.arrivals.take(req.NamespacedName); ok {
+			log.Info("reconcile lag", "lag", time.Since(arrival))
+		}
+	}
+	defer trace.StartRegion(ctx, "reconcile").End()
+
+	res, err := r.reconcile(ctx, req, gvk, obj)
+	logRequeue(log, res, err)
+	return res, err
+}
+
+// logRequeue tells whether and why controller-runtime is going to reconcile
+// the object again. An error takes precedence over the result.
+func logRequeue(log logr.Logger, res reconcile.Result, err error) {
+	switch {
+	case err != nil:
+		log.V(3).Info("requeue", "reason", "error", "err", err)
+	case res.RequeueAfter > 0:
+		log.V(3).Info("requeue", "reason", "requeueAfter", "after", res.RequeueAfter)
+	case res.Requeue:
+		log.V(3).Info("requeue", "reason", "requeue")
+	}
+}
+
+func (r *AnnotatingReconciler) reconcile(ctx context.Context, req reconcile.Request, gvk schema.GroupVersionKind, obj client.Object) (reconcile.Result, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	kind := strings.ToLower(gvk.Kind)
+	if r.PerRequestReadCache {
+		ctx = withReadCache(ctx, r.reader())
+	}
+
+	err := r.readerFor(ctx).Get(ctx, req.NamespacedName, obj)
+	switch {
+	// If the object doesn't exist, the reconciliation is done, unless the
+	// cache is merely lagging behind the metadata cache.
+	case apierrors.IsNotFound(err):
+		if r.RequeueOnStale > 0 {
+			stale, err := r.inMetadataCache(ctx, gvk, req.NamespacedName)
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			if stale {
+				staleReads.Inc()
+				after := r.staleDelay(req.NamespacedName)
+				log.Info(kind+" not found but present in the metadata cache, requeuing", "after", after)
+				return reconcile.Result{RequeueAfter: after}, nil
+			}
+		} else if r.RequeueOnNotFound > 0 {
+			log.Info(kind+" not found, requeuing", "after", r.RequeueOnNotFound)
+			return reconcile.Result{RequeueAfter: r.RequeueOnNotFound}, nil
+		}
+		r.resetStaleDelay(req.NamespacedName)
+		log.Info(kind + " not found")
+		return reconcile.Result{}, nil
+	case meta.IsNoMatchError(err) && r.MapperRefreshOnMissing:
+		return r.refreshMapper(ctx, err)
+	case err != nil:
+		return reconcile.Result{}, fmt.Errorf("looking for %s %s: %w", gvk.Kind, req.NamespacedName, err)
+	}
+	r.resetStaleDelay(req.NamespacedName)
+
+	if age := time.Since(obj.GetCreationTimestamp().Time); r.MaxObjectAge > 0 && age > r.MaxObjectAge {
+		log.Info("skipping old object", "age", age.Round(time.Second), "maxAge", r.MaxObjectAge)
+		return reconcile.Result{}, nil
+	}
+
+	if r.ConsistencyChecks > 0 {
+		obj, err = r.consistentRead(ctx, gvk, req.NamespacedName, obj)
+		switch {
+		case apierrors.IsNotFound(err):
+			log.Info(kind + " not found in the apiserver")
+			return reconcile.Result{}, nil
+		case err != nil:
+			return reconcile.Result{}, err
+		}
+	}
+
+	if r.ReportCacheConsistency {
+		obj, err = r.reportCacheConsistency(ctx, gvk, req.NamespacedName, obj)
+		switch {
+		case apierrors.IsNotFound(err):
+			log.Info(kind + " not found in the apiserver")
+			return reconcile.Result{}, nil
+		case err != nil:
+			return reconcile.Result{}, err
+		}
+	}
+
+	updated, err := r.annotate(ctx, obj)
+	if apierrors.IsConflict(err) && r.StrictOptimistic && r.RetryOnConflict {
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			obj = r.newObject()
+			if c := readCacheFrom(ctx); c != nil {
+				c.forget(req.NamespacedName, obj)
+			}
+			err := r.readerFor(ctx).Get(ctx, req.NamespacedName, obj)
+			if err != nil {
+				return err
+			}
+			updated, err = r.annotate(ctx, obj)
+			return err
+		})
+	}
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if !updated {
+		return reconcile.Result{}, nil
+	}
+
+	if r.WriteThrough {
+		err = injectIntoCache(ctx, r.Cache, obj)
+		if err != nil {
+			// The write went through; only the cache will lag behind.
+			log.Error(err, "while writing through to the cache")
+		}
+	}
+
+	if r.VerifyWrites {
+		persisted, err := r.verifyWrite(ctx, gvk, req.NamespacedName)
+		switch {
+		case apierrors.IsNotFound(err):
+			log.Info(kind + " not found in the apiserver after the write")
+			return reconcile.Result{}, nil
+		case err != nil:
+			return reconcile.Result{}, err
+		}
+		if !persisted {
+			log.Info("warning: the annotations are gone from the apiserver right after the write, another writer may have clobbered them, requeuing", "resourceVersion", obj.GetResourceVersion())
+			return reconcile.Result{Requeue: true}, nil
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// staleDelay returns how long to wait before reading the stale object again,
+// and counts the attempt.
+func (r *AnnotatingReconciler) staleDelay(key types.NamespacedName) time.Duration {
+	if r.StaleBackoffMax <= 0 {
+		return r.RequeueOnStale
+	}
+	v, _ := r.staleAttempts.LoadOrStore(key, new(int64))
+	attempts := atomic.AddInt64(v.(*int64), 1) - 1
+
+	delay := r.RequeueOnStale
+	for i := int64(0); i < attempts && delay < r.StaleBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > r.StaleBackoffMax {
+		delay = r.StaleBackoffMax
+	}
+	return delay
+}
+
+func (r *AnnotatingReconciler) resetStaleDelay(key types.NamespacedName) {
+	if r.StaleBackoffMax > 0 {
+		r.staleAttempts.Delete(key)
+	}
+}
+
+// dropAll lets no event through.
+var dropAll = predicate.Funcs{
+	CreateFunc:  func(event.CreateEvent) bool { return false },
+	UpdateFunc:  func(event.UpdateEvent) bool { return false },
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// coalesce enqueues the objects after the given delay. Until then, the
+// workqueue only keeps one request per object, which means the events that
+// come in during the delay result in a single reconcile.
+func coalesce(delay time.Duration) handler.Funcs {
+	enqueue := func(obj client.Object, q workqueue.RateLimitingInterface) {
+		q.AddAfter(reconcile.Request{NamespacedName: client.ObjectKeyFromObject(obj)}, delay)
+	}
+	return handler.Funcs{
+		CreateFunc: func(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+			enqueue(e.Object, q)
+		},
+		UpdateFunc: func(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+			enqueue(e.ObjectNew, q)
+		},
+		DeleteFunc: func(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+			enqueue(e.Object, q)
+		},
+		GenericFunc: func(e event.GenericEvent, q workqueue.RateLimitingInterface) {
+			enqueue(e.Object, q)
+		},
+	}
+}
+
+// The funcs left nil in predicate.Funcs let the events through, hence the
+// explicit "false".
+var onlyCreates = predicate.Funcs{
+	CreateFunc:  func(event.CreateEvent) bool { return true },
+	UpdateFunc:  func(event.UpdateEvent) bool { return false },
+	DeleteFunc:  func(event.DeleteEvent) bool { return false },
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// ignoreAnnotationChanges drops the update events whose objects only differ
+// by the given annotations, their resourceVersion and their managed fields.
+func ignoreAnnotationChanges(keys []string) predicate.Funcs {
+	strip := func(obj client.Object) client.Object {
+		obj = obj.DeepCopyObject().(client.Object)
+		obj.SetResourceVersion("")
+		obj.SetManagedFields(nil)
+		annotations := obj.GetAnnotations()
+		for _, key := range keys {
+			delete(annotations, key)
+		}
+		if len(annotations) == 0 {
+			annotations = nil
+		}
+		obj.SetAnnotations(annotations)
+		return obj
+	}
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return !equality.Semantic.DeepEqual(strip(e.ObjectOld), strip(e.ObjectNew))
+		},
+	}
+}
+
+// secretOfType lets through the events of the Secrets of the given type. The
+// objects must be full Secrets, not PartialObjectMetadata.
+func secretOfType(typ corev1.SecretType) predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		secret, ok := obj.(*corev1.Secret)
+		return ok && secret.Type == typ
+	})
+}
+
+var dropCreates = predicate.Funcs{
+	CreateFunc: func(event.CreateEvent) bool { return false },
+}
+
+// auditEvents logs the events and lets all of them through. The objects are
+// PartialObjectMetadata since the controller watches the metadata only.
+func auditEvents(log logr.Logger) predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			log.Info("create", "object", client.ObjectKeyFromObject(e.Object), "resourceVersion", e.Object.GetResourceVersion())
+			return true
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			log.Info("update", "object", client.ObjectKeyFromObject(e.ObjectNew),
+				"oldResourceVersion", e.ObjectOld.GetResourceVersion(),
+				"newResourceVersion", e.ObjectNew.GetResourceVersion())
+			return true
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			log.Info("delete", "object", client.ObjectKeyFromObject(e.Object), "resourceVersion", e.Object.GetResourceVersion())
+			return true
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			log.Info("generic", "object", client.ObjectKeyFromObject(e.Object), "resourceVersion", e.Object.GetResourceVersion())
+			return true
+		},
+	}
+}
+
+// consistentRead returns obj if it is as recent as the object in the
+// apiserver. Otherwise, it reads the object from the cache again until it
+// catches up, and falls back to reading it from the apiserver.
+func (r *AnnotatingReconciler) consistentRead(ctx context.Context, gvk schema.GroupVersionKind, key types.NamespacedName, obj client.Object) (client.Object, error) {
+	if r.APIReader == nil {
+		return nil, fmt.Errorf("ConsistencyChecks is set but APIReader is not")
+	}
+	log := logr.FromContextOrDiscard(ctx)
+
+	meta := &metav1.PartialObjectMetadata{}
+	meta.SetGroupVersionKind(gvk)
+	err := r.APIReader.Get(ctx, key, meta)
+	if err != nil {
+		return nil, fmt.Errorf("while reading the metadata of %s %s from the apiserver: %w", gvk.Kind, key, err)
+	}
+
+	if olderThan(obj.GetResourceVersion(), meta.ResourceVersion) {
+		staleReads.Inc()
+	}
+	for i := 0; i < r.ConsistencyChecks; i++ {
+		if !olderThan(obj.GetResourceVersion(), meta.ResourceVersion) {
+			return obj, nil
+		}
+		log.V(1).Info("the cache is behind the apiserver, reading again", "cached", obj.GetResourceVersion(), "live", meta.ResourceVersion, "attempt", i+1)
+		time.Sleep(10 * time.Millisecond)
+
+		obj = r.newObject()
+		err = r.readerFor(ctx).Get(ctx, key, obj)
+		if err != nil {
+			return nil, fmt.Errorf("while reading %s %s again: %w", gvk.Kind, key, err)
+		}
+	}
+	if !olderThan(obj.GetResourceVersion(), meta.ResourceVersion) {
+		return obj, nil
+	}
+
+	log.Info("the cache is still behind the apiserver, reading from the apiserver", "cached", obj.GetResourceVersion(), "live", meta.ResourceVersion)
+	obj = r.newObject()
+	err = r.APIReader.Get(ctx, key, obj)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s %s from the apiserver: %w", gvk.Kind, key, err)
+	}
+	return obj, nil
+}
+
+// reportCacheConsistency reads the object from APIReader, sets its
+// CacheConsistent condition depending on whether cached has the same
+// resourceVersion, and writes the status if the condition changed. It returns
+// the object read from APIReader, as updated by the status write.
+func (r *AnnotatingReconciler) reportCacheConsistency(ctx context.Context, gvk schema.GroupVersionKind, key types.NamespacedName, cached client.Object) (client.Object, error) {
+	if r.APIReader == nil {
+		return nil, fmt.Errorf("ReportCacheConsistency is set but APIReader is not")
+	}
+	live := r.newObject()
+	err := r.APIReader.Get(ctx, key, live)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s %s from the apiserver: %w", gvk.Kind, key, err)
+	}
+	withConditions, ok := live.(ConditionObject)
+	if !ok {
+		return nil, fmt.Errorf("%T has no conditions to write to", live)
+	}
+
+	condition := metav1.Condition{
+		Type:               CacheConsistentCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             "SameResourceVersion",
+		Message:            fmt.Sprintf("The cache and the apiserver both returned the resourceVersion %s.", live.GetResourceVersion()),
+		ObservedGeneration: live.GetGeneration(),
+	}
+	if cached.GetResourceVersion() != live.GetResourceVersion() {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "StaleRead"
+		condition.Message = fmt.Sprintf("The cache returned the resourceVersion %s, the apiserver %s.", cached.GetResourceVersion(), live.GetResourceVersion())
+	}
+	existing := meta.FindStatusCondition(withConditions.GetConditions(), CacheConsistentCondition)
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason {
+		return live, nil
+	}
+
+	conditions := withConditions.GetConditions()
+	meta.SetStatusCondition(&conditions, condition)
+	withConditions.SetConditions(conditions)
+	err = r.Client.Status().Update(ctx, live)
+	if err != nil {
+		return nil, fmt.Errorf("while setting the %s condition of %s %s: %w", CacheConsistentCondition, gvk.Kind, key, err)
+	}
+	logr.FromContextOrDiscard(ctx).V(1).Info("cache consistency reported", "status", condition.Status, "cached", cached.GetResourceVersion(), "live", live.GetResourceVersion())
+	return live, nil
+}
+
+// verifyWrite reads the object from APIReader and tells whether it still has
+// the annotations, or the status entries with WriteTargetStatus.
+func (r *AnnotatingReconciler) verifyWrite(ctx context.Context, gvk schema.GroupVersionKind, key types.NamespacedName) (persisted bool, err error) {
+	if r.APIReader == nil {
+		return false, fmt.Errorf("VerifyWrites is set but APIReader is not")
+	}
+	live := r.newObject()
+	err = r.APIReader.Get(ctx, key, live)
+	if err != nil {
+		return false, fmt.Errorf("while reading %s %s back from the apiserver: %w", gvk.Kind, key, err)
+	}
+	got := live.GetAnnotations()
+	if statusObj, ok := live.(StatusObject); ok && r.WriteTarget == WriteTargetStatus {
+		got = statusObj.StatusFound()
+	}
+	if r.KeepExisting {
+		return len(missingAnnotations(got, r.annotations())) == 0, nil
+	}
+	return hasAnnotations(got, r.annotations()), nil
+}
+
+// annotate adds the missing annotations to obj and updates it. It returns
+// false when obj already has all the annotations.
+func (r *AnnotatingReconciler) annotate(ctx context.Context, obj client.Object) (updated bool, err error) {
+	get, set, write := obj.GetAnnotations, obj.SetAnnotations, r.Client.Update
+	if r.WriteTarget == WriteTargetStatus {
+		statusObj, ok := obj.(StatusObject)
+		if !ok {
+			return false, fmt.Errorf("%T has no status to write to", obj)
+		}
+		get, set, write = statusObj.StatusFound, statusObj.SetStatusFound, r.Client.Status().Update
+	}
+
+	want := r.annotations()
+	annotations := get()
+	if r.KeepExisting {
+		want = missingAnnotations(annotations, want)
+	}
+
+	readRV := obj.GetResourceVersion()
+	staleObservedRV := r.AnnotateObservedRV && r.StaleThreshold > 0 && lagsBehind(annotations[ObservedRVAnnotation], readRV, r.StaleThreshold)
+	if hasAnnotations(annotations, want) && !staleObservedRV {
+		return false, nil
+	}
+
+	if annotations == nil {
+		annotations = make(map[string]string, len(want))
+	}
+	for key, value := range want {
+		annotations[key] = value
+	}
+	if r.AnnotateObservedRV {
+		annotations[ObservedRVAnnotation] = readRV
+	}
+	set(annotations)
+	if r.StrictOptimistic {
+		obj.SetResourceVersion(readRV)
+	}
+
+	if r.ValidateBeforeWrite {
+		err = r.validateWrite(ctx, obj, write)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Only the real write gets the injected conflicts, not the dry run.
+	if r.InjectConflicts > 0 {
+		write = r.injectedConflicts().wrap(r.Client, write, r.InjectConflicts)
+	}
+	err = write(ctx, obj)
+	if apierrors.IsConflict(err) {
+		if r.StrictOptimistic {
+			logr.FromContextOrDiscard(ctx).Info("conflict, the object changed since it was read", "resourceVersion", readRV)
+		}
+		return false, conflictError{err: err}
+	}
+	if err != nil {
+		return false, err
+	}
+	logr.FromContextOrDiscard(ctx).V(2).Info("written", "readResourceVersion", readRV, "resourceVersion", obj.GetResourceVersion())
+
+	return true, nil
+}
+
+// validateWrite sends the write as a dry run. The object given to write is a
+// copy since a dry run returns the object as it would have been written.
+func (r *AnnotatingReconciler) validateWrite(ctx context.Context, obj client.Object, write updateFunc) error {
+	log := logr.FromContextOrDiscard(ctx)
+	err := write(ctx, obj.DeepCopyObject().(client.Object), client.DryRunAll)
+	switch {
+	case apierrors.IsConflict(err):
+		return conflictError{err: err}
+	case err != nil:
+		log.Info("the dry run was rejected, not writing", "err", err)
+		return fmt.Errorf("while validating the write with a dry run: %w", err)
+	}
+	log.V(1).Info("the dry run succeeded")
+	return nil
+}
+
+func (r *AnnotatingReconciler) reader() client.Reader {
+	if r.ReadFrom == nil {
+		return r.Client
+	}
+	return r.ReadFrom
+}
+
+// readerFor returns the per-reconcile cache when PerRequestReadCache is set,
+// and the reader otherwise.
+func (r *AnnotatingReconciler) readerFor(ctx context.Context) client.Reader {
+	if c := readCacheFrom(ctx); c != nil {
+		return c
+	}
+	return r.reader()
+}
+
+func (r *AnnotatingReconciler) newObject() client.Object {
+	if r.Object == nil {
+		return &corev1.Secret{}
+	}
+	return r.Object.DeepCopyObject().(client.Object)
+}
+
+// ownedAnnotations returns the keys of the annotations that the reconciler
+// writes.
+func (r *AnnotatingReconciler) ownedAnnotations() []string {
+	var keys []string
+	for key := range r.annotations() {
+		keys = append(keys, key)
+	}
+	if r.AnnotateObservedRV {
+		keys = append(keys, ObservedRVAnnotation)
+	}
+	return keys
+}
+
+func (r *AnnotatingReconciler) annotations() map[string]string {
+	if len(r.Annotations) == 0 {
+		return map[string]string{"secret-found": "yes"}
+	}
+	return r.Annotations
+}
+
+// missingAnnotations returns the wanted annotations whose keys are absent
+// from annotations.
+func missingAnnotations(annotations, want map[string]string) map[string]string {
+	missing := make(map[string]string)
+	for key, value := range want {
+		if _, ok := annotations[key]; !ok {
+			missing[key] = value
+		}
+	}
+	return missing
+}
+
+// hasAnnotations tells whether all the wanted annotations are present in
+// annotations with the same value.
+func hasAnnotations(annotations, want map[string]string) bool {
+	for key, value := range want {
+		got, ok := annotations[key]
+		if !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshMapper resets the client's RESTMapper when it can be, and asks for
+// the object to be retried once the RESTMapper knows about the kind.
+func (r *AnnotatingReconciler) refreshMapper(ctx context.Context, noMatch error) (reconcile.Result, error) {
+	log := logr.FromContextOrDiscard(ctx)
+	if resettable, ok := r.Client.RESTMapper().(interface{ Reset() error }); ok {
+		err := resettable.Reset()
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("while resetting the RESTMapper: %w", err)
+		}
+	}
+	log.Info("the RESTMapper doesn't know the kind, requeuing", "err", noMatch, "after", time.Second)
+	return reconcile.Result{RequeueAfter: time.Second}, nil
+}
+
+// inMetadataCache tells whether the metadata-only cache knows about the
+// object.
+func (r *AnnotatingReconciler) inMetadataCache(ctx context.Context, gvk schema.GroupVersionKind, key types.NamespacedName) (bool, error) {
+	meta := &metav1.PartialObjectMetadata{}
+	meta.SetGroupVersionKind(gvk)
+	err := r.Client.Get(ctx, key, meta)
+	switch {
+	case apierrors.IsNotFound(err):
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("looking for %s %s in the metadata cache: %w", gvk.Kind, key, err)
+	}
+
+	logr.FromContextOrDiscard(ctx).V(1).Info("found in the metadata cache", "resourceVersion", meta.ResourceVersion)
+	return true, nil
+}
+
+// injectIntoCache replaces the informer's copy of obj with obj, unless the
+// informer already holds a newer version.
+func injectIntoCache(ctx context.Context, informers cache.Informers, obj client.Object) error {
+	if informers == nil {
+		return fmt.Errorf("no cache to write through to")
+	}
+
+	log := logr.FromContextOrDiscard(ctx)
+	informer, err := informers.GetInformer(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("while getting the informer for %T: %w", obj, err)
+	}
+	withStore, ok := informer.(interface{ GetStore() toolscache.Store })
+	if !ok {
+		return fmt.Errorf("the informer %T does not expose its store", informer)
+	}
+	store := withStore.GetStore()
+
+	cached, exists, err := store.Get(obj)
+	if err != nil {
+		return fmt.Errorf("while reading %s from the informer's store: %w", client.ObjectKeyFromObject(obj), err)
+	}
+	if exists {
+		cachedObj, ok := cached.(client.Object)
+		if ok && !olderThan(cachedObj.GetResourceVersion(), obj.GetResourceVersion()) {
+			log.V(1).Info("the cache already has this version or a newer one", "cached", cachedObj.GetResourceVersion())
+			return nil
+		}
+	}
+
+	err = store.Update(obj.DeepCopyObject())
+	if err != nil {
+		return fmt.Errorf("while writing %s to the informer's store: %w", client.ObjectKeyFromObject(obj), err)
+	}
+
+	log.V(1).Info("wrote through to the cache", "resourceVersion", obj.GetResourceVersion())
+	return nil
+}
+
+// olderThan tells whether the resourceVersion a is older than b. Although
+// resourceVersions are meant to be opaque, the apiserver uses etcd's revision,
+// which grows monotonically. When a resourceVersion is not a number, we can't
+// tell and olderThan returns false.
+func olderThan(a, b string) bool {
+	aInt, errA := strconv.ParseUint(a, 10, 64)
+	bInt, errB := strconv.ParseUint(b, 10, 64)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return aInt < bInt
+}
@@ -0,0 +1,2281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"controller-runtime-cache-race/api/v1alpha1"
+)
+
+func TestAnnotatingReconciler_RequeueOnStale(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+
+	r := &AnnotatingReconciler{
+		Client:         &staleClient{Client: kc, staleGets: 1},
+		Log:            logger,
+		RequeueOnStale: 100 * time.Millisecond,
+	}
+
+	t.Log("The first Get is stale, the reconciler should requeue")
+	res, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	require.Equal(t, reconcile.Result{RequeueAfter: 100 * time.Millisecond}, res)
+
+	t.Log("The retry should add the annotation")
+	res, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	require.Equal(t, reconcile.Result{}, res)
+	require.NoError(t, kc.Get(ctx, key, &secret))
+	require.Equal(t, "yes", secret.Annotations["secret-found"])
+
+	t.Log("A Secret that is really gone should not be requeued")
+	require.NoError(t, kc.Delete(ctx, &secret))
+	res, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	require.Equal(t, reconcile.Result{}, res)
+}
+
+func TestAnnotatingReconciler_StaleBackoffMax(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&secret)}
+
+	c := &staleClient{Client: kc, staleGets: 5}
+	r := &AnnotatingReconciler{
+		Client:          c,
+		Log:             logger,
+		RequeueOnStale:  50 * time.Millisecond,
+		StaleBackoffMax: 300 * time.Millisecond,
+	}
+
+	var delays []time.Duration
+	for {
+		res, err := r.Reconcile(ctx, req)
+		require.NoError(t, err)
+		if res.RequeueAfter == 0 {
+			break
+		}
+		delays = append(delays, res.RequeueAfter)
+	}
+	require.Equal(t, []time.Duration{
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		300 * time.Millisecond,
+		300 * time.Millisecond,
+	}, delays)
+
+	t.Log("The successful read resets the delay")
+	c.mu.Lock()
+	c.staleGets = 1
+	c.mu.Unlock()
+	res, err := r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Equal(t, 50*time.Millisecond, res.RequeueAfter)
+
+	t.Log("An object deleted while stale doesn't keep its count")
+	require.NoError(t, kc.Delete(ctx, &secret))
+	res, err = r.Reconcile(ctx, req)
+	require.NoError(t, err)
+	require.Zero(t, res.RequeueAfter)
+	_, found := r.staleAttempts.Load(req.NamespacedName)
+	require.False(t, found)
+}
+
+// staleClient pretends that the cache hasn't caught up yet: the first
+// staleGets calls to Get for a concrete Secret return NotFound. Reads of
+// metav1.PartialObjectMetadata are not affected, just like the metadata cache
+// that triggers the reconciliation.
+type staleClient struct {
+	client.Client
+
+	mu        sync.Mutex
+	staleGets int
+}
+
+func (c *staleClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		c.mu.Lock()
+		stale := c.staleGets > 0
+		if stale {
+			c.staleGets--
+		}
+		c.mu.Unlock()
+
+		if stale {
+			return apierrors.NewNotFound(corev1.Resource("secrets"), key.Name)
+		}
+	}
+
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestAnnotatingReconciler_WriteThrough(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 20 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	_, err = mgr.GetCache().GetInformer(ctx, &corev1.Secret{})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	// staleReads reconciles n new Secrets one by one and counts how many times
+	// the cache, read right after the reconciler's Update, still returns the
+	// version that precedes the Update.
+	staleReads := func(prefix string, writeThrough bool, n int) int {
+		writes := &updateRecorder{Client: mgr.GetClient()}
+		r := &AnnotatingReconciler{
+			Client:       writes,
+			Log:          logger,
+			WriteThrough: writeThrough,
+			Cache:        mgr.GetCache(),
+		}
+
+		stale := 0
+		for i := 0; i < n; i++ {
+			key := types.NamespacedName{Name: fmt.Sprintf("%s-%d", prefix, i), Namespace: "default"}
+			require.NoError(t, kc.Create(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}))
+
+			// The reconciler only writes if it finds the Secret.
+			require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+				err := mgr.GetCache().Get(ctx, key, &corev1.Secret{})
+				return err == nil, client.IgnoreNotFound(err)
+			}))
+
+			_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			require.NoError(t, err)
+
+			var cached corev1.Secret
+			require.NoError(t, mgr.GetCache().Get(ctx, key, &cached))
+			if cached.ResourceVersion != writes.LastResourceVersion() {
+				stale++
+			}
+		}
+		return stale
+	}
+
+	const n = 20
+	withoutWriteThrough := staleReads("default", false, n)
+	withWriteThrough := staleReads("write-through", true, n)
+	t.Logf("stale reads after write: %d/%d by default, %d/%d with write-through", withoutWriteThrough, n, withWriteThrough, n)
+
+	require.Equal(t, 0, withWriteThrough)
+	require.LessOrEqual(t, withWriteThrough, withoutWriteThrough)
+}
+
+// updateRecorder remembers the resourceVersion returned by the last Update.
+type updateRecorder struct {
+	client.Client
+
+	mu     sync.Mutex
+	lastRV string
+}
+
+func (c *updateRecorder) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	err := c.Client.Update(ctx, obj, opts...)
+	if err == nil {
+		c.mu.Lock()
+		c.lastRV = obj.GetResourceVersion()
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *updateRecorder) LastResourceVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastRV
+}
+
+func TestAnnotatingReconciler_OnlyCreates(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+
+	log := NewCapturingLogger()
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: log, OnlyCreates: true}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+	reconciles := func() int {
+		count := 0
+		for _, line := range log.Lines() {
+			if line.Msg == "start" && line.Value("secret") == key {
+				count++
+			}
+		}
+		return count
+	}
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	require.NoError(t, kc.Create(ctx, &secret))
+
+	t.Log("Waiting for the reconcile triggered by the creation")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return reconciles() > 0, nil
+	}))
+
+	t.Log("Updates, including the reconciler's own write, should not trigger reconciles")
+	require.NoError(t, kc.Get(ctx, key, &secret))
+	secret.Labels = map[string]string{"foo": "bar"}
+	require.NoError(t, kc.Update(ctx, &secret))
+	time.Sleep(time.Second)
+
+	require.Equal(t, 1, reconciles())
+}
+
+func TestAnnotatingReconciler_Reconcile(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+	secret := func(annotations map[string]string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace, Annotations: annotations}}
+	}
+	conflict := apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, key.Name, errors.New("the object has been modified"))
+
+	tests := []struct {
+		name         string
+		existing     *corev1.Secret    // Nil means the Secret doesn't exist.
+		annotations  map[string]string // Defaults to secret-found=yes.
+		keepExisting bool
+		getErr       error // Returned by Get instead of the Secret.
+		updateErr    error // Returned by Update instead of writing.
+
+		wantErr         func(error) bool  // Nil means no error.
+		wantUpdates     int               // Including the ones that failed.
+		wantAnnotations map[string]string // Of the Secret once reconciled.
+	}{
+		{
+			name:        "not found",
+			wantUpdates: 0,
+		},
+		{
+			name:            "missing annotation",
+			existing:        secret(nil),
+			wantUpdates:     1,
+			wantAnnotations: map[string]string{"secret-found": "yes"},
+		},
+		{
+			name:            "present annotation",
+			existing:        secret(map[string]string{"secret-found": "yes"}),
+			wantUpdates:     0,
+			wantAnnotations: map[string]string{"secret-found": "yes"},
+		},
+		{
+			name:            "wrong value",
+			existing:        secret(map[string]string{"secret-found": "no", "unrelated": "kept"}),
+			wantUpdates:     1,
+			wantAnnotations: map[string]string{"secret-found": "yes", "unrelated": "kept"},
+		},
+		{
+			name:            "wrong value kept",
+			existing:        secret(map[string]string{"secret-found": "no"}),
+			keepExisting:    true,
+			wantUpdates:     0,
+			wantAnnotations: map[string]string{"secret-found": "no"},
+		},
+		{
+			name:            "several annotations, some missing",
+			existing:        secret(map[string]string{"foo": "wrong", "bar": "2"}),
+			annotations:     map[string]string{"foo": "1", "bar": "2", "baz": "3"},
+			wantUpdates:     1,
+			wantAnnotations: map[string]string{"foo": "1", "bar": "2", "baz": "3"},
+		},
+		{
+			name:            "update conflict",
+			existing:        secret(nil),
+			updateErr:       conflict,
+			wantErr:         func(err error) bool { return errors.Is(err, ErrConflict) && apierrors.IsConflict(err) },
+			wantUpdates:     1,
+			wantAnnotations: nil,
+		},
+		{
+			name:            "update error",
+			existing:        secret(nil),
+			updateErr:       errors.New("connection refused"),
+			wantErr:         func(err error) bool { return err.Error() == "connection refused" },
+			wantUpdates:     1,
+			wantAnnotations: nil,
+		},
+		{
+			name:            "get error",
+			existing:        secret(nil),
+			getErr:          apierrors.NewServiceUnavailable("etcd is down"),
+			wantErr:         apierrors.IsServiceUnavailable,
+			wantUpdates:     0,
+			wantAnnotations: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := fake.NewClientBuilder().WithScheme(scheme)
+			if tt.existing != nil {
+				b = b.WithObjects(tt.existing.DeepCopy())
+			}
+			c := &faultyClient{Client: b.Build(), getErr: tt.getErr, updateErr: tt.updateErr}
+			r := &AnnotatingReconciler{
+				Client:       c,
+				Log:          NewCapturingLogger(),
+				Annotations:  tt.annotations,
+				KeepExisting: tt.keepExisting,
+			}
+
+			res, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key})
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				require.True(t, tt.wantErr(err), "unexpected error: %v", err)
+			}
+			require.Equal(t, reconcile.Result{}, res)
+			require.Equal(t, tt.wantUpdates, c.updates)
+
+			var got corev1.Secret
+			err = c.Client.Get(context.Background(), key, &got)
+			if tt.existing == nil {
+				require.True(t, apierrors.IsNotFound(err), "expected NotFound, got: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantAnnotations, got.Annotations)
+		})
+	}
+}
+
+// faultyClient returns getErr from Get and updateErr from Update when they
+// are set, and counts the calls to Update.
+type faultyClient struct {
+	client.Client
+	getErr, updateErr error
+	updates           int
+}
+
+func (c *faultyClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if c.getErr != nil {
+		return c.getErr
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *faultyClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.updates++
+	if c.updateErr != nil {
+		return c.updateErr
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func TestAnnotatingReconciler_AuditEvents(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+
+	log := NewCapturingLogger()
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: log, AuditEvents: true}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	find := func(key types.NamespacedName, msg string, keysAndValues ...interface{}) bool {
+		for _, line := range log.Lines() {
+			if line.Name != "events" || line.Msg != msg || line.Value("object") != key {
+				continue
+			}
+			found := true
+			for i := 0; i+1 < len(keysAndValues); i += 2 {
+				if line.Value(keysAndValues[i].(string)) != keysAndValues[i+1] {
+					found = false
+				}
+			}
+			if found {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Until the watch is established, the initial LIST may see the Secret at
+	// its updated version and the create event would carry that version.
+	t.Log("Waiting for the watch to be established")
+	warmup := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "warmup", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &warmup))
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return find(client.ObjectKeyFromObject(&warmup), "create"), nil
+	}))
+
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	createdRV := secret.ResourceVersion
+
+	// Whether or not the reconciler wins the race, this update goes through.
+	secret.Labels = map[string]string{"foo": "bar"}
+	require.NoError(t, retryOnConflict(ctx, kc, &secret))
+	updatedRV := secret.ResourceVersion
+
+	t.Log("Waiting for the create event and the update event to be logged")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return find(key, "create", "resourceVersion", createdRV) &&
+			find(key, "update", "newResourceVersion", updatedRV), nil
+	}))
+
+	t.Log("The events should still reach the reconciler")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		for _, line := range log.Lines() {
+			if line.Msg == "start" && line.Value("secret") == key {
+				return true, nil
+			}
+		}
+		return false, nil
+	}))
+}
+
+// retryOnConflict updates obj, re-applying its labels on top of the latest
+// version when the reconciler got there first.
+func retryOnConflict(ctx context.Context, c client.Client, obj *corev1.Secret) error {
+	labels := obj.Labels
+	for {
+		err := c.Update(ctx, obj)
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+			return err
+		}
+		obj.Labels = labels
+	}
+}
+
+func TestAnnotatingReconciler_LoggerInContext(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+
+	// The stale Get makes Reconcile call inMetadataCache.
+	log := NewCapturingLogger()
+	r := &AnnotatingReconciler{
+		Client:         &staleClient{Client: kc, staleGets: 1},
+		Log:            log,
+		RequeueOnStale: 100 * time.Millisecond,
+	}
+	_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+
+	var found []LogLine
+	for _, line := range log.Lines() {
+		if line.Msg == "found in the metadata cache" {
+			found = append(found, line)
+		}
+	}
+	require.Len(t, found, 1)
+	require.Equal(t, "secret-reconciler", found[0].Name)
+	require.Equal(t, 1, found[0].Level)
+	require.Equal(t, key, found[0].Value("secret"))
+	require.Equal(t, secret.ResourceVersion, found[0].Value("resourceVersion"))
+}
+
+func TestAnnotatingReconciler_MaxConcurrentReconciles(t *testing.T) {
+	t.Run("reconciles of distinct Secrets overlap", func(t *testing.T) {
+		lines := runConcurrentReconciles(t, 20, 4)
+		require.True(t, overlappingReconciles(lines), "no reconcile started before the previous one ended")
+	})
+	t.Run("reconciles of a single Secret never overlap", func(t *testing.T) {
+		lines := runConcurrentReconciles(t, 1, 4)
+		require.False(t, overlappingReconciles(lines), "a reconcile started before the previous one ended")
+	})
+}
+
+// runConcurrentReconciles creates count Secrets before the manager starts so
+// that they all get queued at once, and returns the reconciler's log lines
+// once each Secret has been reconciled at least once.
+func runConcurrentReconciles(t *testing.T, count, workers int) []LogLine {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	var keys []types.NamespacedName
+	for i := 0; i < count; i++ {
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("secret-%d", i), Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+		keys = append(keys, client.ObjectKeyFromObject(&secret))
+	}
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+
+	log := NewCapturingLogger()
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: log, MaxConcurrentReconciles: workers}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		ended := make(map[interface{}]bool)
+		for _, line := range log.Lines() {
+			if line.Msg == "end" {
+				ended[line.Value("secret")] = true
+			}
+		}
+		for _, key := range keys {
+			if !ended[key] {
+				return false, nil
+			}
+		}
+		return true, nil
+	}))
+
+	return log.Lines()
+}
+
+// overlappingReconciles tells whether a "start" line was logged while another
+// reconcile had not logged its "end" yet.
+func overlappingReconciles(lines []LogLine) bool {
+	inFlight := 0
+	for _, line := range lines {
+		switch line.Msg {
+		case "start":
+			if inFlight > 0 {
+				return true
+			}
+			inFlight++
+		case "end":
+			inFlight--
+		}
+	}
+	return false
+}
+
+func TestAnnotatingReconciler_RequeueOnNotFound(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+
+	// The creation is the only event: the annotation can only come from the
+	// requeue that follows the stale Get.
+	err = (&AnnotatingReconciler{
+		Client:            &staleClient{Client: mgr.GetClient(), staleGets: 1},
+		Log:               logger,
+		RequeueOnNotFound: 100 * time.Millisecond,
+	}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+
+	t.Log("Waiting for the Secret to have the annotation secret-found=yes")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+		if err != nil {
+			return false, err
+		}
+		return secret.Annotations["secret-found"] == "yes", nil
+	}))
+}
+
+func TestAnnotatingReconciler_StrictOptimistic(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	t.Run("the conflict is returned", func(t *testing.T) {
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+		key := client.ObjectKeyFromObject(&secret)
+
+		r := &AnnotatingReconciler{
+			Client:           &outOfBandClient{Client: kc, changes: 1},
+			Log:              logger,
+			StrictOptimistic: true,
+		}
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.True(t, apierrors.IsConflict(err), "expected a conflict, got: %v", err)
+
+		require.NoError(t, kc.Get(ctx, key, &secret))
+		require.NotContains(t, secret.Annotations, "secret-found")
+	})
+
+	t.Run("the conflict is retried", func(t *testing.T) {
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-2", Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+		key := client.ObjectKeyFromObject(&secret)
+
+		c := &outOfBandClient{Client: kc, changes: 1}
+		r := &AnnotatingReconciler{
+			Client:           c,
+			Log:              logger,
+			StrictOptimistic: true,
+			RetryOnConflict:  true,
+		}
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.NoError(t, err)
+		require.Equal(t, 2, c.gets)
+
+		require.NoError(t, kc.Get(ctx, key, &secret))
+		require.Equal(t, "yes", secret.Annotations["secret-found"])
+		require.Equal(t, "0", secret.Labels["out-of-band"])
+	})
+}
+
+// outOfBandClient updates the Secret right after the first few Gets, as if
+// someone else had changed it while the reconciler was working on it.
+type outOfBandClient struct {
+	client.Client
+
+	mu      sync.Mutex
+	changes int
+	gets    int
+}
+
+func (c *outOfBandClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	err := c.Client.Get(ctx, key, obj)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gets++
+	if c.changes == 0 {
+		return nil
+	}
+	c.changes--
+
+	other := obj.DeepCopyObject().(client.Object)
+	other.SetLabels(map[string]string{"out-of-band": fmt.Sprint(c.changes)})
+	return c.Client.Update(ctx, other)
+}
+
+func TestAnnotatingReconciler_AnnotateObservedRV(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+
+	r := &AnnotatingReconciler{Client: kc, Log: logger, AnnotateObservedRV: true}
+	_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+
+	require.NoError(t, kc.Get(ctx, key, &secret))
+	require.Contains(t, secret.Annotations, ObservedRVAnnotation)
+	observed, err := strconv.ParseUint(secret.Annotations[ObservedRVAnnotation], 10, 64)
+	require.NoError(t, err)
+	live, err := strconv.ParseUint(secret.ResourceVersion, 10, 64)
+	require.NoError(t, err)
+	require.LessOrEqual(t, observed, live)
+}
+
+func TestAnnotatingReconciler_ConsistencyChecks(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name              string
+		staleGets         int
+		consistencyChecks int
+		wantConflict      bool
+	}{
+		{name: "without checks, the stale version is acted on", staleGets: 1, consistencyChecks: 0, wantConflict: true},
+		{name: "the cache catches up when read again", staleGets: 2, consistencyChecks: 3},
+		{name: "the object is read from the apiserver", staleGets: 10, consistencyChecks: 3},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("secret-%d", i), Namespace: "default"}}
+			require.NoError(t, kc.Create(ctx, &secret))
+			key := client.ObjectKeyFromObject(&secret)
+
+			// The cache keeps serving the created version after this update.
+			stale := secret.DeepCopy()
+			secret.Labels = map[string]string{"foo": "bar"}
+			require.NoError(t, kc.Update(ctx, &secret))
+
+			c := &laggingClient{Client: kc, stale: stale, staleGets: tt.staleGets}
+			r := &AnnotatingReconciler{
+				Client:            c,
+				Log:               logger,
+				ConsistencyChecks: tt.consistencyChecks,
+				APIReader:         kc,
+			}
+			_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			if tt.wantConflict {
+				require.True(t, apierrors.IsConflict(err), "expected a conflict, got: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, []string{secret.ResourceVersion}, c.updatedFrom)
+		})
+	}
+}
+
+// laggingClient serves a copy of stale to the first few Gets of that object,
+// as a cache that hasn't caught up would, and records the resourceVersion of
+// the objects given to Update.
+type laggingClient struct {
+	client.Client
+	stale *corev1.Secret
+
+	mu          sync.Mutex
+	staleGets   int
+	updatedFrom []string
+}
+
+func (c *laggingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	secret, ok := obj.(*corev1.Secret)
+	if ok && key == client.ObjectKeyFromObject(c.stale) {
+		c.mu.Lock()
+		stale := c.staleGets > 0
+		if stale {
+			c.staleGets--
+		}
+		c.mu.Unlock()
+
+		if stale {
+			c.stale.DeepCopyInto(secret)
+			return nil
+		}
+	}
+
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *laggingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.mu.Lock()
+	c.updatedFrom = append(c.updatedFrom, obj.GetResourceVersion())
+	c.mu.Unlock()
+
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+// The reconciler has no UseAPIReader switch: it gets an APIReader, but only
+// calls it when an option asks for it, e.g., ConsistencyChecks. The
+// "cache-only" case stands for "UseAPIReader is false": APIReader is set but
+// ConsistencyChecks is 0 and no other option uses it. The
+// "consistency-checks" case shows that the counting does see the calls when
+// there are some.
+func TestAnnotatingReconciler_CacheOnly(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name              string
+		consistencyChecks int
+		wantAPIReads      bool
+	}{
+		{name: "cache-only", consistencyChecks: 0, wantAPIReads: false},
+		{name: "consistency-checks", consistencyChecks: 3, wantAPIReads: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr, err := ctrl.NewManager(rc, ctrl.Options{
+				Scheme:             scheme,
+				Logger:             logger,
+				MetricsBindAddress: "0",
+			})
+			require.NoError(t, err)
+			apiReader := &countingReader{Reader: mgr.GetAPIReader()}
+			err = (&AnnotatingReconciler{
+				Client:            mgr.GetClient(),
+				Log:               logger,
+				RequeueOnStale:    100 * time.Millisecond,
+				ConsistencyChecks: tt.consistencyChecks,
+				APIReader:         apiReader,
+			}).SetupWithManager(mgr)
+			require.NoError(t, err)
+
+			mgrCtx, stop := context.WithCancel(ctx)
+			defer stop()
+			errc := startManager(t, mgrCtx, mgr)
+
+			secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: tt.name, Namespace: "default"}}
+			require.NoError(t, kc.Create(ctx, &secret))
+			require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+				err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+				return secret.Annotations["secret-found"] == "yes", err
+			}))
+			stop()
+			<-errc
+
+			if tt.wantAPIReads {
+				require.Greater(t, apiReader.count(), 0)
+				return
+			}
+			AssertNoAPIReaderCalls(t, apiReader)
+		})
+	}
+}
+
+// In the default mode, a reconcile reads the object once, from the cache.
+func TestAnnotatingReconciler_ReadPath(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := mgr.GetClient().Get(ctx, key, &corev1.Secret{})
+		return err == nil, client.IgnoreNotFound(err)
+	}))
+
+	cached := newCountingClient(mgr.GetClient())
+	apiReader := &countingReader{Reader: mgr.GetAPIReader()}
+	r := &AnnotatingReconciler{Client: cached, Log: logger, APIReader: apiReader}
+	_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+
+	require.Equal(t, 1, cached.reads.count(), "cached Gets and Lists")
+	AssertNoAPIReaderCalls(t, apiReader)
+	require.NoError(t, kc.Get(ctx, key, &secret))
+	require.Equal(t, "yes", secret.Annotations["secret-found"])
+}
+
+// countingClient counts the Gets and Lists made through the client.
+type countingClient struct {
+	client.Client
+	reads *countingReader
+}
+
+func newCountingClient(c client.Client) *countingClient {
+	return &countingClient{Client: c, reads: &countingReader{Reader: c}}
+}
+
+func (c *countingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.reads.Get(ctx, key, obj)
+}
+
+func (c *countingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.reads.List(ctx, list, opts...)
+}
+
+// AssertNoAPIReaderCalls fails the test if the reader, meant to wrap
+// mgr.GetAPIReader(), was called at all, i.e., if a reconciler that should
+// only read from the cache went to the apiserver. Like countingReader, it
+// lives in this file and is only meant for the tests of this package.
+func AssertNoAPIReaderCalls(t *testing.T, reader *countingReader) {
+	t.Helper()
+	if n := reader.count(); n > 0 {
+		t.Errorf("expected no call to the APIReader, got %d", n)
+	}
+}
+
+// countingReader counts the calls to Get and List.
+type countingReader struct {
+	client.Reader
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (r *countingReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+	return r.Reader.Get(ctx, key, obj)
+}
+
+func (r *countingReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	r.mu.Lock()
+	r.calls++
+	r.mu.Unlock()
+	return r.Reader.List(ctx, list, opts...)
+}
+
+func (r *countingReader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+// The metadata informer that triggers the reconciles never holds the Secrets'
+// data. Neither should any other informer, which isn't the case with the
+// default wiring: the reconciler's Get on the concrete Secret creates an
+// informer that caches the Secrets in full, so that subtest fails until the
+// wiring is fixed.
+func TestAnnotatingReconciler_SecretData(t *testing.T) {
+	tests := []struct {
+		wiring ClientWiring
+	}{
+		{wiring: ClientWiringDefault},
+		{wiring: ClientWiringDirect},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(string(tt.wiring), func(t *testing.T) {
+			logger := setupTestLogger(t)
+
+			scheme, err := BuildScheme(corev1.AddToScheme)
+			require.NoError(t, err)
+			rc := startTestEnv(t, scheme)
+
+			const timeout = 10 * time.Second
+			ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+			defer cancel()
+
+			kc, err := client.New(rc, client.Options{Scheme: scheme})
+			require.NoError(t, err)
+
+			lists := &secretListCounter{}
+			rc = rest.CopyConfig(rc)
+			rc.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+				return countingRoundTripper{next: rt, lists: lists}
+			})
+			newClient, err := NewClientFunc(tt.wiring)
+			require.NoError(t, err)
+			mgr, err := ctrl.NewManager(rc, ctrl.Options{
+				Scheme:             scheme,
+				Logger:             logger,
+				MetricsBindAddress: "0",
+				NewClient:          newClient,
+			})
+			require.NoError(t, err)
+			err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: logger, RequeueOnStale: 100 * time.Millisecond}).SetupWithManager(mgr)
+			require.NoError(t, err)
+			startManager(t, ctx, mgr)
+
+			secret := corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"},
+				Data:       map[string][]byte{"password": []byte("hunter2")},
+			}
+			require.NoError(t, kc.Create(ctx, &secret))
+			require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+				err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+				return secret.Annotations["secret-found"] == "yes", err
+			}))
+
+			store := func(obj client.Object) toolscache.Store {
+				informer, err := mgr.GetCache().GetInformer(ctx, obj)
+				require.NoError(t, err)
+				withStore, ok := informer.(interface{ GetStore() toolscache.Store })
+				require.True(t, ok, "the informer %T does not expose its store", informer)
+				return withStore.GetStore()
+			}
+
+			meta := &metav1.PartialObjectMetadata{}
+			meta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+			cached, found, err := store(meta).GetByKey("default/secret-1")
+			require.NoError(t, err)
+			require.True(t, found)
+			require.IsType(t, &metav1.PartialObjectMetadata{}, cached)
+
+			// Getting the v1.Secret informer would create it, hence the
+			// LIST requests telling whether it exists.
+			if lists.concrete() == 0 {
+				return
+			}
+			cached, found, err = store(&corev1.Secret{}).GetByKey("default/secret-1")
+			require.NoError(t, err)
+			if !found || len(cached.(*corev1.Secret).Data) == 0 {
+				return
+			}
+			t.Errorf("the Secret's data is cached by the v1.Secret informer")
+		})
+	}
+}
+
+func TestAnnotatingReconciler_LogRequeue(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	log := NewCapturingLogger()
+	r := &AnnotatingReconciler{
+		Client: &failingClient{scheme: scheme, err: fmt.Errorf("connection refused")},
+		Log:    log,
+	}
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+	_, err = r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key})
+	require.Error(t, err)
+
+	var requeues []LogLine
+	for _, line := range log.Lines() {
+		if line.Msg == "requeue" {
+			requeues = append(requeues, line)
+		}
+	}
+	require.Len(t, requeues, 1)
+	require.Equal(t, 3, requeues[0].Level)
+	require.Equal(t, "error", requeues[0].Value("reason"))
+	require.Equal(t, key, requeues[0].Value("secret"))
+	require.EqualError(t, requeues[0].Value("err").(error), err.Error())
+}
+
+// failingClient fails every Get with err. Only Get and Scheme can be called.
+type failingClient struct {
+	client.Client
+	scheme *runtime.Scheme
+	err    error
+}
+
+func (c *failingClient) Get(context.Context, client.ObjectKey, client.Object) error {
+	return c.err
+}
+
+func (c *failingClient) Scheme() *runtime.Scheme {
+	return c.scheme
+}
+
+func TestAnnotatingReconciler_WriteTargetStatus(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme, v1alpha1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme, "config/crd")
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+
+	log := NewCapturingLogger()
+	r := NewAnnotatingReconciler(mgr.GetClient(), log, &v1alpha1.Widget{}, "widget-found", "yes")
+	r.WriteTarget = WriteTargetStatus
+	r.OnlyGenerationChanges = true
+	r.RequeueOnNotFound = 100 * time.Millisecond
+	r.AuditEvents = true
+	require.NoError(t, r.SetupWithManager(mgr))
+	startManager(t, ctx, mgr)
+
+	key := types.NamespacedName{Name: "widget-1", Namespace: "default"}
+
+	widget := v1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	require.NoError(t, kc.Create(ctx, &widget))
+
+	t.Log("Waiting for the Widget to have widget-found=yes in its status")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := kc.Get(ctx, key, &widget)
+		if err != nil {
+			return false, err
+		}
+		return widget.Status.Found["widget-found"] == "yes", nil
+	}))
+	require.Empty(t, widget.Annotations)
+	require.Equal(t, int64(1), widget.Generation)
+
+	t.Log("Waiting for the update event caused by the status write")
+	statusUpdate := -1
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		for i, line := range log.Lines() {
+			if line.Msg == "update" && line.Value("newResourceVersion") == widget.ResourceVersion {
+				statusUpdate = i
+				return true, nil
+			}
+		}
+		return false, nil
+	}))
+
+	t.Log("The status update should not trigger another reconcile")
+	time.Sleep(time.Second)
+	for _, line := range log.Lines()[statusUpdate:] {
+		require.False(t, line.Msg == "start" && line.Value("widget") == key, "reconciled after the status update")
+	}
+}
+
+func TestAnnotatingReconciler_SerializePerKey(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	// All the reconciles read the same version of the Secret, and all but
+	// the first Update are rejected, unless they wait for each other.
+	conflicts := func(t *testing.T, name string, serialize bool) int {
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+		req := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&secret)}
+
+		r := &AnnotatingReconciler{
+			Client:          &slowClient{Client: kc, delay: 20 * time.Millisecond},
+			Log:             logger,
+			SerializePerKey: serialize,
+		}
+		const concurrency = 20
+		errs := make(chan error, concurrency)
+		for i := 0; i < concurrency; i++ {
+			go func() {
+				_, err := r.Reconcile(ctx, req)
+				errs <- err
+			}()
+		}
+		count := 0
+		for i := 0; i < concurrency; i++ {
+			err := <-errs
+			switch {
+			case errors.Is(err, ErrConflict):
+				count++
+			case err != nil:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+		return count
+	}
+
+	off := conflicts(t, "secret-1", false)
+	on := conflicts(t, "secret-2", true)
+	t.Logf("conflicts: %d without serialization, %d with", off, on)
+	require.Greater(t, off, 1)
+	require.Equal(t, 0, on)
+}
+
+func TestAnnotatingReconciler_Coalesce(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	reconciles := func(t *testing.T, name string, coalesce time.Duration) int {
+		ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+		defer cancel()
+
+		mgr, err := ctrl.NewManager(rc, ctrl.Options{
+			Scheme:             scheme,
+			Logger:             logger,
+			MetricsBindAddress: "0",
+		})
+		require.NoError(t, err)
+		log := NewCapturingLogger()
+		err = (&AnnotatingReconciler{
+			Client:            mgr.GetClient(),
+			Log:               log,
+			RequeueOnNotFound: 100 * time.Millisecond,
+			Coalesce:          coalesce,
+		}).SetupWithManager(mgr)
+		require.NoError(t, err)
+		startManager(t, ctx, mgr)
+
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+		key := client.ObjectKeyFromObject(&secret)
+		for i := 0; i < 20; i++ {
+			patch := client.RawPatch(types.MergePatchType, []byte(fmt.Sprintf(`{"metadata":{"labels":{"update":"%d"}}}`, i)))
+			require.NoError(t, kc.Patch(ctx, &secret, patch))
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Log("Waiting for the Secret to have the annotation secret-found=yes")
+		require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			err := kc.Get(ctx, key, &secret)
+			if err != nil {
+				return false, err
+			}
+			return secret.Annotations["secret-found"] == "yes", nil
+		}))
+		// Lets the events caused by the annotation come in.
+		time.Sleep(coalesce + 500*time.Millisecond)
+
+		count := 0
+		for _, line := range log.Lines() {
+			if line.Msg == "start" && line.Value("secret") == key {
+				count++
+			}
+		}
+		return count
+	}
+
+	off := reconciles(t, "secret-1", 0)
+	on := reconciles(t, "secret-2", 500*time.Millisecond)
+	t.Logf("reconciles: %d without coalescing, %d with", off, on)
+	require.Less(t, on, off)
+	require.LessOrEqual(t, on, 3)
+}
+
+func TestAnnotatingReconciler_ContextDeadline(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	// The manager only serves the cache: the reconciles are the ones below.
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+
+	expired, cancelExpired := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancelExpired()
+	<-expired.Done()
+
+	// Each operation must give up right away rather than block until the
+	// outer context is done.
+	within := func(t *testing.T, f func() error) error {
+		start := time.Now()
+		err := f()
+		require.Less(t, int64(time.Since(start)), int64(time.Second), "took %s", time.Since(start))
+		return err
+	}
+
+	t.Run("the apiserver calls fail with DeadlineExceeded", func(t *testing.T) {
+		err := within(t, func() error { return kc.Get(expired, key, &corev1.Secret{}) })
+		require.True(t, errors.Is(err, context.DeadlineExceeded), "expected DeadlineExceeded, got: %v", err)
+
+		err = within(t, func() error { return kc.Update(expired, secret.DeepCopy()) })
+		require.True(t, errors.Is(err, context.DeadlineExceeded), "expected DeadlineExceeded, got: %v", err)
+	})
+
+	t.Run("the cache doesn't wait for an informer to sync", func(t *testing.T) {
+		// No v1.Secret informer exists yet: the Get would start one and
+		// wait for it to sync.
+		err := within(t, func() error { return mgr.GetClient().Get(expired, key, &corev1.Secret{}) })
+		require.Error(t, err)
+	})
+
+	t.Run("the reconcile error wraps DeadlineExceeded", func(t *testing.T) {
+		require.NoError(t, mgr.GetClient().Get(ctx, key, &corev1.Secret{}))
+
+		// The Get is served from the cache, which never blocks once
+		// synced, and the Update is the one that fails.
+		r := &AnnotatingReconciler{Client: mgr.GetClient(), Log: logger}
+		err := within(t, func() error {
+			_, err := r.Reconcile(expired, reconcile.Request{NamespacedName: key})
+			return err
+		})
+		require.True(t, errors.Is(err, context.DeadlineExceeded), "expected DeadlineExceeded, got: %v", err)
+
+		require.NoError(t, kc.Get(ctx, key, &secret))
+		require.NotContains(t, secret.Annotations, "secret-found")
+	})
+}
+
+func TestAnnotatingReconciler_LogWrittenRV(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}).Build()
+	var before corev1.Secret
+	require.NoError(t, c.Get(context.Background(), key, &before))
+
+	log := NewCapturingLogger()
+	r := &AnnotatingReconciler{Client: c, Log: log}
+	_, err = r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+
+	var after corev1.Secret
+	require.NoError(t, c.Get(context.Background(), key, &after))
+	require.NotEqual(t, before.ResourceVersion, after.ResourceVersion)
+
+	var written []LogLine
+	for _, line := range log.Lines() {
+		if line.Msg == "written" {
+			written = append(written, line)
+		}
+	}
+	require.Len(t, written, 1)
+	require.Equal(t, 2, written[0].Level)
+	require.Equal(t, before.ResourceVersion, written[0].Value("readResourceVersion"))
+	require.Equal(t, after.ResourceVersion, written[0].Value("resourceVersion"))
+}
+
+func TestAnnotatingReconciler_ReportCacheConsistency(t *testing.T) {
+	setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme, v1alpha1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme, "config/crd")
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	key := types.NamespacedName{Name: "widget-1", Namespace: "default"}
+	widget := v1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	require.NoError(t, kc.Create(ctx, &widget))
+
+	r := NewAnnotatingReconciler(kc, logr.Discard(), &v1alpha1.Widget{}, "widget-found", "yes")
+	r.APIReader = kc
+	r.ReportCacheConsistency = true
+
+	condition := func() *metav1.Condition {
+		var got v1alpha1.Widget
+		require.NoError(t, kc.Get(ctx, key, &got))
+		return meta.FindStatusCondition(got.Status.Conditions, CacheConsistentCondition)
+	}
+
+	t.Log("Reading from the apiserver, the cache can't be stale")
+	_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	got := condition()
+	require.NotNil(t, got)
+	require.Equal(t, metav1.ConditionTrue, got.Status)
+
+	t.Log("Forcing a stale read with a cache that lags one version behind")
+	require.NoError(t, kc.Get(ctx, key, &widget))
+	stale := NewFakeStaleCache(1)
+	stale.Set(&widget)
+	widget.Labels = map[string]string{"changed": "yes"}
+	require.NoError(t, kc.Update(ctx, &widget))
+	stale.Set(&widget)
+	r.ReadFrom = stale
+
+	_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	got = condition()
+	require.NotNil(t, got)
+	require.Equal(t, metav1.ConditionFalse, got.Status)
+	require.Equal(t, "StaleRead", got.Reason)
+}
+
+func TestAnnotatingReconciler_ReportCacheConsistency_NoConditions(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	kc := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+
+	r := &AnnotatingReconciler{Client: kc, APIReader: kc, Log: logr.Discard(), ReportCacheConsistency: true}
+	_, err = r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(secret)})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has no conditions")
+}
+
+// AssertAnnotatedForUID waits up to 10 seconds for the Secret with the given
+// key to have the secret-found=yes annotation, and fails the test unless that
+// Secret has the given UID. A Secret that was deleted and created again keeps
+// its name but gets a new UID, which tells it apart from the deleted one.
+func AssertAnnotatedForUID(t *testing.T, c client.Reader, key client.ObjectKey, uid types.UID) {
+	t.Helper()
+	var secret corev1.Secret
+	err := pollUntil(context.Background(), 10*time.Millisecond, 10*time.Second, func() (bool, error) {
+		err := c.Get(context.Background(), key, &secret)
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return secret.UID == uid && secret.Annotations["secret-found"] == "yes", nil
+	})
+	if err != nil {
+		t.Errorf("Secret %s with UID %s never got annotated, last seen with UID %s and annotations %v: %v", key, uid, secret.UID, secret.Annotations, err)
+	}
+}
+
+func TestAnnotatingReconciler_DeleteThenRecreate(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 20 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	r := &AnnotatingReconciler{
+		Client:         mgr.GetClient(),
+		Log:            logger,
+		RequeueOnStale: 100 * time.Millisecond,
+	}
+	require.NoError(t, r.SetupWithManager(mgr))
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	key := client.ObjectKeyFromObject(&secret)
+	require.NoError(t, kc.Create(ctx, &secret))
+	AssertAnnotatedForUID(t, kc, key, secret.UID)
+	oldUID := secret.UID
+
+	t.Log("Deleting and recreating the Secret right away")
+	require.NoError(t, kc.Delete(ctx, &secret))
+	recreated := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	require.NoError(t, kc.Create(ctx, &recreated))
+	require.NotEqual(t, oldUID, recreated.UID)
+
+	AssertAnnotatedForUID(t, kc, key, recreated.UID)
+}
+
+func TestAnnotatingReconciler_SecretType(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme, v1alpha1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: logger, Object: &v1alpha1.Widget{}, SecretType: corev1.SecretTypeTLS}).SetupWithManager(mgr)
+	require.EqualError(t, err, "SecretType requires the object to be a Secret, got *v1alpha1.Widget")
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: logger, SecretType: corev1.SecretTypeTLS}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	opaque := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-opaque", Namespace: "default"}, Type: corev1.SecretTypeOpaque}
+	require.NoError(t, kc.Create(ctx, &opaque))
+	tls := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret-tls", Namespace: "default"},
+		Type:       corev1.SecretTypeTLS,
+		Data:       map[string][]byte{corev1.TLSCertKey: nil, corev1.TLSPrivateKeyKey: nil},
+	}
+	require.NoError(t, kc.Create(ctx, &tls))
+
+	t.Log("Waiting for the TLS Secret to be annotated")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := kc.Get(ctx, client.ObjectKeyFromObject(&tls), &tls)
+		if err != nil {
+			return false, err
+		}
+		return tls.Annotations["secret-found"] == "yes", nil
+	}))
+
+	t.Log("The Opaque Secret, created first, should be left alone")
+	time.Sleep(500 * time.Millisecond)
+	require.NoError(t, kc.Get(ctx, client.ObjectKeyFromObject(&opaque), &opaque))
+	require.Empty(t, opaque.Annotations)
+}
+
+func TestAnnotatingReconciler_IgnoreOwnUpdates(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name             string
+		ignoreOwnUpdates bool
+		// The reconciles after the creation and after the reconciler's own
+		// write.
+		wantReconciles int
+	}{
+		{name: "default", ignoreOwnUpdates: false, wantReconciles: 2},
+		{name: "ignore own updates", ignoreOwnUpdates: true, wantReconciles: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+			defer cancel()
+
+			mgr, err := ctrl.NewManager(rc, ctrl.Options{
+				Scheme:             scheme,
+				Logger:             logger,
+				MetricsBindAddress: "0",
+			})
+			require.NoError(t, err)
+			// Watching the full object rules out the stale reads, which
+			// would add reconciles of their own.
+			recorder := &ReconcileRecorder{}
+			err = (&AnnotatingReconciler{
+				Client:           mgr.GetClient(),
+				Log:              logger,
+				Name:             strings.ReplaceAll(tt.name, " ", "-"),
+				WatchFullObject:  true,
+				IgnoreOwnUpdates: tt.ignoreOwnUpdates,
+				Middlewares:      []Middleware{Recording(recorder)},
+			}).SetupWithManager(mgr)
+			require.NoError(t, err)
+			startManager(t, ctx, mgr)
+
+			secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-" + strings.ReplaceAll(tt.name, " ", "-"), Namespace: "default"}}
+			key := client.ObjectKeyFromObject(&secret)
+			require.NoError(t, kc.Create(ctx, &secret))
+
+			require.NoError(t, WaitForReconcileCount(ctx, recorder, key.String(), tt.wantReconciles, 5*time.Second))
+			require.Error(t, WaitForReconcileCount(ctx, recorder, key.String(), tt.wantReconciles+1, time.Second), "redundant reconcile")
+			require.NoError(t, kc.Get(ctx, key, &secret))
+			require.Equal(t, "yes", secret.Annotations["secret-found"])
+
+			t.Log("Someone else's change is still reconciled")
+			secret.Labels = map[string]string{"foo": "bar"}
+			require.NoError(t, kc.Update(ctx, &secret))
+			require.NoError(t, WaitForReconcileCount(ctx, recorder, key.String(), tt.wantReconciles+1, 5*time.Second))
+		})
+	}
+}
+
+func TestAnnotatingReconciler_DeterministicOrder(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	// The names go the other way around from the creations. The
+	// creationTimestamps are only precise to the second.
+	names := []string{"secret-c", "secret-b", "secret-a"}
+	for i, name := range names {
+		if i > 0 {
+			time.Sleep(1100 * time.Millisecond)
+		}
+		require.NoError(t, kc.Create(context.Background(), &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}))
+	}
+
+	// By default, the order depends on how the apiserver's watch cache
+	// lists the objects, which is a map: any of the three may come first.
+	tests := []struct {
+		name               string
+		deterministicOrder bool
+		wantFirst          string // Empty when the order can't be known.
+	}{
+		{name: "default", deterministicOrder: false},
+		{name: "by creation", deterministicOrder: true, wantFirst: "default/secret-c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+			defer cancel()
+
+			mgr, err := ctrl.NewManager(rc, ctrl.Options{
+				Scheme:             scheme,
+				Logger:             logger,
+				MetricsBindAddress: "0",
+			})
+			require.NoError(t, err)
+			recorder := &ReconcileRecorder{}
+			err = (&AnnotatingReconciler{
+				Client:             mgr.GetClient(),
+				Log:                logger,
+				Name:               strings.ReplaceAll(tt.name, " ", "-"),
+				Annotations:        map[string]string{"order": strings.ReplaceAll(tt.name, " ", "-")},
+				DeterministicOrder: tt.deterministicOrder,
+				Middlewares:        []Middleware{Recording(recorder)},
+			}).SetupWithManager(mgr)
+			require.NoError(t, err)
+			startManager(t, ctx, mgr)
+
+			for _, name := range names {
+				require.NoError(t, WaitForReconcileCount(ctx, recorder, "default/"+name, 1, 5*time.Second))
+			}
+			recorder.mu.Lock()
+			first := recorder.events[0]
+			recorder.mu.Unlock()
+			t.Logf("First reconcile: %s", first.Key)
+			if tt.wantFirst != "" {
+				require.Equal(t, tt.wantFirst, first.Key)
+			}
+		})
+	}
+}
+
+// clobberingClient removes the secret-found annotation right after the first
+// Update, as a competing writer would.
+type clobberingClient struct {
+	client.Client
+	clobbered bool
+}
+
+func (c *clobberingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	err := c.Client.Update(ctx, obj, opts...)
+	if err != nil || c.clobbered {
+		return err
+	}
+	c.clobbered = true
+	competing := obj.DeepCopyObject().(client.Object)
+	annotations := competing.GetAnnotations()
+	delete(annotations, "secret-found")
+	competing.SetAnnotations(annotations)
+	return c.Client.Update(ctx, competing)
+}
+
+func TestAnnotatingReconciler_VerifyWrites(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+	kc := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}).Build()
+
+	log := NewCapturingLogger()
+	r := &AnnotatingReconciler{
+		Client:       &clobberingClient{Client: kc},
+		APIReader:    kc,
+		Log:          log,
+		VerifyWrites: true,
+	}
+	warnings := func() int {
+		count := 0
+		for _, line := range log.Lines() {
+			if strings.HasPrefix(line.Msg, "warning: the annotations are gone") {
+				count++
+			}
+		}
+		return count
+	}
+
+	t.Log("The competing writer removes the annotation, the reconciler should notice and requeue")
+	res, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	require.Equal(t, reconcile.Result{Requeue: true}, res)
+	require.Equal(t, 1, warnings())
+
+	var secret corev1.Secret
+	require.NoError(t, kc.Get(context.Background(), key, &secret))
+	require.NotContains(t, secret.Annotations, "secret-found")
+
+	t.Log("The next attempt should add the annotation again, and it should stick")
+	res, err = r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	require.Equal(t, reconcile.Result{}, res)
+	require.Equal(t, 1, warnings())
+	require.NoError(t, kc.Get(context.Background(), key, &secret))
+	require.Equal(t, "yes", secret.Annotations["secret-found"])
+
+	t.Run("without APIReader", func(t *testing.T) {
+		kc := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}).Build()
+		r := &AnnotatingReconciler{Client: kc, Log: logr.Discard(), VerifyWrites: true}
+		_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: key})
+		require.EqualError(t, err, "VerifyWrites is set but APIReader is not")
+	})
+}
+
+// servedVersions records the resourceVersion of each object that Get returns.
+type servedVersions struct {
+	client.Reader
+
+	mu       sync.Mutex
+	versions []string
+}
+
+func (r *servedVersions) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	err := r.Reader.Get(ctx, key, obj)
+	if err == nil {
+		r.mu.Lock()
+		r.versions = append(r.versions, obj.GetResourceVersion())
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// The ConsistencyChecks read the cache several times within one reconcile,
+// and the cache serves a new version in between.
+func TestAnnotatingReconciler_PerRequestReadCache(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	tests := []struct {
+		name                string
+		perRequestReadCache bool
+		wantCacheReads      int
+	}{
+		{name: "without it, the reconcile sees two versions", perRequestReadCache: false, wantCacheReads: 2},
+		{name: "with it, the reconcile sees a single version", perRequestReadCache: true, wantCacheReads: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+			kc := fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()
+			key := client.ObjectKeyFromObject(secret)
+			require.NoError(t, kc.Get(ctx, key, secret))
+			stale := secret.DeepCopy()
+			secret.Labels = map[string]string{"changed": "yes"}
+			require.NoError(t, kc.Update(ctx, secret))
+
+			cache := &servedVersions{Reader: &laggingClient{Client: kc, stale: stale, staleGets: 1}}
+			log := NewCapturingLogger()
+			r := &AnnotatingReconciler{
+				Client:              kc,
+				ReadFrom:            cache,
+				APIReader:           kc,
+				Log:                 log,
+				ConsistencyChecks:   3,
+				PerRequestReadCache: tt.perRequestReadCache,
+			}
+			_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			require.NoError(t, err)
+
+			require.Len(t, cache.versions, tt.wantCacheReads)
+			require.Equal(t, stale.ResourceVersion, cache.versions[0])
+			seen := map[string]bool{}
+			for _, line := range log.Lines() {
+				if line.Msg == "the cache is behind the apiserver, reading again" {
+					seen[line.Value("cached").(string)] = true
+				}
+			}
+			require.Equal(t, map[string]bool{stale.ResourceVersion: true}, seen)
+
+			var got corev1.Secret
+			require.NoError(t, kc.Get(ctx, key, &got))
+			require.Equal(t, "yes", got.Annotations["secret-found"])
+		})
+	}
+}
+
+func TestAnnotatingReconciler_MaxObjectAge(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	old := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "old", Namespace: "default", CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour))}}
+	fresh := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "default", CreationTimestamp: metav1.Now()}}
+	kc := fake.NewClientBuilder().WithScheme(scheme).WithObjects(old, fresh).Build()
+
+	log := NewCapturingLogger()
+	r := &AnnotatingReconciler{Client: kc, Log: log, MaxObjectAge: time.Minute}
+	for _, secret := range []*corev1.Secret{old, fresh} {
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(secret)})
+		require.NoError(t, err)
+	}
+
+	var got corev1.Secret
+	require.NoError(t, kc.Get(ctx, client.ObjectKeyFromObject(old), &got))
+	require.NotContains(t, got.Annotations, "secret-found")
+	require.NoError(t, kc.Get(ctx, client.ObjectKeyFromObject(fresh), &got))
+	require.Equal(t, "yes", got.Annotations["secret-found"])
+
+	var skipped []string
+	for _, line := range log.Lines() {
+		if line.Msg == "skipping old object" {
+			skipped = append(skipped, line.Value("secret").(types.NamespacedName).Name)
+		}
+	}
+	require.Equal(t, []string{"old"}, skipped)
+}
+
+// The webhook denies every write to the Secrets labeled deny=yes, and counts
+// the dry runs apart from the real writes.
+func TestAnnotatingReconciler_ValidateBeforeWrite(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	fail := admissionregistrationv1.Fail
+	none := admissionregistrationv1.SideEffectClassNone
+	path := "/validate-secret"
+	testEnv := newTestEnv(scheme)
+	testEnv.WebhookInstallOptions = envtest.WebhookInstallOptions{
+		ValidatingWebhooks: []admissionregistrationv1.ValidatingWebhookConfiguration{{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "ValidatingWebhookConfiguration"},
+			ObjectMeta: metav1.ObjectMeta{Name: "deny-secrets"},
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{{
+				Name:                    "deny-secrets.cacherace.io",
+				AdmissionReviewVersions: []string{"v1"},
+				SideEffects:             &none,
+				FailurePolicy:           &fail,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{Name: "deny-secrets", Namespace: "default", Path: &path},
+				},
+				ObjectSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"deny": "yes"}},
+				Rules: []admissionregistrationv1.RuleWithOperations{{
+					Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update},
+					Rule: admissionregistrationv1.Rule{
+						APIGroups:   []string{""},
+						APIVersions: []string{"v1"},
+						Resources:   []string{"secrets"},
+					},
+				}},
+			}},
+		}},
+	}
+	rc, err := testEnv.Start()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, testEnv.Stop())
+	})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var dryRuns, writes int
+	server := &webhook.Server{
+		Host:    testEnv.WebhookInstallOptions.LocalServingHost,
+		Port:    testEnv.WebhookInstallOptions.LocalServingPort,
+		CertDir: testEnv.WebhookInstallOptions.LocalServingCertDir,
+	}
+	server.Register(path, &webhook.Admission{Handler: admission.HandlerFunc(func(_ context.Context, req admission.Request) admission.Response {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.DryRun != nil && *req.DryRun {
+			dryRuns++
+		} else {
+			writes++
+		}
+		return admission.Denied("the Secrets labeled deny=yes can't be changed")
+	})})
+	go func() {
+		_ = server.StartStandalone(ctx, scheme)
+	}()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default", Labels: map[string]string{"deny": "yes"}}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+
+	log := NewCapturingLogger()
+	r := &AnnotatingReconciler{Client: kc, Log: log, ValidateBeforeWrite: true}
+
+	// The webhook server may still be starting.
+	require.NoError(t, pollUntil(ctx, 100*time.Millisecond, 10*time.Second, func() (bool, error) {
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		return err != nil && strings.Contains(err.Error(), "can't be changed"), nil
+	}))
+
+	mu.Lock()
+	gotDryRuns, gotWrites := dryRuns, writes
+	mu.Unlock()
+	require.GreaterOrEqual(t, gotDryRuns, 1)
+	require.Zero(t, gotWrites, "the real write shouldn't have been sent")
+
+	var rejected []LogLine
+	for _, line := range log.Lines() {
+		if line.Msg == "the dry run was rejected, not writing" {
+			rejected = append(rejected, line)
+		}
+	}
+	require.NotEmpty(t, rejected)
+	require.Contains(t, fmt.Sprint(rejected[len(rejected)-1].Value("err")), "can't be changed")
+
+	require.NoError(t, kc.Get(ctx, key, &secret))
+	require.NotContains(t, secret.Annotations, "secret-found")
+
+	t.Log("Once the dry run succeeds, the real write goes through")
+	allowed := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-2", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &allowed))
+	_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&allowed)})
+	require.NoError(t, err)
+	require.NoError(t, kc.Get(ctx, client.ObjectKeyFromObject(&allowed), &allowed))
+	require.Equal(t, "yes", allowed.Annotations["secret-found"])
+}
+
+func TestAnnotatingReconciler_InjectConflicts(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	newSecret := func() (client.Client, types.NamespacedName) {
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+		return fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build(), client.ObjectKeyFromObject(secret)
+	}
+	annotated := func(kc client.Client, key types.NamespacedName) bool {
+		var secret corev1.Secret
+		require.NoError(t, kc.Get(ctx, key, &secret))
+		return secret.Annotations["secret-found"] == "yes"
+	}
+
+	t.Run("RetryOnConflict retries within the reconcile", func(t *testing.T) {
+		kc, key := newSecret()
+		log := NewCapturingLogger()
+		r := &AnnotatingReconciler{Client: kc, Log: log, InjectConflicts: 2, StrictOptimistic: true, RetryOnConflict: true}
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.NoError(t, err)
+		require.True(t, annotated(kc, key))
+
+		conflicts := 0
+		for _, line := range log.Lines() {
+			if line.Msg == "conflict, the object changed since it was read" {
+				conflicts++
+			}
+		}
+		require.Equal(t, 2, conflicts)
+	})
+
+	t.Run("without RetryOnConflict, each conflict is returned", func(t *testing.T) {
+		kc, key := newSecret()
+		r := &AnnotatingReconciler{Client: kc, Log: logr.Discard(), InjectConflicts: 2}
+		for i := 0; i < 2; i++ {
+			_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			require.True(t, errors.Is(err, ErrConflict), "attempt %d: expected a conflict, got: %v", i+1, err)
+			require.True(t, apierrors.IsConflict(err))
+			require.False(t, annotated(kc, key))
+		}
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.NoError(t, err)
+		require.True(t, annotated(kc, key))
+	})
+
+	t.Run("the conflicts name the resource", func(t *testing.T) {
+		kc, key := newSecret()
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(corev1.SchemeGroupVersion.WithKind("Secret"), meta.RESTScopeNamespace)
+		r := &AnnotatingReconciler{Client: mappedClient{Client: kc, mapper: mapper}, Log: logr.Discard(), InjectConflicts: 1}
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.True(t, apierrors.IsConflict(err))
+		require.Contains(t, err.Error(), `on secrets "secret-1"`)
+	})
+
+	t.Run("the dry runs don't use up the conflicts", func(t *testing.T) {
+		kc, key := newSecret()
+		c := &dryRunCountingClient{Client: kc}
+		r := &AnnotatingReconciler{Client: c, Log: logr.Discard(), InjectConflicts: 1, ValidateBeforeWrite: true}
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.True(t, errors.Is(err, ErrConflict), "expected a conflict, got: %v", err)
+		require.Equal(t, 1, c.dryRuns, "the dry run should have been sent")
+		require.False(t, annotated(kc, key))
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.NoError(t, err)
+		require.True(t, annotated(kc, key))
+	})
+
+	t.Run("the status writes get the conflicts too", func(t *testing.T) {
+		scheme, err := BuildScheme(v1alpha1.AddToScheme)
+		require.NoError(t, err)
+		widget := &v1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{Name: "widget-1", Namespace: "default"}}
+		kc := fake.NewClientBuilder().WithScheme(scheme).WithObjects(widget).Build()
+		key := client.ObjectKeyFromObject(widget)
+		found := func() bool {
+			var widget v1alpha1.Widget
+			require.NoError(t, kc.Get(ctx, key, &widget))
+			return widget.StatusFound()["widget-found"] == "yes"
+		}
+
+		r := NewAnnotatingReconciler(kc, logr.Discard(), &v1alpha1.Widget{}, "widget-found", "yes")
+		r.WriteTarget = WriteTargetStatus
+		r.InjectConflicts = 1
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.True(t, errors.Is(err, ErrConflict), "expected a conflict, got: %v", err)
+		require.False(t, found())
+		_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.NoError(t, err)
+		require.True(t, found())
+	})
+}
+
+// dryRunCountingClient counts the dry run Updates that reach the client.
+type dryRunCountingClient struct {
+	client.Client
+	dryRuns int
+}
+
+func (c *dryRunCountingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	updateOpts := &client.UpdateOptions{}
+	updateOpts.ApplyOptions(opts)
+	if len(updateOpts.DryRun) > 0 {
+		c.dryRuns++
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+// mappedClient gives a RESTMapper to the fake client, which has none.
+type mappedClient struct {
+	client.Client
+	mapper meta.RESTMapper
+}
+
+func (c mappedClient) RESTMapper() meta.RESTMapper {
+	return c.mapper
+}
+
+func TestAnnotatingReconciler_LogReconcileLag(t *testing.T) {
+	captured := NewCapturingLogger()
+	logger := teeLogger{setupTestLogger(t), captured}
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 30 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+
+	// The artificial load: a single worker that takes a while per object.
+	const work = 100 * time.Millisecond
+	slow := func(next reconcile.Reconciler) reconcile.Reconciler {
+		return reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+			res, err := next.Reconcile(ctx, req)
+			time.Sleep(work)
+			return res, err
+		})
+	}
+	recorder := &ReconcileRecorder{}
+	r := &AnnotatingReconciler{
+		Client:                  mgr.GetClient(),
+		Log:                     logger,
+		MaxConcurrentReconciles: 1,
+		IgnoreOwnUpdates:        true,
+		LogReconcileLag:         true,
+		Middlewares:             []Middleware{Recording(recorder), slow},
+	}
+	require.NoError(t, r.SetupWithManager(mgr))
+	startManager(t, ctx, mgr)
+
+	lags := func() []time.Duration {
+		var lags []time.Duration
+		for _, line := range captured.Lines() {
+			if line.Msg == "reconcile lag" {
+				lags = append(lags, line.Value("lag").(time.Duration))
+			}
+		}
+		return lags
+	}
+
+	t.Log("A burst of Secrets, each one waits for the ones before it")
+	const burst = 10
+	for i := 0; i < burst; i++ {
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("secret-%d", i), Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+	}
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return len(lags()) == burst, nil
+	}))
+	burstLags := lags()
+	t.Logf("Lags during the burst: %v", burstLags)
+	require.Greater(t, int64(burstLags[burst-1]), int64(burst/2*work), "the lag should have grown with the queue")
+	require.Greater(t, int64(burstLags[burst-1]), int64(burstLags[0]+burst/2*work))
+
+	t.Log("Once the queue is drained, the lag shrinks")
+	AssertWorkqueueDrained(t, recorder, work)
+	var secret corev1.Secret
+	require.NoError(t, kc.Get(ctx, client.ObjectKey{Name: "secret-0", Namespace: "default"}, &secret))
+	secret.Labels = map[string]string{"foo": "bar"}
+	require.NoError(t, kc.Update(ctx, &secret))
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return len(lags()) == burst+1, nil
+	}))
+	last := lags()[burst]
+	t.Logf("Lag after the burst: %s", last)
+	require.Less(t, int64(last), int64(burstLags[burst-1]), "the lag should have shrunk")
+}
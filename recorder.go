@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// ReconcileEvent is a call to Reconcile as seen by the ReconcileRecorder.
+type ReconcileEvent struct {
+	Key    string // Of the form "namespace/name".
+	Start  time.Time
+	End    time.Time
+	Result reconcile.Result
+	Err    error
+}
+
+// ReconcileRecorder wraps a reconciler and records each call to Reconcile.
+// It is safe to use from multiple reconcile workers.
+type ReconcileRecorder struct {
+	Reconciler reconcile.Reconciler
+
+	mu      sync.Mutex
+	events  []ReconcileEvent
+	created map[string]time.Time
+	running int
+}
+
+func (r *ReconcileRecorder) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	start := time.Now()
+	r.mu.Lock()
+	r.running++
+	r.mu.Unlock()
+	res, err := r.Reconciler.Reconcile(ctx, req)
+
+	r.mu.Lock()
+	r.running--
+	r.events = append(r.events, ReconcileEvent{
+		Key:    req.NamespacedName.String(),
+		Start:  start,
+		End:    time.Now(),
+		Result: res,
+		Err:    err,
+	})
+	r.mu.Unlock()
+
+	return res, err
+}
+
+// Events returns the recorded reconciles for the given key, in the order in
+// which they ended.
+func (r *ReconcileRecorder) Events(key string) []ReconcileEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []ReconcileEvent
+	for _, e := range r.events {
+		if e.Key == key {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// LastReconcile returns when the last recorded reconcile ended, and whether a
+// reconcile is still running. The time is zero when nothing was reconciled.
+func (r *ReconcileRecorder) LastReconcile() (end time.Time, running bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range r.events {
+		if e.End.After(end) {
+			end = e.End
+		}
+	}
+	return end, r.running > 0
+}
+
+// Created records when the object with the given key, of the form
+// "namespace/name", was created. The creationTimestamp of the object can't be
+// used since it is only precise to the second. Calling Created right before
+// the Create call makes sure that no reconcile of that object starts earlier.
+func (r *ReconcileRecorder) Created(key string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.created == nil {
+		r.created = make(map[string]time.Time)
+	}
+	r.created[key] = at
+}
+
+// TimeToFirstReconcile returns the time between the creation of the object,
+// as given to Created, and the start of its first reconcile. It returns false
+// when the creation wasn't recorded or the object wasn't reconciled yet. A
+// reconcile that is still running doesn't count.
+func TimeToFirstReconcile(recorder *ReconcileRecorder, key string) (time.Duration, bool) {
+	recorder.mu.Lock()
+	created, ok := recorder.created[key]
+	recorder.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+
+	events := recorder.Events(key)
+	if len(events) == 0 {
+		return 0, false
+	}
+	first := events[0].Start
+	for _, e := range events[1:] {
+		if e.Start.Before(first) {
+			first = e.Start
+		}
+	}
+	return first.Sub(created), true
+}
+
+// ReconcileFairness returns the ratio of the smallest to the largest number
+// of reconciles among the given keys, of the form "namespace/name": 1 when
+// they were all reconciled as many times, 0 when one of them was starved,
+// i.e., never reconciled while another one was. It is 1 when keys is empty
+// and 0 when none of the keys was reconciled.
+func ReconcileFairness(recorder *ReconcileRecorder, keys []string) float64 {
+	if len(keys) == 0 {
+		return 1
+	}
+	min, max := -1, 0
+	for _, key := range keys {
+		n := len(recorder.Events(key))
+		if min == -1 || n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	if max == 0 {
+		return 0
+	}
+	return float64(min) / float64(max)
+}
+
+// WaitForReconcileCount waits until the object with the given key, of the form
+// "namespace/name", has been reconciled at least want times, counting the
+// reconciles that returned an error. It returns an error when ctx is done or
+// the timeout expires first.
+func WaitForReconcileCount(ctx context.Context, recorder *ReconcileRecorder, key string, want int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := wait.PollImmediateUntil(10*time.Millisecond, func() (bool, error) {
+		return len(recorder.Events(key)) >= want, nil
+	}, ctx.Done())
+	if err != nil {
+		return fmt.Errorf("while waiting for %s to be reconciled %d times, got %d: %w", key, want, len(recorder.Events(key)), err)
+	}
+	return nil
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// AssertNoReconcileStorm fails the test if the key was reconciled more than
+// max times within any window of the given duration, which usually means the
+// reconciler keeps writing to the object, e.g., because it reads a stale
+// version back from the cache.
+func AssertNoReconcileStorm(t *testing.T, recorder *ReconcileRecorder, key string, max int, within time.Duration) {
+	t.Helper()
+	err := detectReconcileStorm(recorder.Events(key), max, within)
+	if err != nil {
+		t.Errorf("reconcile storm detected for %s: %v", key, err)
+	}
+}
+
+func detectReconcileStorm(events []ReconcileEvent, max int, within time.Duration) error {
+	starts := make([]time.Time, 0, len(events))
+	for _, e := range events {
+		starts = append(starts, e.Start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	// Sliding window: for each reconcile, count the reconciles that started
+	// less than "within" after it.
+	j := 0
+	for i := range starts {
+		for j < len(starts) && starts[j].Sub(starts[i]) < within {
+			j++
+		}
+		if j-i > max {
+			return fmt.Errorf("%d reconciles within %s starting at %s, expected at most %d", j-i, within, starts[i].Format(time.RFC3339Nano), max)
+		}
+	}
+
+	return nil
+}
+
+func TestAssertNoReconcileStorm(t *testing.T) {
+	t.Run("a few reconciles are not a storm", func(t *testing.T) {
+		recorder := &ReconcileRecorder{Reconciler: reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+			return reconcile.Result{}, nil
+		})}
+		req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "secret-1", Namespace: "default"}}
+		for i := 0; i < 3; i++ {
+			_, err := recorder.Reconcile(context.Background(), req)
+			require.NoError(t, err)
+		}
+
+		AssertNoReconcileStorm(t, recorder, "default/secret-1", 10, time.Second)
+	})
+
+	t.Run("a reconciler that always writes causes a storm", func(t *testing.T) {
+		logger := setupTestLogger(t)
+
+		scheme, err := BuildScheme(corev1.AddToScheme)
+		require.NoError(t, err)
+		rc := startTestEnv(t, scheme)
+
+		const timeout = 10 * time.Second
+		ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+		defer cancel()
+
+		kc, err := client.New(rc, client.Options{Scheme: scheme})
+		require.NoError(t, err)
+
+		mgr, err := ctrl.NewManager(rc, ctrl.Options{
+			Scheme:             scheme,
+			Logger:             logger,
+			MetricsBindAddress: "0",
+		})
+		require.NoError(t, err)
+
+		// Each write triggers a new reconcile, which writes again.
+		recorder := &ReconcileRecorder{Reconciler: reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+			secret := &corev1.Secret{}
+			err := kc.Get(ctx, req.NamespacedName, secret)
+			if err != nil {
+				return reconcile.Result{}, client.IgnoreNotFound(err)
+			}
+			secret.Annotations = map[string]string{"written-at": time.Now().Format(time.RFC3339Nano)}
+			return reconcile.Result{}, kc.Update(ctx, secret)
+		})}
+		require.NoError(t, ctrl.NewControllerManagedBy(mgr).For(&corev1.Secret{}).Complete(recorder))
+		startManager(t, ctx, mgr)
+
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+
+		err = pollUntil(ctx, 100*time.Millisecond, timeout, func() (bool, error) {
+			return len(recorder.Events("default/secret-1")) > 20, nil
+		})
+		require.NoError(t, err)
+
+		require.Error(t, detectReconcileStorm(recorder.Events("default/secret-1"), 10, 5*time.Second))
+	})
+}
+
+// AssertReconcileError fails the test unless the last recorded reconcile of
+// the key returned an error that matches target with errors.Is, e.g.,
+// ErrConflict.
+func AssertReconcileError(t *testing.T, recorder *ReconcileRecorder, key string, target error) {
+	t.Helper()
+	err := checkReconcileError(recorder.Events(key), target)
+	if err != nil {
+		t.Errorf("unexpected reconcile error for %s: %v", key, err)
+	}
+}
+
+func checkReconcileError(events []ReconcileEvent, target error) error {
+	if len(events) == 0 {
+		return fmt.Errorf("never reconciled, expected the error %q", target)
+	}
+	last := events[len(events)-1]
+	if last.Err == nil {
+		return fmt.Errorf("the last reconcile succeeded, expected the error %q", target)
+	}
+	if !errors.Is(last.Err, target) {
+		return fmt.Errorf("the last reconcile returned %q, expected the error %q", last.Err, target)
+	}
+	return nil
+}
+
+func TestAssertReconcileError(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	key := types.NamespacedName{Name: "secret-1", Namespace: "default"}
+	recorder := &ReconcileRecorder{Reconciler: &AnnotatingReconciler{
+		Client: &conflictingClient{scheme: scheme},
+		Log:    logr.Discard(),
+	}}
+
+	require.Error(t, checkReconcileError(recorder.Events(key.String()), ErrConflict))
+
+	_, err = recorder.Reconcile(context.Background(), reconcile.Request{NamespacedName: key})
+	require.Error(t, err)
+	require.True(t, apierrors.IsConflict(err), "expected the apiserver's conflict to be kept, got: %v", err)
+
+	AssertReconcileError(t, recorder, key.String(), ErrConflict)
+	require.Error(t, checkReconcileError(recorder.Events(key.String()), context.DeadlineExceeded))
+}
+
+// conflictingClient returns an empty object on Get and rejects every Update
+// with a conflict, as the apiserver does when the object was read from a
+// stale cache. Only Get, Update and Scheme can be called.
+type conflictingClient struct {
+	client.Client
+	scheme *runtime.Scheme
+}
+
+func (c *conflictingClient) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	obj.SetName(key.Name)
+	obj.SetNamespace(key.Namespace)
+	obj.SetResourceVersion("1")
+	return nil
+}
+
+func (c *conflictingClient) Update(_ context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	return apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, obj.GetName(), errors.New("the object has been modified"))
+}
+
+func (c *conflictingClient) Scheme() *runtime.Scheme {
+	return c.scheme
+}
+
+func TestTimeToFirstReconcile(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	recorder := &ReconcileRecorder{Reconciler: &AnnotatingReconciler{
+		Client:            mgr.GetClient(),
+		Log:               logger,
+		RequeueOnNotFound: 100 * time.Millisecond,
+	}}
+	require.NoError(t, ctrl.NewControllerManagedBy(mgr).For(&corev1.Secret{}, builder.OnlyMetadata).Complete(recorder))
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	key := client.ObjectKeyFromObject(&secret).String()
+	_, ok := TimeToFirstReconcile(recorder, key)
+	require.False(t, ok, "the creation isn't recorded yet")
+
+	recorder.Created(key, time.Now())
+	require.NoError(t, kc.Create(ctx, &secret))
+
+	t.Log("Waiting for the first reconcile")
+	var latency time.Duration
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		latency, ok = TimeToFirstReconcile(recorder, key)
+		return ok, nil
+	}))
+	t.Logf("first reconcile %s after the creation", latency)
+	require.Greater(t, int64(latency), int64(0))
+	require.Less(t, int64(latency), int64(2*time.Second))
+}
+
+func TestWaitForReconcileCount(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	// Watching the full object rules out the stale reads, and ignoring the
+	// updates rules out the reconcile caused by the annotation: the Secret
+	// gets reconciled exactly once.
+	recorder := &ReconcileRecorder{}
+	err = (&AnnotatingReconciler{
+		Client:          mgr.GetClient(),
+		Log:             logger,
+		WatchFullObject: true,
+		OnlyCreates:     true,
+		Middlewares:     []Middleware{Recording(recorder)},
+	}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	key := client.ObjectKeyFromObject(&secret).String()
+	require.NoError(t, kc.Create(ctx, &secret))
+
+	require.NoError(t, WaitForReconcileCount(ctx, recorder, key, 1, 5*time.Second))
+	require.NoError(t, recorder.Events(key)[0].Err)
+
+	t.Log("No other reconcile should happen during the quiet period")
+	err = WaitForReconcileCount(ctx, recorder, key, 2, time.Second)
+	require.Error(t, err)
+	require.Len(t, recorder.Events(key), 1)
+}
+
+// AssertWorkqueueDrained waits until nothing was reconciled for the given
+// quiet period and fails the test if a reconcile is still going on after ten
+// quiet periods, which usually means that the reconciler is hot-looping. It
+// also fails the test when the last reconcile of a key asked to be requeued,
+// since the workqueue isn't empty then.
+func AssertWorkqueueDrained(t *testing.T, recorder *ReconcileRecorder, within time.Duration) {
+	t.Helper()
+	err := waitDrained(recorder, within, 10*within)
+	if err != nil {
+		t.Errorf("workqueue not drained: %v", err)
+	}
+}
+
+func waitDrained(recorder *ReconcileRecorder, quiet, timeout time.Duration) error {
+	err := wait.PollImmediate(10*time.Millisecond, timeout, func() (bool, error) {
+		end, running := recorder.LastReconcile()
+		return !running && time.Since(end) >= quiet, nil
+	})
+	if err != nil {
+		return fmt.Errorf("still reconciling after %s, expected %s without reconciles", timeout, quiet)
+	}
+
+	recorder.mu.Lock()
+	last := make(map[string]ReconcileEvent)
+	for _, e := range recorder.events {
+		last[e.Key] = e
+	}
+	recorder.mu.Unlock()
+
+	var pending []string
+	for key, e := range last {
+		if e.Err != nil || e.Result.Requeue || e.Result.RequeueAfter > 0 {
+			pending = append(pending, key)
+		}
+	}
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		return fmt.Errorf("pending requeues for %v", pending)
+	}
+	return nil
+}
+
+func TestAssertWorkqueueDrained(t *testing.T) {
+	t.Run("a hot-loop never drains", func(t *testing.T) {
+		recorder := &ReconcileRecorder{Reconciler: reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+			return reconcile.Result{}, nil
+		})}
+		req := reconcile.Request{NamespacedName: types.NamespacedName{Name: "secret-1", Namespace: "default"}}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		_, err := recorder.Reconcile(ctx, req)
+		require.NoError(t, err)
+		go func() {
+			for ctx.Err() == nil {
+				_, _ = recorder.Reconcile(ctx, req)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		require.Error(t, waitDrained(recorder, 100*time.Millisecond, 500*time.Millisecond))
+	})
+
+	t.Run("a pending requeue isn't drained", func(t *testing.T) {
+		recorder := &ReconcileRecorder{Reconciler: reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+			return reconcile.Result{RequeueAfter: time.Hour}, nil
+		})}
+		_, err := recorder.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "secret-1", Namespace: "default"}})
+		require.NoError(t, err)
+
+		err = waitDrained(recorder, 10*time.Millisecond, time.Second)
+		require.EqualError(t, err, "pending requeues for [default/secret-1]")
+	})
+
+	t.Run("the queue drains once the Secret is annotated", func(t *testing.T) {
+		logger := setupTestLogger(t)
+
+		scheme, err := BuildScheme(corev1.AddToScheme)
+		require.NoError(t, err)
+		rc := startTestEnv(t, scheme)
+
+		const timeout = 10 * time.Second
+		ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+		defer cancel()
+
+		kc, err := client.New(rc, client.Options{Scheme: scheme})
+		require.NoError(t, err)
+
+		mgr, err := ctrl.NewManager(rc, ctrl.Options{
+			Scheme:             scheme,
+			Logger:             logger,
+			MetricsBindAddress: "0",
+		})
+		require.NoError(t, err)
+		// Watching the full object rules out the stale reads that would
+		// requeue the Secret.
+		recorder := &ReconcileRecorder{}
+		err = (&AnnotatingReconciler{
+			Client:          mgr.GetClient(),
+			Log:             logger,
+			WatchFullObject: true,
+			Middlewares:     []Middleware{Recording(recorder)},
+		}).SetupWithManager(mgr)
+		require.NoError(t, err)
+		startManager(t, ctx, mgr)
+
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+
+		t.Log("Waiting for the Secret to be annotated")
+		require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+			err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+			if err != nil {
+				return false, err
+			}
+			return secret.Annotations["secret-found"] == "yes", nil
+		}))
+
+		AssertWorkqueueDrained(t, recorder, 500*time.Millisecond)
+	})
+}
+
+// AssertFair fails the test if the fairness score of the keys, as returned by
+// ReconcileFairness, is below minScore, which means that some objects got
+// reconciled a lot less often than others.
+func AssertFair(t *testing.T, recorder *ReconcileRecorder, keys []string, minScore float64) {
+	t.Helper()
+	score := ReconcileFairness(recorder, keys)
+	if score < minScore {
+		counts := make(map[string]int, len(keys))
+		for _, key := range keys {
+			counts[key] = len(recorder.Events(key))
+		}
+		t.Errorf("unfair reconciles: score %.2f below %.2f, reconcile counts: %v", score, minScore, counts)
+	}
+}
+
+func TestReconcileFairness(t *testing.T) {
+	record := func(recorder *ReconcileRecorder, name string, times int) {
+		for i := 0; i < times; i++ {
+			_, err := recorder.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: "default"}})
+			require.NoError(t, err)
+		}
+	}
+	noop := reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+		return reconcile.Result{}, nil
+	})
+
+	recorder := &ReconcileRecorder{Reconciler: noop}
+	require.Equal(t, 1.0, ReconcileFairness(recorder, nil))
+	require.Equal(t, 0.0, ReconcileFairness(recorder, []string{"default/a", "default/b"}))
+
+	record(recorder, "a", 4)
+	record(recorder, "b", 2)
+	require.Equal(t, 0.5, ReconcileFairness(recorder, []string{"default/a", "default/b"}))
+	require.Equal(t, 0.0, ReconcileFairness(recorder, []string{"default/a", "default/b", "default/c"}))
+	require.Equal(t, 1.0, ReconcileFairness(recorder, []string{"default/a"}))
+}
+
+// Each Secret requeues itself right away, and the workers are busy all the
+// time: the workqueue should still give every Secret its turn.
+func TestAssertFair(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 20*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	recorder := &ReconcileRecorder{Reconciler: reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) {
+		time.Sleep(5 * time.Millisecond)
+		return reconcile.Result{RequeueAfter: time.Millisecond}, nil
+	})}
+	err = ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Secret{}, builder.OnlyMetadata).
+		WithOptions(controller.Options{MaxConcurrentReconciles: 2}).
+		Complete(recorder)
+	require.NoError(t, err)
+
+	const count = 8
+	var keys []string
+	for i := 0; i < count; i++ {
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("secret-%d", i), Namespace: "default"}}
+		require.NoError(t, kc.Create(ctx, &secret))
+		keys = append(keys, client.ObjectKeyFromObject(&secret).String())
+	}
+
+	startManager(t, ctx, mgr)
+	for _, key := range keys {
+		require.NoError(t, WaitForReconcileCount(ctx, recorder, key, 20, 10*time.Second))
+	}
+
+	t.Logf("Fairness score: %.2f", ReconcileFairness(recorder, keys))
+	AssertFair(t, recorder, keys, 0.5)
+}
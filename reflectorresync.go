@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SetReflectorResync makes the reflector of the informer of obj resync every
+// period, independently of the manager's SyncPeriod, and adds handler, if not
+// nil, with that resync period. The field that ends up changed is the
+// resyncCheckPeriod of client-go's sharedIndexInformer, which the informer
+// passes to its reflector as cache.Config.FullResyncPeriod: adding a handler
+// whose resync period is shorter than resyncCheckPeriod lowers it, but only as
+// long as the informer hasn't started. It must thus be called before the
+// manager starts; later on, client-go logs a warning and keeps the period it
+// had. The informer's other handlers, e.g., the controllers', still get their
+// resyncs every SyncPeriod.
+//
+// A resync replays the objects that the informer's store already has, as
+// update events whose old and new objects are the same; it doesn't read
+// anything from the apiserver, which means that it can't fix a stale entry.
+// Besides, the reflector only resyncs while its watch is running: when the
+// watch breaks, which is when the cache falls behind for more than a moment,
+// the resyncs stop too, and the relist that follows is what catches up.
+func SetReflectorResync(ctx context.Context, informers cache.Informers, obj client.Object, period time.Duration, handler toolscache.ResourceEventHandler) error {
+	informer, err := informers.GetInformer(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("while getting the informer for %T: %w", obj, err)
+	}
+	if handler == nil {
+		handler = toolscache.ResourceEventHandlerFuncs{}
+	}
+	informer.AddEventHandlerWithResyncPeriod(handler, period)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestSetReflectorResync(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 20 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	partitioner := &Partitioner{}
+	requests := &RequestCounter{}
+	mgr, err := ctrl.NewManager(partitioner.Wrap(requests.Wrap(rc)), ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+
+	// A resync is an update whose old and new objects are the same.
+	var mu sync.Mutex
+	resyncedRVs := map[string]int{}
+	resyncs := func(rv string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return resyncedRVs[rv]
+	}
+	const period = 200 * time.Millisecond
+	err = SetReflectorResync(ctx, mgr.GetCache(), &corev1.Secret{}, period, toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSecret, newSecret := oldObj.(*corev1.Secret), newObj.(*corev1.Secret)
+			if oldSecret.ResourceVersion == newSecret.ResourceVersion {
+				mu.Lock()
+				resyncedRVs[newSecret.ResourceVersion]++
+				mu.Unlock()
+			}
+		},
+	})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+	staleRV := secret.ResourceVersion
+
+	t.Log("Waiting for a few resyncs, far more often than the default SyncPeriod of 10 hours")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return resyncs(staleRV) >= 3, nil
+	}))
+	stale := secret.DeepCopy()
+
+	t.Log("Updating the Secret and waiting for the cache to catch up")
+	secret.Labels = map[string]string{"foo": "bar"}
+	require.NoError(t, kc.Update(ctx, &secret))
+	var fromCache corev1.Secret
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := mgr.GetClient().Get(ctx, key, &fromCache)
+		return fromCache.ResourceVersion == secret.ResourceVersion, err
+	}))
+
+	// With a healthy watch, the cache only gets stale for a moment, which is
+	// why the stale version is put back into the informer's store by hand.
+	t.Log("Even with a healthy watch, a resync replays the stale object without asking the apiserver")
+	informer, err := mgr.GetCache().GetInformer(ctx, &corev1.Secret{})
+	require.NoError(t, err)
+	withStore, ok := informer.(interface{ GetStore() toolscache.Store })
+	require.True(t, ok, "the informer %T does not expose its store", informer)
+	lists := requests.Count("list", "secrets")
+	before := resyncs(staleRV)
+	require.NoError(t, withStore.GetStore().Update(stale))
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return resyncs(staleRV) >= before+3, nil
+	}))
+	require.NoError(t, mgr.GetClient().Get(ctx, key, &fromCache))
+	require.Equal(t, staleRV, fromCache.ResourceVersion)
+	require.Equal(t, lists, requests.Count("list", "secrets"), "a resync should not list")
+
+	t.Log("Updating the Secret while the watch is cut")
+	partitioner.SimulatePartition(2 * time.Second)
+	secret.Labels = map[string]string{"foo": "baz"}
+	require.NoError(t, kc.Update(ctx, &secret))
+	before = resyncs(staleRV)
+	time.Sleep(time.Second)
+
+	t.Log("The reflector doesn't resync while its watch is broken, and the cache stays stale")
+	require.Equal(t, before, resyncs(staleRV))
+	require.NoError(t, mgr.GetClient().Get(ctx, key, &fromCache))
+	require.Equal(t, staleRV, fromCache.ResourceVersion)
+
+	t.Log("Only the relist that follows the partition catches up")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := mgr.GetClient().Get(ctx, key, &fromCache)
+		return fromCache.ResourceVersion == secret.ResourceVersion, err
+	}))
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return resyncs(secret.ResourceVersion) >= 1, nil
+	}))
+}
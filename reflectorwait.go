@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// WaitForBothReflectors waits until the Secret with the given key, of the form
+// "namespace/name", is at the resourceVersion rv or a newer one in both
+// primary, read as a Secret, and secondary, read as its metadata. With
+// mgr.GetCache() passed for both, these are the two reflectors of the race,
+// the concrete one and the metadata one, and the race is over once
+// WaitForBothReflectors returns. It returns an error naming the cache that
+// lagged behind when ctx is done or the timeout expires first. Comparing the
+// resourceVersions assumes that they are numbers, see olderThan.
+func WaitForBothReflectors(ctx context.Context, primary, secondary cache.Cache, key, rv string, timeout time.Duration) error {
+	namespace, name, err := toolscache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return fmt.Errorf("while parsing the key %q: %w", key, err)
+	}
+	objKey := client.ObjectKey{Namespace: namespace, Name: name}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var primaryRV, secondaryRV string
+	err = wait.PollImmediateUntil(10*time.Millisecond, func() (bool, error) {
+		var secret corev1.Secret
+		primaryRV, err = cachedResourceVersion(ctx, primary, objKey, &secret)
+		if err != nil {
+			return false, fmt.Errorf("while reading %s from the primary cache: %w", key, err)
+		}
+		meta := &metav1.PartialObjectMetadata{}
+		meta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+		secondaryRV, err = cachedResourceVersion(ctx, secondary, objKey, meta)
+		if err != nil {
+			return false, fmt.Errorf("while reading %s from the secondary cache: %w", key, err)
+		}
+		return atLeast(primaryRV, rv) && atLeast(secondaryRV, rv), nil
+	}, ctx.Done())
+	switch {
+	case err == nil:
+		return nil
+	case !errors.Is(err, wait.ErrWaitTimeout):
+		return err
+	case !atLeast(primaryRV, rv) && !atLeast(secondaryRV, rv):
+		return fmt.Errorf("while waiting for %s to reach the resourceVersion %s in both caches, both lagged behind (%q in primary, %q in secondary): %w", key, rv, primaryRV, secondaryRV, err)
+	case !atLeast(primaryRV, rv):
+		return fmt.Errorf("while waiting for %s to reach the resourceVersion %s in both caches, the primary cache lagged behind at %q: %w", key, rv, primaryRV, err)
+	case !atLeast(secondaryRV, rv):
+		return fmt.Errorf("while waiting for %s to reach the resourceVersion %s in both caches, the secondary cache lagged behind at %q: %w", key, rv, secondaryRV, err)
+	default:
+		return err
+	}
+}
+
+// cachedResourceVersion returns the resourceVersion of the object in the
+// cache, or an empty string when the cache doesn't have it.
+func cachedResourceVersion(ctx context.Context, c client.Reader, key client.ObjectKey, obj client.Object) (string, error) {
+	err := c.Get(ctx, key, obj)
+	switch {
+	case apierrors.IsNotFound(err):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	return obj.GetResourceVersion(), nil
+}
+
+// atLeast tells whether the resourceVersion got is rv or a newer one. An
+// empty got, i.e., a missing object, is never recent enough.
+func atLeast(got, rv string) bool {
+	return got != "" && (got == rv || olderThan(rv, got))
+}
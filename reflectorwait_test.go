@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// The primary cache is partitioned from the apiserver for a while, which
+// makes it lag behind the secondary one.
+func TestWaitForBothReflectors(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 20 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	partitioner := &Partitioner{}
+	startMgr := func(rc *rest.Config) manager.Manager {
+		mgr, err := ctrl.NewManager(rc, ctrl.Options{
+			Scheme:             scheme,
+			Logger:             logger,
+			MetricsBindAddress: "0",
+		})
+		require.NoError(t, err)
+		// Both informers must be running before the update.
+		_, err = mgr.GetCache().GetInformer(ctx, &corev1.Secret{})
+		require.NoError(t, err)
+		meta := &metav1.PartialObjectMetadata{}
+		meta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+		_, err = mgr.GetCache().GetInformer(ctx, meta)
+		require.NoError(t, err)
+		startManager(t, ctx, mgr)
+		return mgr
+	}
+	primary := startMgr(partitioner.Wrap(rc)).GetCache()
+	secondary := startMgr(rc).GetCache()
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret).String()
+	require.NoError(t, WaitForBothReflectors(ctx, primary, secondary, key, secret.ResourceVersion, 5*time.Second))
+
+	partitioner.SimulatePartition(2 * time.Second)
+	secret.Labels = map[string]string{"foo": "bar"}
+	require.NoError(t, kc.Update(ctx, &secret))
+
+	t.Log("The primary cache can't see the update during the partition")
+	err = WaitForBothReflectors(ctx, primary, secondary, key, secret.ResourceVersion, 500*time.Millisecond)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the primary cache lagged behind")
+
+	t.Log("Both caches should agree once the partition heals")
+	require.NoError(t, WaitForBothReflectors(ctx, primary, secondary, key, secret.ResourceVersion, 15*time.Second))
+	var fromPrimary corev1.Secret
+	require.NoError(t, primary.Get(ctx, client.ObjectKeyFromObject(&secret), &fromPrimary))
+	fromSecondary := &metav1.PartialObjectMetadata{}
+	fromSecondary.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+	require.NoError(t, secondary.Get(ctx, client.ObjectKeyFromObject(&secret), fromSecondary))
+	require.Equal(t, secret.ResourceVersion, fromPrimary.ResourceVersion)
+	require.Equal(t, fromPrimary.ResourceVersion, fromSecondary.ResourceVersion)
+	require.Equal(t, secret.Labels, fromPrimary.Labels)
+
+	t.Run("a resourceVersion that doesn't exist yet", func(t *testing.T) {
+		rv, err := strconv.Atoi(secret.ResourceVersion)
+		require.NoError(t, err)
+		err = WaitForBothReflectors(ctx, primary, secondary, key, strconv.Itoa(rv+1000), 100*time.Millisecond)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "both lagged behind")
+	})
+}
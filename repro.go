@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+)
+
+// GenerateReproScript returns the source of a self-contained Go program that
+// reproduces the scenario that RunScenario runs with the same config: the
+// controller watches the Secrets using the metadata projection, the reconciler
+// reads the concrete Secret and annotates it, and the program waits for the
+// annotation to show up. The program reads the kubeconfig the same way
+// kubectl does, so it can be attached as is to an upstream bug report. The
+// defaults are applied the same way as in RunScenario.
+func GenerateReproScript(cfg ScenarioConfig) string {
+	cfg = cfg.withDefaults()
+
+	var b strings.Builder
+	err := reproTemplate.Execute(&b, struct {
+		ScenarioConfig
+		Key, Value string
+	}{cfg, "secret-found", "yes"})
+	if err != nil {
+		// The template and its data are fixed, an error is a bug.
+		panic("while executing the repro template: " + err.Error())
+	}
+	return b.String()
+}
+
+var reproTemplate = template.Must(template.New("repro").Parse(`// Command repro reproduces a stale read in controller-runtime: the reconciler
+// is triggered by the metadata-only informer, but it reads the Secret from the
+// v1.Secret informer, which may not have received the Secret yet.
+//
+// Generated by GenerateReproScript with namespace={{ .Namespace }},
+// name={{ .Name }}, timeout={{ .Timeout }}, requeueOnStale={{ .RequeueOnStale }}.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2/klogr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	namespace      = {{ printf "%q" .Namespace }}
+	name           = {{ printf "%q" .Name }}
+	annotationKey  = {{ printf "%q" .Key }}
+	annotationVal  = {{ printf "%q" .Value }}
+	timeout        = time.Duration({{ printf "%d" .Timeout }})
+	requeueOnStale = time.Duration({{ printf "%d" .RequeueOnStale }})
+)
+
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	log := klogr.New()
+	ctrl.SetLogger(log)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rc, err := ctrl.GetConfig()
+	if err != nil {
+		return fmt.Errorf("while loading the kubeconfig: %w", err)
+	}
+	kc, err := client.New(rc, client.Options{})
+	if err != nil {
+		return fmt.Errorf("while creating the uncached client: %w", err)
+	}
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{MetricsBindAddress: "0"})
+	if err != nil {
+		return fmt.Errorf("while creating the manager: %w", err)
+	}
+
+	err = ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Secret{}, builder.OnlyMetadata).
+		Complete(reconcile.Func(func(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+			var secret corev1.Secret
+			err := mgr.GetClient().Get(ctx, req.NamespacedName, &secret)
+			if apierrors.IsNotFound(err) {
+				log.Info("secret not found in the cache, the race happened", "secret", req.NamespacedName)
+				return reconcile.Result{RequeueAfter: requeueOnStale}, nil
+			}
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			if secret.Annotations[annotationKey] == annotationVal {
+				return reconcile.Result{}, nil
+			}
+			if secret.Annotations == nil {
+				secret.Annotations = map[string]string{}
+			}
+			secret.Annotations[annotationKey] = annotationVal
+			return reconcile.Result{}, mgr.GetClient().Update(ctx, &secret)
+		}))
+	if err != nil {
+		return fmt.Errorf("while completing new controller: %w", err)
+	}
+
+	go func() {
+		_ = mgr.Start(ctx)
+	}()
+
+	// The v1.Secret informer must already be running when the ADDED event
+	// comes in for the race to happen.
+	_ = mgr.GetClient().Get(ctx, types.NamespacedName{}, &corev1.Secret{})
+	time.Sleep(300 * time.Millisecond)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	err = kc.Create(ctx, &secret)
+	if err != nil {
+		return fmt.Errorf("while creating the Secret: %w", err)
+	}
+	defer func() {
+		_ = kc.Delete(context.Background(), &secret)
+	}()
+
+	err = wait.PollImmediateUntil(10*time.Millisecond, func() (bool, error) {
+		err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+		if err != nil {
+			return false, err
+		}
+		return secret.Annotations[annotationKey] == annotationVal, nil
+	}, ctx.Done())
+	if err != nil {
+		return fmt.Errorf("the Secret never got the annotation %s=%s: %w", annotationKey, annotationVal, err)
+	}
+
+	fmt.Println("the Secret got annotated, the race did not prevent the reconciliation")
+	return nil
+}
+`))
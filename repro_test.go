@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateReproScript(t *testing.T) {
+	script := GenerateReproScript(ScenarioConfig{
+		Namespace:      "repro",
+		Name:           "secret-42",
+		Timeout:        5 * time.Second,
+		RequeueOnStale: 100 * time.Millisecond,
+	})
+
+	vetReproScript(t, script)
+	require.Contains(t, script, `namespace      = "repro"`)
+	require.Contains(t, script, `name           = "secret-42"`)
+	require.Contains(t, script, `annotationKey  = "secret-found"`)
+	require.Contains(t, script, `annotationVal  = "yes"`)
+	require.Contains(t, script, "requeueOnStale = time.Duration(100000000)")
+}
+
+func TestGenerateReproScript_Defaults(t *testing.T) {
+	script := GenerateReproScript(ScenarioConfig{})
+
+	vetReproScript(t, script)
+	require.Contains(t, script, `namespace      = "default"`)
+	require.Contains(t, script, `name           = "secret-1"`)
+	require.Contains(t, script, "timeout        = time.Duration(10000000000)")
+}
+
+// vetReproScript runs go vet on the script in a module that has the same
+// dependencies as this one, which type-checks it: parsing alone doesn't catch
+// a missing import.
+func vetReproScript(t *testing.T, script string) {
+	t.Helper()
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for _, name := range []string{"go.mod", "go.sum"} {
+		b, err := os.ReadFile(filepath.Join(wd, name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), b, 0o644))
+	}
+	require.NoError(t, os.Symlink(filepath.Join(wd, "vendor"), filepath.Join(dir, "vendor")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte(script), 0o644))
+
+	cmd := exec.Command("go", "vet", ".")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "go vet on the generated script:\n%s", out)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/rest"
+)
+
+// RequestKind is what a request to the apiserver does: its verb, e.g., "get",
+// "list" or "watch", and its resource, e.g., "secrets" or "secrets/status".
+// The resource is empty for the requests that aren't about a resource, such as
+// the discovery ones.
+type RequestKind struct {
+	Verb, Resource string
+}
+
+// RequestCounter counts the requests made by the clients built from the
+// rest.Config returned by Wrap, per RequestKind. They are also counted in
+// the cacherace_apiserver_requests_total metric. Its zero value is ready to
+// use.
+type RequestCounter struct {
+	mu     sync.Mutex
+	counts map[RequestKind]int
+}
+
+// Wrap returns a copy of rc whose requests get counted.
+func (c *RequestCounter) Wrap(rc *rest.Config) *rest.Config {
+	rc = rest.CopyConfig(rc)
+	rc.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return requestCountingRoundTripper{next: rt, c: c}
+	})
+	return rc
+}
+
+// Count returns the number of requests with the given verb and resource.
+func (c *RequestCounter) Count(verb, resource string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[RequestKind{Verb: verb, Resource: resource}]
+}
+
+// Counts returns a copy of all the counts.
+func (c *RequestCounter) Counts() map[RequestKind]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[RequestKind]int, len(c.counts))
+	for kind, n := range c.counts {
+		counts[kind] = n
+	}
+	return counts
+}
+
+func (c *RequestCounter) add(kind RequestKind) {
+	c.mu.Lock()
+	if c.counts == nil {
+		c.counts = make(map[RequestKind]int)
+	}
+	c.counts[kind]++
+	c.mu.Unlock()
+	apiserverRequests.WithLabelValues(kind.Verb, kind.Resource).Inc()
+}
+
+type requestCountingRoundTripper struct {
+	next http.RoundTripper
+	c    *RequestCounter
+}
+
+func (rt requestCountingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.c.add(classifyRequest(req))
+	return rt.next.RoundTrip(req)
+}
+
+// classifyRequest works out the verb and the resource from the path, e.g.,
+// /api/v1/namespaces/default/secrets/secret-1 or /apis/cacherace.io/v1alpha1/widgets,
+// the same way the apiserver does, minus the corner cases.
+func classifyRequest(req *http.Request) RequestKind {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	var segments []string
+	switch {
+	case len(parts) >= 2 && parts[0] == "api":
+		segments = parts[2:]
+	case len(parts) >= 3 && parts[0] == "apis":
+		segments = parts[3:]
+	}
+	// The namespaces are a resource of their own, e.g., /api/v1/namespaces/ns-1.
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		segments = segments[2:]
+	}
+
+	kind := RequestKind{}
+	if len(segments) > 0 {
+		kind.Resource = segments[0]
+	}
+	if len(segments) > 2 {
+		kind.Resource += "/" + segments[2]
+	}
+	named := len(segments) > 1
+
+	switch req.Method {
+	case http.MethodGet:
+		switch {
+		case req.URL.Query().Get("watch") == "true" || req.URL.Query().Get("watch") == "1":
+			kind.Verb = "watch"
+		case named || kind.Resource == "":
+			kind.Verb = "get"
+		default:
+			kind.Verb = "list"
+		}
+	case http.MethodPost:
+		kind.Verb = "create"
+	case http.MethodPut:
+		kind.Verb = "update"
+	case http.MethodPatch:
+		kind.Verb = "patch"
+	case http.MethodDelete:
+		kind.Verb = "delete"
+		if !named {
+			kind.Verb = "deletecollection"
+		}
+	default:
+		kind.Verb = strings.ToLower(req.Method)
+	}
+	return kind
+}
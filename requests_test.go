@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	tests := []struct {
+		method, url string
+		want        RequestKind
+	}{
+		{method: "GET", url: "/api/v1/namespaces/default/secrets/secret-1", want: RequestKind{"get", "secrets"}},
+		{method: "GET", url: "/api/v1/namespaces/default/secrets", want: RequestKind{"list", "secrets"}},
+		{method: "GET", url: "/api/v1/secrets?limit=500", want: RequestKind{"list", "secrets"}},
+		{method: "GET", url: "/api/v1/secrets?allowWatchBookmarks=true&watch=true", want: RequestKind{"watch", "secrets"}},
+		{method: "PUT", url: "/api/v1/namespaces/default/secrets/secret-1", want: RequestKind{"update", "secrets"}},
+		{method: "PATCH", url: "/api/v1/namespaces/default/secrets/secret-1", want: RequestKind{"patch", "secrets"}},
+		{method: "POST", url: "/api/v1/namespaces/default/secrets", want: RequestKind{"create", "secrets"}},
+		{method: "DELETE", url: "/api/v1/namespaces/default/secrets", want: RequestKind{"deletecollection", "secrets"}},
+		{method: "PUT", url: "/apis/cacherace.io/v1alpha1/namespaces/default/widgets/widget-1/status", want: RequestKind{"update", "widgets/status"}},
+		{method: "GET", url: "/api/v1/namespaces/ns-1", want: RequestKind{"get", "namespaces"}},
+		{method: "GET", url: "/apis/cacherace.io/v1alpha1", want: RequestKind{"get", ""}},
+		{method: "GET", url: "/version", want: RequestKind{"get", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "https://127.0.0.1:6443"+tt.url, nil)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, classifyRequest(req))
+		})
+	}
+}
+
+func TestRequestCounter(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	// The reconciler has no UseAPIReader switch, reading live means setting
+	// ReadFrom to mgr.GetAPIReader().
+	tests := []struct {
+		name         string
+		useAPIReader bool
+	}{
+		{name: "cache", useAPIReader: false},
+		{name: "apireader", useAPIReader: true},
+	}
+	gets := map[string]int{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+			defer cancel()
+
+			requests := &RequestCounter{}
+			mgr, err := ctrl.NewManager(requests.Wrap(rc), ctrl.Options{
+				Scheme:             scheme,
+				Logger:             logger,
+				MetricsBindAddress: "0",
+			})
+			require.NoError(t, err)
+			r := &AnnotatingReconciler{
+				Client:         mgr.GetClient(),
+				Log:            logger,
+				Name:           tt.name,
+				RequeueOnStale: 100 * time.Millisecond,
+			}
+			if tt.useAPIReader {
+				r.ReadFrom = mgr.GetAPIReader()
+			}
+			require.NoError(t, r.SetupWithManager(mgr))
+			startManager(t, ctx, mgr)
+
+			secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-" + tt.name, Namespace: "default"}}
+			require.NoError(t, kc.Create(ctx, &secret))
+			require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 5*time.Second, func() (bool, error) {
+				err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+				return secret.Annotations["secret-found"] == "yes", err
+			}))
+
+			// The write triggers another reconcile, which writes again if it
+			// reads the version that precedes the write.
+			require.GreaterOrEqual(t, requests.Count("update", "secrets"), 1)
+			gets[tt.name] = requests.Count("get", "secrets")
+			t.Logf("Requests: %v", requests.Counts())
+		})
+	}
+
+	require.Zero(t, gets["cache"], "the cache-only path shouldn't GET the Secrets")
+	require.Greater(t, gets["apireader"], gets["cache"])
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestResourceVersionReader(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 30*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+	mapper, err := apiutil.NewDynamicRESTMapper(rc)
+	require.NoError(t, err)
+	anyRV := NewResourceVersionReader(rc, scheme, mapper, ResourceVersionAny)
+	quorum := NewResourceVersionReader(rc, scheme, mapper, ResourceVersionQuorum)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+
+	t.Run("the reconciler reads through it", func(t *testing.T) {
+		r := &AnnotatingReconciler{Client: kc, Log: logger, ReadFrom: quorum}
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+		require.NoError(t, err)
+		require.NoError(t, kc.Get(ctx, key, &secret))
+		require.Equal(t, "yes", secret.Annotations["secret-found"])
+	})
+
+	t.Run("resourceVersion=0 is served from the watch cache", func(t *testing.T) {
+		// The watch cache ignores the limit, etcd doesn't, which tells
+		// where a list was served from.
+		for _, name := range []string{"secret-2", "secret-3"} {
+			require.NoError(t, kc.Create(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}))
+		}
+		var list corev1.SecretList
+		require.NoError(t, anyRV.List(ctx, &list, client.InNamespace("default"), client.Limit(1)))
+		require.Greater(t, len(list.Items), 1)
+		require.NoError(t, quorum.List(ctx, &list, client.InNamespace("default"), client.Limit(1)))
+		require.Len(t, list.Items, 1)
+	})
+
+	t.Run("the quorum read is never stale", func(t *testing.T) {
+		// The watch cache of a local apiserver catches up with etcd faster
+		// than the next request comes in, which means the resourceVersion=0
+		// reads are rarely stale in envtest: they are only counted.
+		const writes = 200
+		staleAny, staleQuorum := 0, 0
+		for i := 0; i < writes; i++ {
+			secret.Labels = map[string]string{"write": strconv.Itoa(i)}
+			require.NoError(t, kc.Update(ctx, &secret))
+
+			var got corev1.Secret
+			require.NoError(t, anyRV.Get(ctx, key, &got))
+			if olderThan(got.ResourceVersion, secret.ResourceVersion) {
+				staleAny++
+			}
+			require.NoError(t, quorum.Get(ctx, key, &got))
+			if got.ResourceVersion != secret.ResourceVersion {
+				staleQuorum++
+			}
+		}
+		t.Logf("Stale reads out of %d: %d with resourceVersion=0, %d with a quorum read", writes, staleAny, staleQuorum)
+		require.Zero(t, staleQuorum)
+	})
+}
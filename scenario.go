@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ScenarioConfig configures RunScenario. Only RestConfig is required.
+type ScenarioConfig struct {
+	RestConfig *rest.Config
+	Log        logr.Logger // Defaults to logr.Discard().
+
+	// Namespace and Name are the Secret that gets created. Default to
+	// default/secret-1. The namespace must exist.
+	Namespace, Name string
+
+	// Timeout is how long to wait for the Secret to be annotated and for the
+	// cache to catch up. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// RequeueOnStale is passed to the AnnotatingReconciler. When left to
+	// zero, a stale read means the Secret never gets annotated and
+	// RunScenario times out.
+	RequeueOnStale time.Duration
+
+	// DataSizeBytes pads the Secret with that many bytes of data. Large
+	// objects take longer to decode and to go through the informers, which
+	// may widen the race window. The apiserver rejects Secrets larger than
+	// 1MiB. Defaults to no data at all.
+	DataSizeBytes int
+
+	// DisableWatchBookmarks makes the manager's informers watch without
+	// bookmarks. See WithoutWatchBookmarks.
+	DisableWatchBookmarks bool
+
+	// RunLabel, when set, is the value of the RunLabelKey label on the
+	// Secret, so that CleanupByLabel can remove the Secrets left by a series
+	// of runs.
+	RunLabel string
+
+	// Impersonate, when its UserName is set, makes the manager act as that
+	// user, as a controller running under its own identity would. The
+	// Secret is still created with RestConfig as is. The user must be
+	// allowed to list, watch and update the Secrets.
+	Impersonate rest.ImpersonationConfig
+
+	// ClientQPS and ClientBurst, when non-zero, replace the QPS and Burst
+	// of the manager's client, which the client-go rate limiter enforces
+	// before the apiserver's priority and fairness gets a chance to throttle
+	// the requests. A negative ClientQPS disables the rate limiting. The
+	// client used to create and poll the Secret is left as is.
+	ClientQPS   float32
+	ClientBurst int
+
+	// ClientWiring is how the manager's client splits the reads from the
+	// writes, see NewClientFunc. With ClientWiringDirect, the reconciler
+	// reads from the apiserver, which means no stale read can happen.
+	ClientWiring ClientWiring
+}
+
+func (cfg ScenarioConfig) withDefaults() ScenarioConfig {
+	if cfg.Log == nil {
+		cfg.Log = logr.Discard()
+	}
+	if cfg.Namespace == "" {
+		cfg.Namespace = "default"
+	}
+	if cfg.Name == "" {
+		cfg.Name = "secret-1"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	return cfg
+}
+
+// managerConfig returns the rest.Config of the manager, which is RestConfig
+// with the knobs of cfg applied.
+func (cfg ScenarioConfig) managerConfig() *rest.Config {
+	mgrConfig := cfg.RestConfig
+	if cfg.DisableWatchBookmarks {
+		mgrConfig = WithoutWatchBookmarks(mgrConfig)
+	}
+	mgrConfig = rest.CopyConfig(mgrConfig)
+	mgrConfig.UserAgent = ManagerUserAgent
+	if cfg.Impersonate.UserName != "" {
+		mgrConfig.Impersonate = cfg.Impersonate
+	}
+	if cfg.ClientQPS != 0 {
+		mgrConfig.QPS = cfg.ClientQPS
+	}
+	if cfg.ClientBurst != 0 {
+		mgrConfig.Burst = cfg.ClientBurst
+	}
+	return mgrConfig
+}
+
+// ManagerUserAgent is the user agent of the manager started by RunScenario,
+// which tells its requests apart from the ones made to create and poll the
+// Secret.
+const ManagerUserAgent = "cacherace-manager"
+
+// Report is what RunScenario observed.
+type Report struct {
+	// StaleReadObserved is true when the reconciler's Get returned something
+	// older than what the apiserver had at the time, including nothing at all.
+	StaleReadObserved bool
+
+	// FirstStaleRead is the first stale read, when StaleReadObserved is
+	// true.
+	FirstStaleRead StaleRead
+
+	// Incidents are all the stale reads, in the order in which they
+	// happened.
+	Incidents []Incident
+
+	// MaxSkew is the largest number of versions of the Secret that the cache
+	// was behind when the reconciler read it. A Secret missing from the cache
+	// counts as at least one version behind.
+	MaxSkew int
+
+	// ReconcileCount is the number of times the Secret got reconciled.
+	ReconcileCount int
+
+	// TimeToConverge is the time between the creation of the Secret and the
+	// moment both the apiserver and the cache have the annotation.
+	TimeToConverge time.Duration
+}
+
+// StaleRead is a read of the Secret that returned an older version than the
+// ones known to exist at the time.
+type StaleRead struct {
+	// ResourceVersion is what the reconciler's Get returned, empty when the
+	// Secret couldn't be found.
+	ResourceVersion string
+
+	// Known are the resourceVersions of the Secret known to exist by then,
+	// i.e., the one returned on creation and the ones written so far. It is
+	// empty when the reconciler got NotFound before RunScenario recorded the
+	// version returned on creation.
+	Known []string
+}
+
+// RunScenario runs the reproducer end to end: it starts a manager that runs
+// the AnnotatingReconciler, creates a Secret, waits until the annotation shows
+// up in both the apiserver and the cache, and reports what happened in
+// between. The manager is stopped before RunScenario returns. When the Secret
+// doesn't converge in time, the Report gathered so far is returned along with
+// the error.
+func RunScenario(ctx context.Context, cfg ScenarioConfig) (Report, error) {
+	cfg = cfg.withDefaults()
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	if err != nil {
+		return Report{}, err
+	}
+	kc, err := client.New(cfg.RestConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return Report{}, fmt.Errorf("while creating the uncached client: %w", err)
+	}
+	newClient, err := NewClientFunc(cfg.ClientWiring)
+	if err != nil {
+		return Report{}, err
+	}
+	mgr, err := ctrl.NewManager(cfg.managerConfig(), ctrl.Options{
+		Scheme:             scheme,
+		Logger:             cfg.Log,
+		MetricsBindAddress: "0",
+		NewClient:          newClient,
+	})
+	if err != nil {
+		return Report{}, fmt.Errorf("while creating the manager: %w", err)
+	}
+
+	key := types.NamespacedName{Namespace: cfg.Namespace, Name: cfg.Name}
+	skew := &skewClient{Client: mgr.GetClient(), key: key, cacheName: "v1.Secret"}
+	recorder := &ReconcileRecorder{Reconciler: &AnnotatingReconciler{
+		Client:         skew,
+		Log:            cfg.Log,
+		RequeueOnStale: cfg.RequeueOnStale,
+	}}
+	err = ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Secret{}, builder.OnlyMetadata).
+		Complete(recorder)
+	if err != nil {
+		return Report{}, fmt.Errorf("while completing new controller: %w", err)
+	}
+
+	mgrCtx, stop := context.WithCancel(ctx)
+	mgrErr := make(chan error, 1)
+	go func() {
+		mgrErr <- mgr.Start(mgrCtx)
+	}()
+	defer func() {
+		stop()
+		<-mgrErr
+	}()
+
+	// Same as in Test_secretController: the v1.Secret informer must already
+	// be running when the ADDED event comes in for the race to happen.
+	_ = mgr.GetClient().Get(ctx, types.NamespacedName{}, &corev1.Secret{})
+	time.Sleep(300 * time.Millisecond)
+
+	secret := paddedSecret(key.Namespace, key.Name, cfg.DataSizeBytes)
+	if cfg.RunLabel != "" {
+		secret.Labels = map[string]string{RunLabelKey: cfg.RunLabel}
+	}
+	created := time.Now()
+	err = kc.Create(ctx, secret)
+	if err != nil {
+		return Report{}, fmt.Errorf("while creating Secret %s: %w", key, err)
+	}
+	skew.addVersion(secret.ResourceVersion)
+
+	err = PollLogged(ctx, cfg.Log, 10*time.Millisecond, cfg.Timeout, func() (bool, error) {
+		var fromAPI, fromCache corev1.Secret
+		err := kc.Get(ctx, key, &fromAPI)
+		if err != nil {
+			return false, err
+		}
+		if fromAPI.Annotations["secret-found"] != "yes" {
+			return false, nil
+		}
+		skew.addVersion(fromAPI.ResourceVersion)
+
+		err = mgr.GetClient().Get(ctx, key, &fromCache)
+		switch {
+		case apierrors.IsNotFound(err):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+		if fromCache.ResourceVersion != fromAPI.ResourceVersion {
+			return false, nil
+		}
+
+		// The annotation may be visible before the recorder is done with
+		// the reconcile that added it.
+		return len(recorder.Events(key.String())) > 0, nil
+	})
+	timeToConverge := time.Since(created)
+
+	stale, firstStale, maxSkew := skew.observed()
+	report := Report{
+		StaleReadObserved: stale,
+		FirstStaleRead:    firstStale,
+		Incidents:         skew.Incidents(),
+		MaxSkew:           maxSkew,
+		ReconcileCount:    len(recorder.Events(key.String())),
+	}
+	if err != nil {
+		return report, fmt.Errorf("while waiting for Secret %s to converge: %w", key, err)
+	}
+	report.TimeToConverge = timeToConverge
+
+	return report, nil
+}
+
+// skewClient compares what the cache returns for the Secret key with the
+// versions of that Secret known to exist so far, i.e., the one returned on
+// creation and the ones written by the reconciler. Each stale read is recorded
+// as an Incident of the cache with the given name.
+type skewClient struct {
+	client.Client
+	key       types.NamespacedName
+	cacheName string
+
+	mu         sync.Mutex
+	versions   []string
+	stale      bool
+	firstStale StaleRead
+	maxSkew    int
+	incidents  []Incident
+}
+
+func (c *skewClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	err := c.Client.Get(ctx, key, obj)
+	// The reconciler also reads the metadata cache when RequeueOnStale is
+	// set; only the reads from the concrete v1.Secret cache matter here.
+	_, isSecret := obj.(*corev1.Secret)
+	if !isSecret || key != c.key || (err != nil && !apierrors.IsNotFound(err)) {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	skew := 0
+	if err != nil {
+		skew = len(c.versions)
+		if skew == 0 {
+			skew = 1
+		}
+	} else {
+		for _, v := range c.versions {
+			if olderThan(obj.GetResourceVersion(), v) {
+				skew++
+			}
+		}
+	}
+	seen := ""
+	if err == nil {
+		seen = obj.GetResourceVersion()
+	}
+	if skew > 0 && !c.stale {
+		c.stale = true
+		c.firstStale = StaleRead{ResourceVersion: seen, Known: append([]string(nil), c.versions...)}
+	}
+	if skew > 0 {
+		c.incidents = append(c.incidents, Incident{
+			Timestamp:  time.Now(),
+			Key:        key.String(),
+			WriteRV:    latestVersion(c.versions),
+			SeenRV:     seen,
+			CacheName:  c.cacheName,
+			StackTrace: string(debug.Stack()),
+		})
+	}
+	if skew > c.maxSkew {
+		c.maxSkew = skew
+	}
+
+	return err
+}
+
+func (c *skewClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	err := c.Client.Update(ctx, obj, opts...)
+	if err == nil && client.ObjectKeyFromObject(obj) == c.key {
+		c.addVersion(obj.GetResourceVersion())
+	}
+	return err
+}
+
+func (c *skewClient) addVersion(rv string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range c.versions {
+		if v == rv {
+			return
+		}
+	}
+	c.versions = append(c.versions, rv)
+}
+
+// Incidents returns a copy of the stale reads recorded so far.
+func (c *skewClient) Incidents() []Incident {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Incident(nil), c.incidents...)
+}
+
+// latestVersion returns the newest of the resourceVersions.
+func latestVersion(versions []string) string {
+	latest := ""
+	for _, v := range versions {
+		if latest == "" || olderThan(latest, v) {
+			latest = v
+		}
+	}
+	return latest
+}
+
+func (c *skewClient) observed() (stale bool, first StaleRead, maxSkew int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stale, c.firstStale, c.maxSkew
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestRunScenario(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	report, err := RunScenario(context.Background(), ScenarioConfig{
+		RestConfig:     rc,
+		Log:            logger,
+		RequeueOnStale: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	t.Logf("Report: %+v", report)
+
+	require.GreaterOrEqual(t, report.ReconcileCount, 1)
+	require.Greater(t, report.TimeToConverge, time.Duration(0))
+	require.Less(t, report.TimeToConverge, 10*time.Second)
+	if report.StaleReadObserved {
+		require.Greater(t, report.MaxSkew, 0)
+		if report.FirstStaleRead.ResourceVersion != "" {
+			require.NotEmpty(t, report.FirstStaleRead.Known)
+		}
+		require.NotEmpty(t, report.Incidents)
+	} else {
+		require.Equal(t, 0, report.MaxSkew)
+		require.Equal(t, StaleRead{}, report.FirstStaleRead)
+		require.Empty(t, report.Incidents)
+	}
+}
+
+// The large Secrets must get annotated too. Whether they make the race more
+// likely is only logged, since a handful of runs can't tell for sure.
+func TestRunScenario_LargeSecret(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const runs = 5
+	stale := map[int]int{}
+	for _, size := range []int{0, 256 << 10} {
+		for i := 0; i < runs; i++ {
+			report, err := RunScenario(context.Background(), ScenarioConfig{
+				RestConfig:     rc,
+				Log:            logger,
+				Name:           fmt.Sprintf("secret-%d-%d", size, i),
+				RequeueOnStale: 100 * time.Millisecond,
+				DataSizeBytes:  size,
+			})
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, report.ReconcileCount, 1)
+			if report.StaleReadObserved {
+				stale[size]++
+			}
+		}
+	}
+	t.Logf("Stale reads: %d/%d with no data, %d/%d with 256KiB of data", stale[0], runs, stale[256<<10], runs)
+}
+
+// Two managers that run as two distinct users each have their own cache; the
+// Secrets get annotated either way. The stale reads are only logged.
+func TestRunScenario_Impersonate(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme, rbacv1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+	require.NoError(t, kc.Create(ctx, &rbacv1.ClusterRole{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret-annotator"},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{""},
+			Resources: []string{"secrets"},
+			Verbs:     []string{"get", "list", "watch", "update"},
+		}},
+	}))
+	require.NoError(t, kc.Create(ctx, &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret-annotator"},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "secret-annotator"},
+		Subjects: []rbacv1.Subject{
+			{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: "alice"},
+			{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: "bob"},
+		},
+	}))
+
+	users := []string{"alice", "bob"}
+	reports := make([]Report, len(users))
+	errs := make([]error, len(users))
+	var wg sync.WaitGroup
+	for i, user := range users {
+		wg.Add(1)
+		go func(i int, user string) {
+			defer wg.Done()
+			reports[i], errs[i] = RunScenario(ctx, ScenarioConfig{
+				RestConfig:     rc,
+				Log:            logger.WithName(user),
+				Name:           "secret-" + user,
+				RequeueOnStale: 100 * time.Millisecond,
+				Impersonate:    rest.ImpersonationConfig{UserName: user},
+			})
+		}(i, user)
+	}
+	wg.Wait()
+	for i, user := range users {
+		require.NoError(t, errs[i], user)
+		require.GreaterOrEqual(t, reports[i].ReconcileCount, 1, user)
+		t.Logf("Report for %s: %+v", user, reports[i])
+	}
+
+	t.Log("A user that can't watch the Secrets never gets its cache synced")
+	mallory, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	_, err = RunScenario(mallory, ScenarioConfig{
+		RestConfig:  rc,
+		Log:         logger.WithName("mallory"),
+		Name:        "secret-mallory",
+		Impersonate: rest.ImpersonationConfig{UserName: "mallory"},
+	})
+	require.Error(t, err)
+}
+
+func TestRunScenario_ClientQPS(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	tests := []struct {
+		name     string
+		qps      float32
+		burst    int
+		requests *requestRateCounter
+	}{
+		{name: "unthrottled", qps: -1, requests: &requestRateCounter{userAgent: ManagerUserAgent}},
+		{name: "throttled", qps: 10, burst: 1, requests: &requestRateCounter{userAgent: ManagerUserAgent}},
+	}
+	for _, tt := range tests {
+		counted := rest.CopyConfig(rc)
+		requests := tt.requests
+		counted.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+			return requestRateRoundTripper{next: rt, requests: requests}
+		})
+
+		report, err := RunScenario(context.Background(), ScenarioConfig{
+			RestConfig:     counted,
+			Log:            logger,
+			Name:           "secret-" + tt.name,
+			Timeout:        20 * time.Second,
+			RequeueOnStale: 100 * time.Millisecond,
+			ClientQPS:      tt.qps,
+			ClientBurst:    tt.burst,
+		})
+		require.NoError(t, err)
+		t.Logf("%s: stale read observed: %v, %d requests at %.1f requests/s", tt.name, report.StaleReadObserved, tt.requests.count(), tt.requests.rate())
+	}
+
+	unthrottled, throttled := tests[0].requests, tests[1].requests
+	require.Less(t, throttled.rate(), unthrottled.rate())
+	require.LessOrEqual(t, throttled.rate(), 12.0, "the rate limiter allows about 10 requests/s")
+}
+
+// requestRateCounter records when the requests made with the given user agent
+// were sent.
+type requestRateCounter struct {
+	userAgent string
+
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (c *requestRateCounter) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.times)
+}
+
+// rate returns the number of requests per second between the first and the
+// last request.
+func (c *requestRateCounter) rate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.times) < 2 {
+		return 0
+	}
+	return float64(len(c.times)-1) / c.times[len(c.times)-1].Sub(c.times[0]).Seconds()
+}
+
+type requestRateRoundTripper struct {
+	next     http.RoundTripper
+	requests *requestRateCounter
+}
+
+func (rt requestRateRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == rt.requests.userAgent {
+		rt.requests.mu.Lock()
+		rt.requests.times = append(rt.requests.times, time.Now())
+		rt.requests.mu.Unlock()
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// AssertRaceDoesNotReproduce runs the scenario the given number of times and
+// fails the test as soon as a stale read is observed, which is how a fix of
+// the race gets verified. Each run creates its own Secret, named after
+// cfg.Name with the iteration appended.
+func AssertRaceDoesNotReproduce(t *testing.T, cfg ScenarioConfig, iterations int) {
+	t.Helper()
+	base := cfg.withDefaults().Name
+	for i := 1; i <= iterations; i++ {
+		cfg.Name = fmt.Sprintf("%s-%d", base, i)
+		report, err := RunScenario(context.Background(), cfg)
+		if report.StaleReadObserved {
+			stale := report.FirstStaleRead
+			got := stale.ResourceVersion
+			if got == "" {
+				got = "nothing"
+			}
+			t.Fatalf("iteration %d/%d: the race reproduced: the cache returned %s for %s/%s while the apiserver had the resourceVersions %v", i, iterations, got, cfg.withDefaults().Namespace, cfg.Name, stale.Known)
+		}
+		if err != nil {
+			t.Fatalf("iteration %d/%d: %v", i, iterations, err)
+		}
+	}
+}
+
+func TestAssertRaceDoesNotReproduce(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	// Without a cache to read from, the race can't happen.
+	AssertRaceDoesNotReproduce(t, ScenarioConfig{
+		RestConfig:   rc,
+		Log:          logger,
+		ClientWiring: ClientWiringDirect,
+	}, 10)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// BuildScheme creates a scheme and registers the types of each adder, e.g.
+// corev1.AddToScheme. All the adders are applied even if one of them fails; the
+// returned error aggregates the failures.
+func BuildScheme(adders ...func(*runtime.Scheme) error) (*runtime.Scheme, error) {
+	scheme := runtime.NewScheme()
+
+	var errs []error
+	for _, add := range adders {
+		err := add(scheme)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return scheme, utilerrors.NewAggregate(errs)
+}
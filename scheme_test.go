@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestBuildScheme(t *testing.T) {
+	t.Run("registers the types of all the adders", func(t *testing.T) {
+		scheme, err := BuildScheme(corev1.AddToScheme, appsv1.AddToScheme)
+		require.NoError(t, err)
+		assert.True(t, scheme.Recognizes(corev1.SchemeGroupVersion.WithKind("Secret")))
+		assert.True(t, scheme.Recognizes(appsv1.SchemeGroupVersion.WithKind("Deployment")))
+	})
+
+	t.Run("aggregates the errors", func(t *testing.T) {
+		failing := func(msg string) func(*runtime.Scheme) error {
+			return func(*runtime.Scheme) error { return errors.New(msg) }
+		}
+		scheme, err := BuildScheme(failing("foo"), corev1.AddToScheme, failing("bar"))
+		require.EqualError(t, err, "[foo, bar]")
+		assert.True(t, scheme.Recognizes(corev1.SchemeGroupVersion.WithKind("Secret")))
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RunLabelKey is the label that tags the Secrets created during a run, e.g.,
+// with ScenarioConfig.RunLabel, so that CleanupByLabel can delete them
+// afterwards.
+const RunLabelKey = "cacherace.io/run"
+
+// SeedSecrets creates count copies of template in the namespace ns. The copies
+// are named after the template's name followed by their index, e.g.,
+// secret-0, secret-1, and so on; the name defaults to "secret". When the
+// template has a generateName instead, the apiserver picks the names.
+func SeedSecrets(ctx context.Context, c client.Client, ns string, count int, template corev1.Secret) error {
+	name := template.Name
+	if name == "" && template.GenerateName == "" {
+		name = "secret"
+	}
+
+	for i := 0; i < count; i++ {
+		secret := template.DeepCopy()
+		secret.Namespace = ns
+		secret.ResourceVersion = ""
+		if name != "" {
+			secret.Name = fmt.Sprintf("%s-%d", name, i)
+		}
+
+		err := c.Create(ctx, secret)
+		if err != nil {
+			return fmt.Errorf("while creating Secret %d out of %d in namespace %s: %w", i+1, count, ns, err)
+		}
+	}
+
+	return nil
+}
+
+// SeedLargeSecret creates the Secret ns/name with size bytes of data, which
+// is a way to see whether large objects make the cache fall further behind
+// than small ones.
+func SeedLargeSecret(ctx context.Context, c client.Client, ns, name string, size int) error {
+	err := c.Create(ctx, paddedSecret(ns, name, size))
+	if err != nil {
+		return fmt.Errorf("while creating Secret %s/%s with %d bytes of data: %w", ns, name, size, err)
+	}
+	return nil
+}
+
+// paddedSecret returns a Secret holding size bytes of data under the "padding"
+// key. A size of zero or less means no data at all.
+func paddedSecret(ns, name string, size int) *corev1.Secret {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns}}
+	if size > 0 {
+		secret.Data = map[string][]byte{"padding": bytes.Repeat([]byte{'x'}, size)}
+	}
+	return secret
+}
+
+// CleanupByLabel deletes the Secrets in the namespace ns whose RunLabelKey
+// label is set to label, in a single DeleteAllOf call. The other Secrets are
+// left alone, which makes it safe to use against a shared cluster.
+func CleanupByLabel(ctx context.Context, c client.Client, ns, label string) error {
+	err := c.DeleteAllOf(ctx, &corev1.Secret{}, client.InNamespace(ns), client.MatchingLabels{RunLabelKey: label})
+	if err != nil {
+		return fmt.Errorf("while deleting the Secrets with the label %s=%s in namespace %s: %w", RunLabelKey, label, ns, err)
+	}
+	return nil
+}
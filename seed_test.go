@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestSeedSecrets(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	template := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "seeded",
+			Labels: map[string]string{"app": "cache-race", "tier": "load"},
+		},
+		StringData: map[string]string{"foo": "bar"},
+	}
+	require.NoError(t, SeedSecrets(ctx, kc, "default", 20, template))
+
+	var list corev1.SecretList
+	require.NoError(t, kc.List(ctx, &list, client.InNamespace("default"), client.MatchingLabels(template.Labels)))
+	require.Len(t, list.Items, 20)
+
+	for _, secret := range list.Items {
+		require.Equal(t, template.Labels, secret.Labels)
+		require.Equal(t, []byte("bar"), secret.Data["foo"])
+	}
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprintf("seeded-%d", i))
+	}
+	sort.Strings(want)
+	require.Equal(t, want, SortedSecretNames(list))
+}
+
+func TestSeedLargeSecret(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	require.NoError(t, SeedLargeSecret(ctx, kc, "default", "large", 256<<10))
+
+	var secret corev1.Secret
+	require.NoError(t, kc.Get(ctx, client.ObjectKey{Namespace: "default", Name: "large"}, &secret))
+	require.Len(t, secret.Data["padding"], 256<<10)
+}
+
+func TestCleanupByLabel(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	for _, tmpl := range []corev1.Secret{
+		{ObjectMeta: metav1.ObjectMeta{Name: "run-1", Labels: map[string]string{RunLabelKey: "run-1"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "run-2", Labels: map[string]string{RunLabelKey: "run-2"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"}},
+	} {
+		require.NoError(t, SeedSecrets(ctx, kc, "default", 3, tmpl))
+	}
+	_, err = RunScenario(ctx, ScenarioConfig{
+		RestConfig:     rc,
+		Log:            logger,
+		Name:           "scenario",
+		RequeueOnStale: 100 * time.Millisecond,
+		RunLabel:       "run-1",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, CleanupByLabel(ctx, kc, "default", "run-1"))
+
+	var list corev1.SecretList
+	require.NoError(t, kc.List(ctx, &list, client.InNamespace("default")))
+	// The Secret created by RunScenario is gone too.
+	require.Equal(t, []string{"run-2-0", "run-2-1", "run-2-2", "unlabeled-0", "unlabeled-1", "unlabeled-2"}, SortedSecretNames(list))
+}
+
+// SortedSecretNames returns the names of the Secrets in lexicographic order,
+// which keeps the failures of the assertions on many Secrets readable: the
+// order of a list returned by the cache isn't stable.
+func SortedSecretNames(list corev1.SecretList) []string {
+	names := make([]string, 0, len(list.Items))
+	for _, secret := range list.Items {
+		names = append(names, secret.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSortedSecretNames(t *testing.T) {
+	secret := func(name string) corev1.Secret {
+		return corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	}
+	list := corev1.SecretList{Items: []corev1.Secret{secret("secret-2"), secret("secret-10"), secret("a"), secret("secret-1")}}
+
+	require.Equal(t, []string{"a", "secret-1", "secret-10", "secret-2"}, SortedSecretNames(list))
+	require.Equal(t, "secret-2", list.Items[0].Name, "the list must be left as is")
+	require.Empty(t, SortedSecretNames(corev1.SecretList{}))
+}
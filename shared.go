@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// SetupSharedInformerReconcilers sets up two Secret controllers, "secret-a"
+// and "secret-b", on the same manager, which add the annotations keyA=yes and
+// keyB=yes. Both watch the concrete Secrets, which means the two controllers
+// and their reads share one informer: the reconciles are triggered by the
+// informer they read from, and never find the cache behind. This is the
+// common setup, and the counterpart of the two caches that the
+// AnnotatingReconciler uses by default. When a Secret can't be found anyway,
+// it is requeued after requeueOnNotFound.
+func SetupSharedInformerReconcilers(mgr manager.Manager, keyA, keyB string, requeueOnNotFound time.Duration) error {
+	for name, key := range map[string]string{"secret-a": keyA, "secret-b": keyB} {
+		err := (&AnnotatingReconciler{
+			Client:            mgr.GetClient(),
+			Log:               mgr.GetLogger(),
+			Annotations:       map[string]string{key: "yes"},
+			WatchFullObject:   true,
+			RequeueOnNotFound: requeueOnNotFound,
+			Name:              name,
+		}).SetupWithManager(mgr)
+		if err != nil {
+			return fmt.Errorf("while setting up the %s controller: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+func TestSetupSharedInformerReconcilers(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	// staleReads creates a few Secrets, waits for both controllers to
+	// annotate them, and returns how many times a reconcile didn't find the
+	// Secret that triggered it.
+	staleReads := func(t *testing.T, prefix string, setup func(manager.Manager) error) int {
+		const timeout = 10 * time.Second
+		ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+		defer cancel()
+
+		log := NewCapturingLogger()
+		mgr, err := ctrl.NewManager(rc, ctrl.Options{
+			Scheme:             scheme,
+			Logger:             log,
+			MetricsBindAddress: "0",
+		})
+		require.NoError(t, err)
+		require.NoError(t, setup(mgr))
+		startManager(t, ctx, mgr)
+
+		// Same as in Test_secretController: the v1.Secret informer must
+		// already be running for the two-cache race to happen.
+		_ = mgr.GetClient().Get(ctx, types.NamespacedName{}, &corev1.Secret{})
+		time.Sleep(300 * time.Millisecond)
+
+		const runs = 20
+		var secrets []corev1.Secret
+		for i := 0; i < runs; i++ {
+			secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("%s-%d", prefix, i), Namespace: "default"}}
+			require.NoError(t, kc.Create(ctx, &secret))
+			secrets = append(secrets, secret)
+		}
+
+		t.Log("Waiting for every Secret to have both annotations")
+		require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+			for _, secret := range secrets {
+				err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+				if err != nil {
+					return false, err
+				}
+				if secret.Annotations["a-found"] != "yes" || secret.Annotations["b-found"] != "yes" {
+					return false, nil
+				}
+			}
+			return true, nil
+		}))
+
+		count := 0
+		for _, line := range log.Lines() {
+			if line.Msg == "secret not found, requeuing" {
+				count++
+			}
+		}
+		return count
+	}
+
+	shared := staleReads(t, "shared", func(mgr manager.Manager) error {
+		return SetupSharedInformerReconcilers(mgr, "a-found", "b-found", 100*time.Millisecond)
+	})
+	separate := staleReads(t, "separate", func(mgr manager.Manager) error {
+		for name, key := range map[string]string{"secret-a": "a-found", "secret-b": "b-found"} {
+			err := (&AnnotatingReconciler{
+				Client:            mgr.GetClient(),
+				Log:               mgr.GetLogger(),
+				Annotations:       map[string]string{key: "yes"},
+				RequeueOnNotFound: 100 * time.Millisecond,
+				Name:              name,
+			}).SetupWithManager(mgr)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// The race doesn't happen often enough with two caches to assert on it
+	// without making the test flaky, which is why it is only logged.
+	t.Logf("stale reads: %d with a shared informer, %d with a metadata informer and a concrete one", shared, separate)
+
+	require.Equal(t, 0, shared)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SnapshotCache lists the objects from c, usually the manager's client, and
+// returns their resourceVersions keyed by "namespace/name".
+func SnapshotCache(ctx context.Context, c client.Reader, list client.ObjectList, opts ...client.ListOption) (map[string]string, error) {
+	err := c.List(ctx, list, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("while listing %T: %w", list, err)
+	}
+	objs, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, fmt.Errorf("while extracting the items of %T: %w", list, err)
+	}
+
+	snapshot := make(map[string]string, len(objs))
+	for _, obj := range objs {
+		o, err := meta.Accessor(obj)
+		if err != nil {
+			return nil, fmt.Errorf("while reading the metadata of %T: %w", obj, err)
+		}
+		snapshot[client.ObjectKey{Namespace: o.GetNamespace(), Name: o.GetName()}.String()] = o.GetResourceVersion()
+	}
+	return snapshot, nil
+}
+
+// DiffCacheSnapshots returns the sorted keys of the objects that were added,
+// removed, or whose resourceVersion changed between the two snapshots taken
+// with SnapshotCache. Note that the periodic resync that ctrl.Options.SyncPeriod
+// sets up only replays the objects that the informer already has, so it
+// leaves the snapshot as is; only a relist, e.g., after the watch broke, or
+// a watch event changes it.
+func DiffCacheSnapshots(before, after map[string]string) (changed []string) {
+	for key, rv := range after {
+		if before[key] != rv {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
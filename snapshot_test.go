@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+func TestDiffCacheSnapshots(t *testing.T) {
+	before := map[string]string{"default/a": "1", "default/b": "2", "default/c": "3"}
+	after := map[string]string{"default/a": "1", "default/b": "5", "default/d": "6"}
+	require.Equal(t, []string{"default/b", "default/c", "default/d"}, DiffCacheSnapshots(before, after))
+	require.Empty(t, DiffCacheSnapshots(before, before))
+}
+
+func TestSnapshotCache_Resync(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 20 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	syncPeriod := time.Second
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+		SyncPeriod:         &syncPeriod,
+	})
+	require.NoError(t, err)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	key := client.ObjectKeyFromObject(&secret)
+	resyncs := countResyncs(t, mgr.GetCache(), key)
+	startManager(t, ctx, mgr)
+
+	require.NoError(t, kc.Create(ctx, &secret))
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := mgr.GetClient().Get(ctx, key, &corev1.Secret{})
+		return err == nil, client.IgnoreNotFound(err)
+	}))
+
+	before, err := SnapshotCache(ctx, mgr.GetClient(), &corev1.SecretList{}, client.InNamespace("default"))
+	require.NoError(t, err)
+	require.Equal(t, secret.ResourceVersion, before[key.String()])
+
+	t.Log("Waiting for a couple of resyncs, which shouldn't change the cache")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		return resyncs() >= 2, nil
+	}))
+	after, err := SnapshotCache(ctx, mgr.GetClient(), &corev1.SecretList{}, client.InNamespace("default"))
+	require.NoError(t, err)
+	require.Empty(t, DiffCacheSnapshots(before, after))
+}
+
+// Unlike a resync, the relist that follows a broken watch does bring the
+// cache up to date.
+func TestSnapshotCache_Relist(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 20 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	partitioner := &Partitioner{}
+	mgr, err := ctrl.NewManager(partitioner.Wrap(rc), ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	_, err = mgr.GetCache().GetInformer(ctx, &corev1.Secret{})
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		err := mgr.GetClient().Get(ctx, key, &corev1.Secret{})
+		return err == nil, client.IgnoreNotFound(err)
+	}))
+	before, err := SnapshotCache(ctx, mgr.GetClient(), &corev1.SecretList{}, client.InNamespace("default"))
+	require.NoError(t, err)
+
+	t.Log("Updating the Secret while the cache can't see it")
+	partitioner.SimulatePartition(2 * time.Second)
+	secret.Labels = map[string]string{"foo": "bar"}
+	require.NoError(t, kc.Update(ctx, &secret))
+	after, err := SnapshotCache(ctx, mgr.GetClient(), &corev1.SecretList{}, client.InNamespace("default"))
+	require.NoError(t, err)
+	require.Empty(t, DiffCacheSnapshots(before, after), "the cache should still be stale")
+
+	t.Log("Waiting for the relist that follows the partition")
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+		after, err = SnapshotCache(ctx, mgr.GetClient(), &corev1.SecretList{}, client.InNamespace("default"))
+		return len(DiffCacheSnapshots(before, after)) > 0, err
+	}))
+	require.Equal(t, []string{key.String()}, DiffCacheSnapshots(before, after))
+	require.Equal(t, secret.ResourceVersion, after[key.String()])
+}
+
+// countResyncs registers an event handler on the Secret informer of the
+// cache, creating the informer if needed, and returns a func that tells how
+// many times the Secret with the given key was resynced. A resync is an
+// update whose old and new objects have the same resourceVersion. The
+// handler is given the informer's resync period, i.e., the SyncPeriod.
+func countResyncs(t *testing.T, informers cache.Informers, key client.ObjectKey) func() int {
+	t.Helper()
+	var count int32
+	informer, err := informers.GetInformer(context.Background(), &corev1.Secret{})
+	require.NoError(t, err)
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSecret, newSecret := oldObj.(*corev1.Secret), newObj.(*corev1.Secret)
+			if client.ObjectKeyFromObject(newSecret) == key && oldSecret.ResourceVersion == newSecret.ResourceVersion {
+				atomic.AddInt32(&count, 1)
+			}
+		},
+	})
+	return func() int {
+		return int(atomic.LoadInt32(&count))
+	}
+}
+
+// AssertAnnotationSurvivesResync annotates the Secret with the given key with
+// wantKey=wantValue using c, which should read from the apiserver, waits for
+// the annotation to reach mgr's caches and for mgr's Secret informer to
+// resync the Secret, and fails the test if the annotation isn't there anymore,
+// either on the apiserver or in the caches, after the resync. This catches
+// resyncs that bring back an old, un-annotated version of the object. mgr
+// must have been created with ctrl.Options{SyncPeriod: &syncPeriod} and must
+// be started.
+func AssertAnnotationSurvivesResync(t *testing.T, mgr manager.Manager, c client.Client, key client.ObjectKey, wantKey, wantValue string, syncPeriod time.Duration) {
+	t.Helper()
+	ctx := context.Background()
+
+	resyncs := countResyncs(t, mgr.GetCache(), key)
+	var secret corev1.Secret
+	require.NoError(t, c.Get(ctx, key, &secret))
+	patch := client.MergeFrom(secret.DeepCopy())
+	metav1.SetMetaDataAnnotation(&secret.ObjectMeta, wantKey, wantValue)
+	require.NoError(t, c.Patch(ctx, &secret, patch))
+
+	err := waitAnnotationInBothCaches(mgr.GetClient(), mgr.GetClient(), key, wantKey, wantValue, 10*time.Second)
+	require.NoError(t, err, "%s: the annotation never reached the caches", key)
+
+	// The informers add up to 10% of jitter to the SyncPeriod.
+	before := resyncs()
+	within := 2*syncPeriod + 5*time.Second
+	err = pollUntil(ctx, 10*time.Millisecond, within, func() (bool, error) {
+		return resyncs() > before, nil
+	})
+	if err != nil {
+		t.Fatalf("%s: no resync within %s, was mgr created with a SyncPeriod of %s?", key, within, syncPeriod)
+	}
+
+	require.NoError(t, c.Get(ctx, key, &secret))
+	if secret.Annotations[wantKey] != wantValue {
+		t.Errorf("%s: after the resync, the apiserver has %s=%q, want %q", key, wantKey, secret.Annotations[wantKey], wantValue)
+	}
+	require.NoError(t, mgr.GetClient().Get(ctx, key, &secret))
+	if secret.Annotations[wantKey] != wantValue {
+		t.Errorf("%s: after the resync, the cache has %s=%q at version %s, want %q", key, wantKey, secret.Annotations[wantKey], secret.ResourceVersion, wantValue)
+	}
+	meta := &metav1.PartialObjectMetadata{}
+	meta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Secret"))
+	require.NoError(t, mgr.GetClient().Get(ctx, key, meta))
+	if meta.Annotations[wantKey] != wantValue {
+		t.Errorf("%s: after the resync, the metadata cache has %s=%q at version %s, want %q", key, wantKey, meta.Annotations[wantKey], meta.ResourceVersion, wantValue)
+	}
+}
+
+func TestAssertAnnotationSurvivesResync(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 30 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	syncPeriod := time.Second
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+		SyncPeriod:         &syncPeriod,
+	})
+	require.NoError(t, err)
+	err = (&AnnotatingReconciler{Client: mgr.GetClient(), Log: logger}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	key := client.ObjectKeyFromObject(&secret)
+
+	t.Log("The annotation should survive the resyncs, which also reconcile the Secret again")
+	AssertAnnotationSurvivesResync(t, mgr, kc, key, "example.com/owner", "team-a", syncPeriod)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// staleResync backs StaleResyncInterval. Every interval, it compares the
+// observed-rv annotation of the objects in the cache with the resourceVersion
+// of the same objects in the apiserver, and sends the ones that lag behind
+// to the controller as generic events.
+type staleResync struct {
+	r      *AnnotatingReconciler
+	events chan<- event.GenericEvent
+}
+
+func (s *staleResync) Start(ctx context.Context) error {
+	log := s.r.Log.WithName("stale-resync")
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		err := s.resync(ctx)
+		if err != nil {
+			log.Error(err, "while looking for stale objects")
+		}
+	}, s.r.StaleResyncInterval)
+	return nil
+}
+
+func (s *staleResync) resync(ctx context.Context) error {
+	gvk, err := apiutil.GVKForObject(s.r.newObject(), s.r.Client.Scheme())
+	if err != nil {
+		return fmt.Errorf("while finding the kind: %w", err)
+	}
+	newList := func() *metav1.PartialObjectMetadataList {
+		list := &metav1.PartialObjectMetadataList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		return list
+	}
+
+	live := newList()
+	err = s.r.APIReader.List(ctx, live)
+	if err != nil {
+		return fmt.Errorf("while listing the live objects: %w", err)
+	}
+	cached := newList()
+	err = s.r.Client.List(ctx, cached)
+	if err != nil {
+		return fmt.Errorf("while listing the cached objects: %w", err)
+	}
+	observed := make(map[client.ObjectKey]string, len(cached.Items))
+	for i := range cached.Items {
+		obj := &cached.Items[i]
+		observed[client.ObjectKeyFromObject(obj)] = obj.GetAnnotations()[ObservedRVAnnotation]
+	}
+
+	for i := range live.Items {
+		obj := &live.Items[i]
+		if !lagsBehind(observed[client.ObjectKeyFromObject(obj)], obj.GetResourceVersion(), s.r.StaleThreshold) {
+			continue
+		}
+		select {
+		case s.events <- event.GenericEvent{Object: obj}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// lagsBehind tells whether the observed resourceVersion is more than
+// threshold versions older than the live one. A missing or unparsable
+// observed resourceVersion always lags behind.
+func lagsBehind(observed, live string, threshold int) bool {
+	observedInt, err := strconv.ParseUint(observed, 10, 64)
+	if err != nil {
+		return true
+	}
+	liveInt, err := strconv.ParseUint(live, 10, 64)
+	if err != nil {
+		return false
+	}
+	return liveInt > observedInt && liveInt-observedInt > uint64(threshold)
+}
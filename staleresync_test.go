@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestAnnotatingReconciler_StaleResyncInterval(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 10 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		resync        time.Duration
+		wantAnnotated bool
+	}{
+		{name: "without-resync", resync: 0, wantAnnotated: false},
+		{name: "with-resync", resync: 500 * time.Millisecond, wantAnnotated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr, err := ctrl.NewManager(rc, ctrl.Options{
+				Scheme:             scheme,
+				Logger:             logger,
+				MetricsBindAddress: "0",
+			})
+			require.NoError(t, err)
+			// The read triggered by the ADDED event doesn't find the
+			// Secret and, without RequeueOnStale, nothing else happens
+			// to the Secret.
+			err = (&AnnotatingReconciler{
+				Client:              mgr.GetClient(),
+				Log:                 logger,
+				ReadFrom:            &staleClient{Client: mgr.GetClient(), staleGets: 1},
+				AnnotateObservedRV:  true,
+				APIReader:           mgr.GetAPIReader(),
+				StaleResyncInterval: tt.resync,
+				StaleThreshold:      5,
+			}).SetupWithManager(mgr)
+			require.NoError(t, err)
+
+			mgrCtx, stop := context.WithCancel(ctx)
+			defer stop()
+			startManager(t, mgrCtx, mgr)
+
+			secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: tt.name, Namespace: "default"}}
+			require.NoError(t, kc.Create(ctx, &secret))
+
+			if !tt.wantAnnotated {
+				time.Sleep(2 * time.Second)
+				require.NoError(t, kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret))
+				require.Empty(t, secret.Annotations)
+				return
+			}
+			require.NoError(t, pollUntil(ctx, 10*time.Millisecond, timeout, func() (bool, error) {
+				err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+				return secret.Annotations["secret-found"] == "yes", err
+			}))
+			require.NotEmpty(t, secret.Annotations[ObservedRVAnnotation])
+		})
+	}
+}
+
+func TestAnnotatingReconciler_StaleThreshold(t *testing.T) {
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		observedRV string
+		wantWrite  bool
+	}{
+		{name: "within the threshold", observedRV: "997", wantWrite: false},
+		{name: "beyond the threshold", observedRV: "900", wantWrite: true},
+		{name: "missing", observedRV: "", wantWrite: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"secret-found": "yes"}
+			if tt.observedRV != "" {
+				annotations[ObservedRVAnnotation] = tt.observedRV
+			}
+			// The fake client gives the resourceVersion 999 to the objects
+			// it is built with.
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default", Annotations: annotations}}
+			c := &faultyClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(secret).Build()}
+			r := &AnnotatingReconciler{Client: c, Log: NewCapturingLogger(), AnnotateObservedRV: true, StaleThreshold: 5}
+
+			_, err := r.Reconcile(context.Background(), reconcile.Request{NamespacedName: client.ObjectKeyFromObject(secret)})
+			require.NoError(t, err)
+			if !tt.wantWrite {
+				require.Equal(t, 0, c.updates)
+				return
+			}
+			require.Equal(t, 1, c.updates)
+			require.NoError(t, c.Get(context.Background(), client.ObjectKeyFromObject(secret), secret))
+			require.Equal(t, "999", secret.Annotations[ObservedRVAnnotation])
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The module targets Go 1.17, which has no native fuzzing: the stress test
+// draws its operations from a seeded RNG instead. The interleavings still
+// depend on the scheduler, but a failing sequence of operations can be
+// replayed with the same seed.
+var stressSeed = flag.Int64("stress-seed", 1, "Seed of the operations run by TestReconcileConcurrencyStress.")
+
+func TestReconcileConcurrencyStress(t *testing.T) {
+	logger := setupTestLogger(t)
+	t.Logf("seed: %d (use -stress-seed to change it)", *stressSeed)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	const timeout = 30 * time.Second
+	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	mgr, err := ctrl.NewManager(rc, ctrl.Options{
+		Scheme:             scheme,
+		Logger:             logger,
+		MetricsBindAddress: "0",
+	})
+	require.NoError(t, err)
+	// The stale reads are requeued, otherwise the Secrets that lose the race
+	// would never get annotated.
+	err = (&AnnotatingReconciler{
+		Client:                  mgr.GetClient(),
+		Log:                     logger,
+		RequeueOnStale:          100 * time.Millisecond,
+		MaxConcurrentReconciles: 4,
+	}).SetupWithManager(mgr)
+	require.NoError(t, err)
+	startManager(t, ctx, mgr)
+	_ = mgr.GetClient().Get(ctx, types.NamespacedName{}, &corev1.Secret{})
+
+	const workers, ops = 4, 50
+	labels := map[string]string{"stress": "true"}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(*stressSeed + int64(w)))
+			var live []string
+			created := 0
+			for i := 0; i < ops; i++ {
+				err := stressOp(ctx, kc, rng, labels, fmt.Sprintf("worker-%d", w), &live, &created)
+				if err != nil {
+					t.Errorf("worker %d, op %d: %v", w, i, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.False(t, t.Failed())
+
+	t.Log("Waiting for every surviving Secret to be annotated")
+	var list corev1.SecretList
+	require.NoError(t, pollUntil(ctx, 100*time.Millisecond, timeout, func() (bool, error) {
+		err := kc.List(ctx, &list, client.InNamespace("default"), client.MatchingLabels(labels))
+		if err != nil {
+			return false, err
+		}
+		for _, secret := range list.Items {
+			if secret.Annotations["secret-found"] != "yes" {
+				return false, nil
+			}
+		}
+		return true, nil
+	}))
+	t.Logf("%d Secrets survived", len(list.Items))
+
+	AssertCacheMatchesServer(t, mgr.GetClient(), mgr.GetAPIReader(), &corev1.SecretList{}, 10*time.Second, client.InNamespace("default"), client.MatchingLabels(labels))
+}
+
+// stressOp creates, updates or deletes one of the worker's Secrets, at random.
+// live holds the names of the worker's Secrets that still exist.
+func stressOp(ctx context.Context, kc client.Client, rng *rand.Rand, labels map[string]string, prefix string, live *[]string, created *int) error {
+	n := rng.Intn(10)
+	switch {
+	case n < 5 || len(*live) == 0:
+		name := fmt.Sprintf("%s-%d", prefix, *created)
+		*created++
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels}}
+		err := kc.Create(ctx, &secret)
+		if err != nil {
+			return fmt.Errorf("while creating %s: %w", name, err)
+		}
+		*live = append(*live, name)
+	case n < 8:
+		// A merge patch doesn't conflict with the reconciler's writes.
+		name := (*live)[rng.Intn(len(*live))]
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		patch := client.RawPatch(types.MergePatchType, []byte(fmt.Sprintf(`{"stringData":{"n":%q}}`, fmt.Sprint(rng.Int()))))
+		err := kc.Patch(ctx, &secret, patch)
+		if err != nil {
+			return fmt.Errorf("while updating %s: %w", name, err)
+		}
+	default:
+		i := rng.Intn(len(*live))
+		name := (*live)[i]
+		secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+		err := kc.Delete(ctx, &secret)
+		if err != nil {
+			return fmt.Errorf("while deleting %s: %w", name, err)
+		}
+		*live = append((*live)[:i], (*live)[i+1:]...)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RenderTimeline returns a table with one line per informer event, as
+// recorded by the EventLog, and two lines per reconcile, as recorded by the
+// ReconcileRecorder: one for its start and one for its end. The lines are
+// sorted by time, which is shown relative to the first line; two lines at the
+// same time keep the order of the arguments, events first. The apiserver's
+// writes show up as the events they cause, along with their resourceVersion.
+// A reconcile that starts before the event carrying the object it reads is
+// what the race looks like.
+func RenderTimeline(events []Event, reconciles []ReconcileEvent) string {
+	type entry struct {
+		at                        time.Time
+		source, what, key, detail string
+	}
+	var entries []entry
+	for _, e := range events {
+		entries = append(entries, entry{
+			at:     e.Time,
+			source: "informer",
+			what:   e.Verb,
+			key:    e.Namespace + "/" + e.Name,
+			detail: fmt.Sprintf("%s resourceVersion=%s", e.Kind, e.ResourceVersion),
+		})
+	}
+	for _, r := range reconciles {
+		entries = append(entries, entry{at: r.Start, source: "reconcile", what: "start", key: r.Key})
+		end := entry{at: r.End, source: "reconcile", what: "end", key: r.Key}
+		switch {
+		case r.Err != nil:
+			end.detail = "error: " + r.Err.Error()
+		case r.Result.RequeueAfter > 0:
+			end.detail = "requeue after " + r.Result.RequeueAfter.String()
+		case r.Result.Requeue:
+			end.detail = "requeue"
+		}
+		entries = append(entries, end)
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].at.Before(entries[j].at)
+	})
+
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	first := entries[0].at
+	for _, e := range entries {
+		line := fmt.Sprintf("+%.3fs\t%s\t%s\t%s", e.at.Sub(first).Seconds(), e.source, e.what, e.key)
+		if e.detail != "" {
+			line += "\t" + e.detail
+		}
+		fmt.Fprintln(w, line)
+	}
+	_ = w.Flush()
+	return b.String()
+}
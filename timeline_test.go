@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestRenderTimeline(t *testing.T) {
+	t0 := time.Date(2021, 9, 20, 10, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+
+	events := []Event{
+		{Time: at(0), Verb: VerbAdd, Kind: "Secret", Namespace: "default", Name: "secret-1", ResourceVersion: "216"},
+		{Time: at(40), Verb: VerbUpdate, Kind: "Secret", Namespace: "default", Name: "secret-1", ResourceVersion: "217"},
+	}
+	reconciles := []ReconcileEvent{
+		{Key: "default/secret-1", Start: at(30), End: at(35)},
+		{Key: "default/secret-1", Start: at(10), End: at(20), Result: reconcile.Result{RequeueAfter: 100 * time.Millisecond}},
+		{Key: "default/secret-1", Start: at(50), End: at(60), Err: errors.New("conflict")},
+	}
+
+	got := RenderTimeline(events, reconciles)
+	t.Logf("Timeline:\n%s", got)
+
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	var whats []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		require.GreaterOrEqual(t, len(fields), 4, "line %q", line)
+		whats = append(whats, fields[0]+" "+fields[1]+" "+fields[2])
+	}
+	require.Equal(t, []string{
+		"+0.000s informer add",
+		"+0.010s reconcile start",
+		"+0.020s reconcile end",
+		"+0.030s reconcile start",
+		"+0.035s reconcile end",
+		"+0.040s informer update",
+		"+0.050s reconcile start",
+		"+0.060s reconcile end",
+	}, whats)
+	require.Contains(t, lines[0], "resourceVersion=216")
+	require.Contains(t, lines[2], "requeue after 100ms")
+	require.Contains(t, lines[7], "error: conflict")
+
+	require.Empty(t, RenderTimeline(nil, nil))
+}
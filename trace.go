@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/trace"
+)
+
+// startTrace starts the runtime execution tracer, which records the
+// scheduling of every goroutine, e.g., the reflectors' and the reconcile
+// workers', into the file at path. The stop func stops the tracer and closes
+// the file; the trace can then be opened with:
+//
+//	go tool trace trace.out
+//
+// The reconciles show up as "reconcile" regions. When the tracer isn't
+// started, the regions cost next to nothing.
+func startTrace(path string) (stop func() error, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("while creating the trace file: %w", err)
+	}
+	err = trace.Start(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("while starting the tracer: %w", err)
+	}
+	return func() error {
+		trace.Stop()
+		err := f.Close()
+		if err != nil {
+			return fmt.Errorf("while writing the trace file: %w", err)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The trace is written while the command runs, as with --trace-out.
+func TestRun_TraceOut(t *testing.T) {
+	logger := setupTestLogger(t)
+
+	scheme, err := BuildScheme(corev1.AddToScheme)
+	require.NoError(t, err)
+	rc := startTestEnv(t, scheme)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+
+	kc, err := client.New(rc, client.Options{Scheme: scheme})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "trace.out")
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- run(runCtx, rc, logger, runOptions{MetricsAddr: "0", TraceOut: path})
+	}()
+
+	secret := corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "secret-1", Namespace: "default"}}
+	require.NoError(t, kc.Create(ctx, &secret))
+	require.NoError(t, pollUntil(ctx, 10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		err := kc.Get(ctx, client.ObjectKeyFromObject(&secret), &secret)
+		return secret.Annotations["secret-found"] == "yes", err
+	}))
+	stop()
+	require.NoError(t, <-done)
+
+	trace, err := os.ReadFile(path)
+	require.NoError(t, err)
+	// The header is of the form "go 1.17 trace\x00\x00\x00".
+	require.Greater(t, len(trace), 16)
+	require.True(t, bytes.HasPrefix(trace, []byte("go 1.")), "not a trace header: %q", trace[:16])
+	require.True(t, bytes.Contains(trace, []byte("reconcile")), "the trace has no reconcile region")
+}